@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+// Audited resources.
+const (
+	auditBucket       = "bucket"
+	auditBucketItem   = "bucketItem"
+	auditCategory     = "category"
+	auditTemplate     = "template"
+	auditTemplateItem = "templateItem"
+)
+
+// Audited actions.
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete"
+	auditRestore = "restore" // out of the trash
+)
+
+// auditActorHeader names who is making the request. Without it changes are
+// recorded against anonymousActor. Bucket items posted by the scheduler are
+// recorded against schedulerActor.
+const (
+	auditActorHeader = "X-Actor"
+	anonymousActor   = "anonymous"
+	schedulerActor   = "scheduler"
+)
+
+// AuditEntry records one change to a resource. Entries are only ever added,
+// never updated or removed. Before is nil for a create and After for a
+// delete; both hold the resource as the api renders it.
+type AuditEntry struct {
+	ID         int       `db:"id,omitempty" json:"id"`
+	Actor      string    `db:"actor" json:"actor"`
+	At         time.Time `db:"changedAt" json:"at"`
+	Resource   string    `db:"resource" json:"resource"`
+	ResourceID int       `db:"resourceID" json:"resourceID"`
+	Action     string    `db:"action" json:"action"`
+	Before     *string   `db:"beforeJSON" json:"-"`
+	After      *string   `db:"afterJSON" json:"-"`
+}
+
+// AuditFilter narrows down GetAuditEntries. Zero fields don't filter.
+type AuditFilter struct {
+	Resource   string
+	ResourceID int
+	Actor      string
+	From       time.Time // inclusive
+	To         time.Time // exclusive
+}
+
+// auditEntryCursor places an AuditEntry in the newest first order of
+// GetAuditEntries.
+func auditEntryCursor(entry *AuditEntry) Cursor {
+	return Cursor{Key: timeKey(entry.At), ID: entry.ID}
+}
+
+// matches reports whether the entry passes the filter.
+func (f AuditFilter) matches(entry *AuditEntry) bool {
+	return (f.Resource == "" || entry.Resource == f.Resource) &&
+		(f.ResourceID == 0 || entry.ResourceID == f.ResourceID) &&
+		(f.Actor == "" || entry.Actor == f.Actor) &&
+		(f.From.IsZero() || !entry.At.Before(f.From)) &&
+		(f.To.IsZero() || entry.At.Before(f.To))
+}
+
+// snapshot renders v as JSON for an audit entry.
+func snapshot(v interface{}) *string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return nil
+	}
+	s := string(data)
+	return &s
+}
+
+// auditActor returns who is making the request.
+func auditActor(r *http.Request) string {
+	if actor := strings.TrimSpace(r.Header.Get(auditActorHeader)); actor != "" {
+		return actor
+	}
+	return anonymousActor
+}
+
+// recordAudit adds an entry for a change the request made. The change has
+// already been stored by then, so a failure is logged rather than failing
+// the request.
+func recordAudit(r *http.Request, resource string, resourceID int, action string, before *string, after *string) {
+	recordAuditBy(getStore(r), auditActor(r), resource, resourceID, action, before, after)
+}
+
+// recordAuditBy adds an entry for a change actor made, like recordAudit.
+func recordAuditBy(store Store, actor string, resource string, resourceID int, action string, before *string, after *string) {
+	entry := &AuditEntry{
+		Actor:      actor,
+		At:         time.Now().UTC(),
+		Resource:   resource,
+		ResourceID: resourceID,
+		Action:     action,
+		Before:     before,
+		After:      after,
+	}
+	if err := store.NewAuditEntry(entry); err != nil {
+		log.Printf("audit: %s %s %d: %v", action, resource, resourceID, err)
+	}
+}
+
+// legSnapshots snapshots the bucket items of a transfer by id, to audit a
+// change to the transfer that rewrites both of them. A failure is logged
+// and leaves the items out.
+func legSnapshots(store Store, transferID int) map[int]*string {
+	legs, err := store.GetTransferBucketItems(transferID)
+	if err != nil {
+		log.Printf("audit: transfer %d: %v", transferID, err)
+		return nil
+	}
+	snapshots := map[int]*string{}
+	for _, leg := range legs {
+		snapshots[leg.ID] = snapshot(leg)
+	}
+	return snapshots
+}
+
+// recordLegsAudit adds an entry for every bucket item of a transfer the
+// request changed, given legSnapshots of them before and after the change.
+func recordLegsAudit(r *http.Request, action string, before map[int]*string, after map[int]*string) {
+	var ids []int
+	for id := range before {
+		ids = append(ids, id)
+	}
+	for id := range after {
+		if _, ok := before[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		recordAudit(r, auditBucketItem, id, action, before[id], after[id])
+	}
+}
+
+// recordChanges adds an entry for every record a removal deleted or moved
+// along with the one the request removed.
+func recordChanges(r *http.Request, changes []Change) {
+	for _, change := range changes {
+		if change.After == nil {
+			recordAudit(r, change.Resource, change.ID, auditDelete, snapshot(change.Before), nil)
+		} else {
+			recordAudit(r, change.Resource, change.ID, auditUpdate, snapshot(change.Before), snapshot(change.After))
+		}
+	}
+}
+
+// listAudit lists the audit entries, newest first, filtered by ?resource=,
+// ?resourceID=, ?actor= and the ?from= and ?to= time range.
+func listAudit(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	filter := AuditFilter{Resource: qs.Get("resource"), Actor: qs.Get("actor")}
+	if resourceID := qs.Get("resourceID"); resourceID != "" {
+		id, err := strconv.Atoi(resourceID)
+		if err != nil {
+			render.Render(w, r, ErrInvalidRequest(errors.New("resourceID must be a number")))
+			return
+		}
+		filter.ResourceID = id
+	}
+	page, err := pageFromRequest(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if from := qs.Get("from"); from != "" {
+		if filter.From, err = parseTimeParam(from, false); err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+	}
+	if to := qs.Get("to"); to != "" {
+		if filter.To, err = parseTimeParam(to, true); err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+	}
+
+	entries, info, err := getStore(r).GetAuditEntries(filter, page)
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+	setPageHeaders(w, r, page, info)
+	if err := render.RenderList(w, r, newAuditListResponse(entries)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// listBucketItemHistory lists the changes to one BucketItem, newest first.
+// It outlives the item, so deleted items keep their history.
+func listBucketItemHistory(w http.ResponseWriter, r *http.Request) {
+	bucketItemID, ok := urlParamID(r, "bucketItemID")
+	if !ok {
+		render.Render(w, r, ErrInvalidID("bucketItemID"))
+		return
+	}
+	page, err := pageFromRequest(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	entries, info, err := getStore(r).GetAuditEntries(AuditFilter{Resource: auditBucketItem, ResourceID: bucketItemID}, page)
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+	if info.Total == 0 {
+		render.Render(w, r, ErrNotFound)
+		return
+	}
+	setPageHeaders(w, r, page, info)
+	if err := render.RenderList(w, r, newAuditListResponse(entries)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// AuditEntryResponse is the response payload for the AuditEntry data
+// model, with the snapshots inlined as JSON.
+type AuditEntryResponse struct {
+	*AuditEntry
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+func newAuditEntryResponse(entry *AuditEntry) *AuditEntryResponse {
+	return &AuditEntryResponse{AuditEntry: entry}
+}
+
+func (rd *AuditEntryResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	if rd.AuditEntry.Before != nil {
+		rd.Before = json.RawMessage(*rd.AuditEntry.Before)
+	}
+	if rd.AuditEntry.After != nil {
+		rd.After = json.RawMessage(*rd.AuditEntry.After)
+	}
+	return nil
+}
+
+func newAuditListResponse(entries []*AuditEntry) []render.Renderer {
+	list := []render.Renderer{}
+	for _, entry := range entries {
+		list = append(list, newAuditEntryResponse(entry))
+	}
+	return list
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAuditFilter(t *testing.T) {
+	at := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	entry := &AuditEntry{Actor: "sam", At: at, Resource: auditBucketItem, ResourceID: 7, Action: auditUpdate}
+	tests := []struct {
+		filter AuditFilter
+		want   bool
+	}{
+		{AuditFilter{}, true},
+		{AuditFilter{Resource: auditBucketItem}, true},
+		{AuditFilter{Resource: auditBucket}, false},
+		{AuditFilter{ResourceID: 7}, true},
+		{AuditFilter{ResourceID: 8}, false},
+		{AuditFilter{Actor: "sam"}, true},
+		{AuditFilter{Actor: "alex"}, false},
+		{AuditFilter{From: at}, true},
+		{AuditFilter{From: at.Add(time.Second)}, false},
+		{AuditFilter{To: at}, false},
+		{AuditFilter{To: at.Add(time.Second)}, true},
+		{AuditFilter{Resource: auditBucketItem, ResourceID: 7, Actor: "sam", From: at, To: at.Add(time.Hour)}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.matches(entry); got != tt.want {
+			t.Errorf("%+v matches = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+// auditedChange is an audit entry without its time and snapshots.
+type auditedChange struct {
+	Actor, Resource, Action string
+	ResourceID              int
+}
+
+// auditLog returns the entries of /audit narrowed down by query, oldest
+// first.
+func (ts *testServer) auditLog(query string) []auditedChange {
+	ts.t.Helper()
+	var entries []AuditEntry
+	ts.expect(http.StatusOK, &entries, "GET", "/audit"+query, "")
+	var changes []auditedChange
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		changes = append(changes, auditedChange{entry.Actor, entry.Resource, entry.Action, entry.ResourceID})
+	}
+	return changes
+}
+
+func TestBucketItemHistory(t *testing.T) {
+	ts := newTestServer(t)
+	ts.expect(http.StatusNotFound, nil, "GET", "/bucketItems/1/history", "")
+
+	var bucketItem BucketItem
+	ts.expect(http.StatusCreated, &bucketItem, "POST", "/bucketItems", `{"bucketID":1,"name":"fuel","w":"30.00","transaction":"2026-01-01T00:00:00Z"}`, auditActorHeader, "sam")
+	path := "/bucketItems/" + strconv.Itoa(bucketItem.ID)
+	ts.expect(http.StatusOK, nil, "PUT", path, `{"bucketID":1,"name":"fuel","w":"35.00","transaction":"2026-01-01T00:00:00Z"}`, auditActorHeader, "alex")
+	ts.expect(http.StatusOK, nil, "DELETE", path, "")
+
+	var entries []AuditEntryResponse
+	ts.expect(http.StatusOK, &entries, "GET", path+"/history", "")
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Actor+" "+entry.Action)
+	}
+	want := []string{"anonymous delete", "alex update", "sam create"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("history %v, want %v", got, want)
+	}
+	if len(entries) == 3 && (string(entries[0].After) != "null" || string(entries[2].Before) != "null") {
+		t.Errorf("delete after %s, create before %s, want both null", entries[0].After, entries[2].Before)
+	}
+
+	tests := []struct {
+		query string
+		want  []auditedChange
+	}{
+		{"?actor=sam", []auditedChange{{"sam", auditBucketItem, auditCreate, bucketItem.ID}}},
+		{"?resource=bucketItem&resourceID=" + strconv.Itoa(bucketItem.ID) + "&actor=alex", []auditedChange{{"alex", auditBucketItem, auditUpdate, bucketItem.ID}}},
+		{"?resource=bucket", nil},
+		{"?to=2000-01-01", nil},
+	}
+	for _, tt := range tests {
+		if got := ts.auditLog(tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("/audit%s = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestRemovalsAreAudited(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want []auditedChange
+	}{
+		{"bucket cascade", "/buckets/1?cascade=true", []auditedChange{
+			{"sam", auditBucketItem, auditDelete, 1},
+			{"sam", auditTemplateItem, auditDelete, 1},
+			{"sam", auditBucket, auditDelete, 1},
+		}},
+		{"bucket reassign", "/buckets/1?reassignTo=2", []auditedChange{
+			{"sam", auditBucketItem, auditUpdate, 1},
+			{"sam", auditTemplateItem, auditUpdate, 1},
+			{"sam", auditBucket, auditDelete, 1},
+		}},
+		{"category cascade", "/categories/1?cascade=true", []auditedChange{
+			{"sam", auditBucketItem, auditDelete, 1},
+			{"sam", auditTemplateItem, auditDelete, 1},
+			{"sam", auditBucket, auditDelete, 1},
+			{"sam", auditBucket, auditDelete, 2},
+			{"sam", auditCategory, auditDelete, 1},
+		}},
+		{"category reassign", "/categories/1?reassignTo=2", []auditedChange{
+			{"sam", auditBucket, auditUpdate, 1},
+			{"sam", auditBucket, auditUpdate, 2},
+			{"sam", auditCategory, auditDelete, 1},
+		}},
+		{"template cascade", "/templates/1?cascade=true", []auditedChange{
+			{"sam", auditTemplateItem, auditDelete, 1},
+			{"sam", auditTemplate, auditDelete, 1},
+		}},
+	}
+	for _, tt := range tests {
+		ts := newTestServer(t)
+		ts.expect(http.StatusOK, nil, "DELETE", tt.path, "", auditActorHeader, "sam")
+		if got := ts.auditLog("?actor=sam"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: audited %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
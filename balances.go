@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+// Intervals a balance history is reported in. Weeks start on Monday and
+// months on the 1st.
+const (
+	intervalDay   = "day"
+	intervalWeek  = "week"
+	intervalMonth = "month"
+)
+
+var balanceIntervals = []string{intervalDay, intervalWeek, intervalMonth}
+
+// maxBalancePeriods caps the length of a balance history, which is not
+// paged.
+const maxBalancePeriods = 1000
+
+// BalanceHistory is the balance of a bucket, or of the liquid buckets
+// together, at the end of every period of a balanceQuery.
+type BalanceHistory struct {
+	BucketID  int             `json:"bid,omitempty"`  // the bucket, or 0 for the liquid buckets
+	BucketIDs []int           `json:"bids,omitempty"` // the liquid buckets added up
+	Currency  string          `json:"cur"`
+	Interval  string          `json:"interval"`
+	Balances  []BalancePeriod `json:"balances"`
+}
+
+// BalancePeriod is the balance at the end of one period, counting every
+// bucket item up to and including its last day.
+type BalancePeriod struct {
+	Start   string `json:"start"` // first day, 2006-01-02
+	End     string `json:"end"`   // last day
+	Balance Money  `json:"balance"`
+}
+
+func (h *BalanceHistory) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+// balanceQuery is the history asked for with ?from=, ?to=, ?interval= and
+// ?currency=.
+type balanceQuery struct {
+	From     time.Time // the first day
+	To       time.Time // the last day
+	Interval string
+	Currency string // to convert to, or "" for the currency of the buckets
+
+	periods []BalancePeriod // the intervals from From to To
+}
+
+// balanceQueryFromRequest reads the balanceQuery of r. The history runs up
+// to today and back a year, by month, unless asked otherwise.
+func balanceQueryFromRequest(r *http.Request) (balanceQuery, error) {
+	qs := r.URL.Query()
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	q := balanceQuery{To: today, Interval: qs.Get("interval"), Currency: strings.ToUpper(qs.Get("currency"))}
+
+	var err error
+	if to := qs.Get("to"); to != "" {
+		if q.To, err = parseTimeParam(to, false); err != nil {
+			return q, err
+		}
+	}
+	q.To = q.To.UTC().Truncate(24 * time.Hour)
+	q.From = q.To.AddDate(-1, 0, 0)
+	if from := qs.Get("from"); from != "" {
+		if q.From, err = parseTimeParam(from, false); err != nil {
+			return q, err
+		}
+	}
+	q.From = q.From.UTC().Truncate(24 * time.Hour)
+	if q.From.After(q.To) {
+		return q, errors.New("from must not be after to")
+	}
+
+	if q.Interval == "" {
+		q.Interval = intervalMonth
+	}
+	if !containsString(balanceIntervals, q.Interval) {
+		return q, fmt.Errorf("interval must be one of %s", strings.Join(balanceIntervals, ", "))
+	}
+	if q.Currency != "" && !currencyPattern.MatchString(q.Currency) {
+		return q, errors.New("currency must be an ISO 4217 currency code")
+	}
+	q.periods, err = q.split()
+	return q, err
+}
+
+// split splits the days from q.From to q.To into whole intervals, the
+// first one holding q.From and the last one q.To.
+func (q balanceQuery) split() ([]BalancePeriod, error) {
+	start := q.From
+	switch q.Interval {
+	case intervalWeek:
+		start = start.AddDate(0, 0, -(int(start.Weekday())+6)%7)
+	case intervalMonth:
+		start = start.AddDate(0, 0, 1-start.Day())
+	}
+
+	var periods []BalancePeriod
+	for !start.After(q.To) {
+		if len(periods) == maxBalancePeriods {
+			return nil, fmt.Errorf("from and to span more than %d periods, use a longer interval", maxBalancePeriods)
+		}
+		next := start.AddDate(0, 0, 1)
+		switch q.Interval {
+		case intervalWeek:
+			next = start.AddDate(0, 0, 7)
+		case intervalMonth:
+			next = start.AddDate(0, 1, 0)
+		}
+		periods = append(periods, BalancePeriod{
+			Start: start.Format("2006-01-02"),
+			End:   next.AddDate(0, 0, -1).Format("2006-01-02"),
+		})
+		start = next
+	}
+	return periods, nil
+}
+
+// fillBalances sets the balance of every period to the sum of the daily
+// totals up to its end.
+func fillBalances(periods []BalancePeriod, dailyTotals []BucketDailyTotal) {
+	sort.Slice(dailyTotals, func(i, j int) bool { return dailyTotals[i].Day < dailyTotals[j].Day })
+	var balance Money
+	i := 0
+	for p := range periods {
+		for ; i < len(dailyTotals) && dailyTotals[i].Day <= periods[p].End; i++ {
+			balance += dailyTotals[i].Total
+		}
+		periods[p].Balance = balance
+	}
+}
+
+// balanceHistory adds up the daily totals of the buckets in bucketCurrency,
+// which maps them to their currencies, into the history q asks for, in
+// currency. Buckets already held in currency have everything before q.From
+// loaded as one opening total; the others are converted day by day, so
+// their whole history up to q.To is needed.
+func balanceHistory(store Store, q balanceQuery, bucketCurrency map[int]string, currency string) (*BalanceHistory, error) {
+	var same, other []int
+	for bucketID, bucketCur := range bucketCurrency {
+		if bucketCur == currency {
+			same = append(same, bucketID)
+		} else {
+			other = append(other, bucketID)
+		}
+	}
+
+	var dailyTotals []BucketDailyTotal
+	if len(same) > 0 {
+		totals, err := store.GetBucketDailyTotals(DailyTotalFilter{BucketIDs: same, From: q.From, To: q.To})
+		if err != nil {
+			return nil, err
+		}
+		dailyTotals = append(dailyTotals, totals...)
+	}
+	if len(other) > 0 {
+		totals, err := store.GetBucketDailyTotals(DailyTotalFilter{BucketIDs: other, To: q.To})
+		if err != nil {
+			return nil, err
+		}
+		if totals, err = convertDailyTotals(store, totals, bucketCurrency, currency); err != nil {
+			return nil, err
+		}
+		dailyTotals = append(dailyTotals, totals...)
+	}
+	fillBalances(q.periods, dailyTotals)
+	return &BalanceHistory{Currency: currency, Interval: q.Interval, Balances: q.periods}, nil
+}
+
+// getBucketBalances returns the balance history of the Bucket loaded by
+// BucketCtx, in its own currency or the one given by ?currency=EUR.
+func getBucketBalances(w http.ResponseWriter, r *http.Request) {
+	bucket := r.Context().Value("bucket").(*Bucket)
+	q, err := balanceQueryFromRequest(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	currency := bucket.Currency
+	if q.Currency != "" {
+		currency = q.Currency
+	}
+
+	history, err := balanceHistory(getStore(r), q, map[int]string{bucket.Id: bucket.Currency}, currency)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	history.BucketID = bucket.Id
+	if err := render.Render(w, r, history); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// summarizeBalances returns the balance history of every liquid bucket
+// added up. Buckets of different currencies need ?currency= to be added up
+// in. Archived buckets are left out unless ?includeArchived=true.
+func summarizeBalances(w http.ResponseWriter, r *http.Request) {
+	q, err := balanceQueryFromRequest(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	bucketSummaries, err := getStore(r).SummarizeBuckets()
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+
+	bucketCurrency := map[int]string{}
+	var bucketIDs []int
+	currency := q.Currency
+	for _, bs := range bucketSummaries {
+		if !bs.IsLiquid || (bs.Archived || bs.CategoryArchived) && !includeArchived(r) {
+			continue
+		}
+		if q.Currency == "" && currency != "" && currency != bs.Currency {
+			render.Render(w, r, ErrInvalidRequest(errors.New("the liquid buckets hold different currencies, give the one to add them up in as currency")))
+			return
+		}
+		if q.Currency == "" {
+			currency = bs.Currency
+		}
+		bucketCurrency[bs.BucketID] = bs.Currency
+		bucketIDs = append(bucketIDs, bs.BucketID)
+	}
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	sort.Ints(bucketIDs)
+
+	history, err := balanceHistory(getStore(r), q, bucketCurrency, currency)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	history.BucketIDs = bucketIDs
+	if err := render.Render(w, r, history); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
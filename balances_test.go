@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBalanceQuerySplit(t *testing.T) {
+	tests := []struct {
+		interval string
+		from, to string
+		want     []string // start to end of every period
+		tooLong  bool
+	}{
+		{intervalDay, "2026-03-04", "2026-03-06", []string{"2026-03-04 2026-03-04", "2026-03-05 2026-03-05", "2026-03-06 2026-03-06"}, false},
+		{intervalDay, "2026-03-04", "2026-03-04", []string{"2026-03-04 2026-03-04"}, false},
+		{intervalWeek, "2026-03-04", "2026-03-16", []string{"2026-03-02 2026-03-08", "2026-03-09 2026-03-15", "2026-03-16 2026-03-22"}, false},
+		{intervalWeek, "2026-03-08", "2026-03-08", []string{"2026-03-02 2026-03-08"}, false},
+		{intervalMonth, "2026-01-31", "2026-03-01", []string{"2026-01-01 2026-01-31", "2026-02-01 2026-02-28", "2026-03-01 2026-03-31"}, false},
+		{intervalMonth, "2025-12-15", "2026-01-15", []string{"2025-12-01 2025-12-31", "2026-01-01 2026-01-31"}, false},
+		{intervalDay, "2020-01-01", "2026-01-01", nil, true},
+	}
+	for _, tt := range tests {
+		q := balanceQuery{From: day(tt.from), To: day(tt.to), Interval: tt.interval}
+		periods, err := q.split()
+		if tooLong := err != nil; tooLong != tt.tooLong {
+			t.Errorf("%s from %s to %s: split = %v, want too long %v", tt.interval, tt.from, tt.to, err, tt.tooLong)
+			continue
+		}
+		var got []string
+		for _, period := range periods {
+			got = append(got, period.Start+" "+period.End)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s from %s to %s: split = %v, want %v", tt.interval, tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestFillBalances(t *testing.T) {
+	q := balanceQuery{From: day("2026-03-01"), To: day("2026-03-21"), Interval: intervalWeek}
+	tests := []struct {
+		name        string
+		dailyTotals []BucketDailyTotal
+		want        []Money
+	}{
+		{"no items", nil, []Money{0, 0, 0, 0}},
+		{"opening total", []BucketDailyTotal{{Day: "2026-02-22", Total: 1000}}, []Money{1000, 1000, 1000, 1000}},
+		{"out of order", []BucketDailyTotal{
+			{Day: "2026-03-16", Total: -300},
+			{Day: "2026-02-22", Total: 1000},
+			{Day: "2026-03-08", Total: 200},
+			{Day: "2026-03-09", Total: 50},
+		}, []Money{1000, 1200, 1250, 950}},
+		{"two buckets on one day", []BucketDailyTotal{
+			{BucketID: 1, Day: "2026-03-10", Total: 500},
+			{BucketID: 2, Day: "2026-03-10", Total: -125},
+		}, []Money{0, 0, 375, 375}},
+		{"after the last period", []BucketDailyTotal{{Day: "2026-03-23", Total: 700}}, []Money{0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		periods, err := q.split()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fillBalances(periods, tt.dailyTotals)
+		var got []Money
+		for _, period := range periods {
+			got = append(got, period.Balance)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: balances %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
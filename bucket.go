@@ -2,42 +2,106 @@ package main
 
 import (
 	"context"
+	"errors"
 	"net/http"
-	"strconv"
+	"strings"
 
-	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 )
 
 type Bucket struct {
-	Name string `db:"name" json:"name"`
+	Name string `db:"name" json:"name" validate:"required,maxlen=100"`
 
 	Id int `db:"id,omitempty" json:"id"`
 
-	CategoryID int `db:"categoryID"  json:"categoryID"`
+	CategoryID int `db:"categoryID"  json:"categoryID" validate:"required,ref=category"`
 
-	Description string `db:"description"  json:"desc"`
+	Description string `db:"description"  json:"desc" validate:"maxlen=1000"`
 
 	IsLiquid bool `db:"isLiquid"  json:"liq"`
+
+	// Currency is the ISO 4217 code every item in the bucket is recorded in.
+	Currency string `db:"currency" json:"cur" validate:"currency"`
+
+	// Archived buckets keep their history but take no new items.
+	Archived bool `db:"archived" json:"archived"`
+
+	// Version is bumped by every update and sent as the ETag.
+	Version int `db:"version,omitempty" json:"version"`
 }
 
 type BucketSummary struct {
-	BucketID     int     `db:"bucketID" json:"bid"`
-	CategoryName string  `db:"categoryName" json:"cn"`
-	BucketName   string  `db:"bucketName" json:"bn"`
-	Total        float32 `db:"total" json:"t"`
-	IsLiquid     bool    `db:"isLiquid" json:"l"`
+	BucketID     int    `db:"bucketID" json:"bid"`
+	CategoryName string `db:"categoryName" json:"cn"`
+	BucketName   string `db:"bucketName" json:"bn"`
+	Total        Money  `db:"total" json:"t"`
+	Currency     string `db:"currency" json:"cur"`
+	IsLiquid     bool   `db:"isLiquid" json:"l"`
+
+	Archived         bool `db:"archived" json:"a,omitempty"` // the bucket or its category is archived
+	CategoryArchived bool `db:"categoryArchived" json:"-"`
+}
+
+// includeArchived reports whether ?includeArchived=true asks for archived
+// buckets and categories to be listed too.
+func includeArchived(r *http.Request) bool {
+	return r.URL.Query().Get("includeArchived") == "true"
 }
 
-// listBuckets lists out all the Buckets
+// bucketAcceptsItems returns why no new BucketItems can be posted to the
+// bucket, if anything: it doesn't exist, or it or its category is archived.
+// The problem is reported against field, the one naming the bucket.
+func bucketAcceptsItems(store Store, field string, bucketID int) *ValidationError {
+	bucket, err := store.GetBucket(bucketID)
+	if err != nil {
+		return fieldError(field, codeNotFound, "bucket %d does not exist", bucketID)
+	}
+	if bucket.Archived {
+		return fieldError(field, codeArchived, "bucket %d is archived", bucketID)
+	}
+	if category, err := store.GetCategory(bucket.CategoryID); err == nil && category.Archived {
+		return fieldError(field, codeArchived, "bucket %d is in archived category %d", bucketID, category.Id)
+	}
+	return nil
+}
+
+// listBuckets lists out the Buckets, leaving out archived ones and those of
+// archived categories unless ?includeArchived=true.
 func listBuckets(w http.ResponseWriter, r *http.Request) {
-	buckets, err := dbGetBuckets()
+	page, err := pageFromRequest(r)
 	if err != nil {
-		render.Render(w, r, ErrRender(err))
+		render.Render(w, r, ErrInvalidRequest(err))
 		return
 	}
 
-	if err = render.RenderList(w, r, newBucketListResponse(buckets)); err != nil {
+	buckets, err := getStore(r).GetBuckets()
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+
+	if !includeArchived(r) {
+		categories, err := getStore(r).GetCategories()
+		if err != nil {
+			render.Render(w, r, ErrStore(err))
+			return
+		}
+		archivedCategories := map[int]bool{}
+		for _, category := range categories {
+			archivedCategories[category.Id] = category.Archived
+		}
+		var open []*Bucket
+		for _, bucket := range buckets {
+			if !bucket.Archived && !archivedCategories[bucket.CategoryID] {
+				open = append(open, bucket)
+			}
+		}
+		buckets = open
+	}
+
+	start, end, info := page.paginate(buckets, func(i int) Cursor { return Cursor{ID: buckets[i].Id} }, false)
+	setPageHeaders(w, r, page, info)
+	if err = render.RenderList(w, r, newBucketListResponse(buckets[start:end])); err != nil {
 		render.Render(w, r, ErrRender(err))
 		return
 	}
@@ -48,18 +112,14 @@ func listBuckets(w http.ResponseWriter, r *http.Request) {
 // the Bucket could not be found, we stop here and return a 404.
 func BucketCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var bucket *Bucket
-		var err error
-
-		if bucketStr := chi.URLParam(r, "bucketID"); bucketStr != "" {
-			bucketID, _ := strconv.Atoi(bucketStr)
-			bucket, err = dbGetBucket(bucketID)
-		} else {
-			render.Render(w, r, ErrNotFound)
+		bucketID, ok := urlParamID(r, "bucketID")
+		if !ok {
+			render.Render(w, r, ErrInvalidID("bucketID"))
 			return
 		}
+		bucket, err := getStore(r).GetBucket(bucketID)
 		if err != nil {
-			render.Render(w, r, ErrNotFound)
+			render.Render(w, r, ErrStore(err))
 			return
 		}
 
@@ -78,7 +138,11 @@ func createBucket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	bucket := data.Bucket
-	dbNewBucket(bucket)
+	if err := getStore(r).NewBucket(bucket); err != nil {
+		render.Render(w, r, ErrUpdate(err))
+		return
+	}
+	recordAudit(r, auditBucket, bucket.Id, auditCreate, nil, snapshot(bucket))
 
 	render.Status(r, http.StatusCreated)
 	render.Render(w, r, newBucketResponse(bucket))
@@ -94,41 +158,123 @@ func getBucket(w http.ResponseWriter, r *http.Request) {
 	// middleware. The worst case, the recoverer middleware will save us.
 	bucket := r.Context().Value("bucket").(*Bucket)
 
+	setETag(w, bucket.Version)
 	if err := render.Render(w, r, newBucketResponse(bucket)); err != nil {
 		render.Render(w, r, ErrRender(err))
 		return
 	}
 }
 
+// summarizeBuckets totals every bucket in its own currency, or in the
+// reporting currency given by ?currency=EUR. Archived buckets are left out
+// unless ?includeArchived=true. It is not paged: it holds one row per bucket
+// and is read as a whole, like a balance sheet.
 func summarizeBuckets(w http.ResponseWriter, r *http.Request) {
-	if bucketSummaries, err := dbSummarizeBuckets(); err == nil {
-		render.RenderList(w, r, newBucketSummaryResponse(bucketSummaries))
-	} else {
-		render.Render(w, r, ErrRender(err))
+	bucketSummaries, err := getStore(r).SummarizeBuckets()
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
 	}
+
+	var summaries []BucketSummary
+	for _, bs := range bucketSummaries {
+		bs.Archived = bs.Archived || bs.CategoryArchived
+		if !bs.Archived || includeArchived(r) {
+			summaries = append(summaries, bs)
+		}
+	}
+	bucketSummaries = summaries
+
+	if currency := strings.ToUpper(r.URL.Query().Get("currency")); currency != "" {
+		if !currencyPattern.MatchString(currency) {
+			render.Render(w, r, ErrInvalidRequest(errors.New("currency must be an ISO 4217 currency code")))
+			return
+		}
+		if bucketSummaries, err = convertSummaries(getStore(r), bucketSummaries, currency); err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+	}
+
+	render.RenderList(w, r, newBucketSummaryResponse(bucketSummaries))
 }
 
-// updateBucket updates an existing Bucket in our persistent store.
+// updateBucket updates an existing Bucket in our persistent store. Only
+// the archive and unarchive endpoints change whether it is archived.
 func updateBucket(w http.ResponseWriter, r *http.Request) {
 	bucket := r.Context().Value("bucket").(*Bucket)
+	if !checkIfMatch(w, r, bucket.Version) {
+		return
+	}
+	archived, version, currency := bucket.Archived, bucket.Version, bucket.Currency
+	bucketID := bucket.Id
+	before := snapshot(bucket)
 
 	data := &BucketRequest{Bucket: bucket}
-	if err := render.Bind(r, data); err != nil {
+	if err := bindUpdate(r, bucket, data); err != nil {
 		render.Render(w, r, ErrInvalidRequest(err))
 		return
 	}
 	bucket = data.Bucket
-	bucketID := bucket.Id
-	bucket.Id = 0
+	bucket.Archived = archived
+	bucket.Version = version
+	bucket.Id = 0 // the URL names the bucket, not the body
+	if bucket.Currency != currency {
+		if err := bucketKeepsCurrency(getStore(r), bucketID); err != nil {
+			render.Render(w, r, ErrUpdate(err))
+			return
+		}
+	}
 
-	if err := dbUpdateBucket(bucketID, bucket); err != nil {
-		render.Render(w, r, ErrInvalidRequest(err))
+	if err := getStore(r).UpdateBucket(bucketID, bucket); err != nil {
+		render.Render(w, r, ErrUpdate(err))
 		return
 	}
+	recordAudit(r, auditBucket, bucketID, auditUpdate, before, snapshot(bucket))
 
+	setETag(w, bucket.Version)
 	render.Render(w, r, newBucketResponse(bucket))
 }
 
+// bucketKeepsCurrency refuses to change the currency of a bucket holding
+// bucket items, which are recorded in the currency they were posted in.
+// Trashed items don't count.
+func bucketKeepsCurrency(store Store, bucketID int) error {
+	_, info, err := store.GetBucketItems(BucketItemFilter{BucketIDs: []int{bucketID}}, Page{Limit: 1})
+	if err != nil {
+		return err
+	}
+	if info.Total > 0 {
+		return fieldError("cur", codeInvalid, "cur can't change while the bucket holds %d bucket item(s)", info.Total)
+	}
+	return nil
+}
+
+// archiveBucket returns the handler archiving (or unarchiving) the Bucket
+// loaded by BucketCtx.
+func archiveBucket(archived bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket := r.Context().Value("bucket").(*Bucket)
+		if !checkIfMatch(w, r, bucket.Version) {
+			return
+		}
+		before := snapshot(bucket)
+
+		if err := getStore(r).SetBucketArchived(bucket.Id, archived); err != nil {
+			render.Render(w, r, ErrUpdate(err))
+			return
+		}
+		bucket.Archived = archived
+		bucket.Version++
+		recordAudit(r, auditBucket, bucket.Id, auditUpdate, before, snapshot(bucket))
+
+		setETag(w, bucket.Version)
+		render.Render(w, r, newBucketResponse(bucket))
+	}
+}
+
+// deleteBucket removes the Bucket, refusing with a 409 while anything depends
+// on it unless ?cascade=true or ?reassignTo={id} says what to do with that.
 func deleteBucket(w http.ResponseWriter, r *http.Request) {
 	var err error
 
@@ -136,12 +282,28 @@ func deleteBucket(w http.ResponseWriter, r *http.Request) {
 	// context because this handler is a child of the BucketCtx
 	// middleware. The worst case, the recoverer middleware will save us.
 	bucket := r.Context().Value("bucket").(*Bucket)
+	if !checkIfMatch(w, r, bucket.Version) {
+		return
+	}
 
-	err = dbRemoveBucket(bucket.Id)
+	opts, err := removeOptions(r)
 	if err != nil {
 		render.Render(w, r, ErrInvalidRequest(err))
 		return
 	}
+	if opts.ReassignTo != 0 && opts.ReassignTo != bucket.Id {
+		if err := bucketAcceptsItems(getStore(r), "reassignTo", opts.ReassignTo); err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+	}
+	changes, err := getStore(r).RemoveBucket(bucket.Id, opts)
+	if err != nil {
+		render.Render(w, r, ErrRemove(err))
+		return
+	}
+	recordChanges(r, changes)
+	recordAudit(r, auditBucket, bucket.Id, auditDelete, snapshot(bucket), nil)
 
 	render.Render(w, r, newBucketResponse(bucket))
 }
@@ -163,7 +325,14 @@ type BucketRequest struct {
 func (a *BucketRequest) Bind(r *http.Request) error {
 	// just a post-process after a decode..
 	// a.ProtectedID = "" // unset the protected ID
-	return nil
+	if a.Bucket == nil {
+		return errors.New("missing required Bucket fields")
+	}
+	if a.Currency == "" {
+		a.Currency = defaultCurrency
+	}
+	a.Currency = strings.ToUpper(a.Currency)
+	return validate(getStore(r), a.Bucket)
 }
 
 // BucketResponse is the response payload for the Bucket data model.
@@ -2,35 +2,42 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
-	"strconv"
+	"strings"
 	"time"
 
-	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 )
 
-// listBucketItems lists out all the BucketItems
+// listBucketItems lists out the BucketItems, filtered and sorted as the
+// query string asks, see bucketItemFilter.
 func listBucketItems(w http.ResponseWriter, r *http.Request) {
-	qs := r.URL.Query()
-	bucketID, _ := strconv.Atoi(qs.Get("bid"))
-	dateStart := qs.Get("dstart")
-	dateEnd := qs.Get("dend")
-	inName := qs.Get("namePart")
-	var pageSize, pageStart int
-	var err error
-	if pageSize, err = strconv.Atoi(qs.Get("ps")); err != nil {
-		pageSize = 0
+	page, err := pageFromRequest(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	filter, err := bucketItemFilter(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
 	}
-	pageStart, _ = strconv.Atoi(qs.Get("po"))
 
-	bucketItems, err := dbGetBucketItems(bucketID, dateStart, dateEnd, inName, pageSize, pageStart)
+	bucketItems, info, err := getStore(r).GetBucketItems(filter, page)
 	if err != nil {
-		render.Render(w, r, ErrRender(err))
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+	counterparts, err := bucketItemCounterparts(getStore(r), bucketItems)
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
 		return
 	}
 
-	if err = render.RenderList(w, r, newBucketItemListResponse(bucketItems)); err != nil {
+	setPageHeaders(w, r, page, info)
+	if err = render.RenderList(w, r, newBucketItemListResponse(bucketItems, counterparts)); err != nil {
 		render.Render(w, r, ErrRender(err))
 		return
 	}
@@ -41,19 +48,14 @@ func listBucketItems(w http.ResponseWriter, r *http.Request) {
 // the BucketItem could not be found, we stop here and return a 404.
 func BucketItemCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var bucketItem *BucketItem
-		var err error
-
-		if bucketItemStr := chi.URLParam(r, "bucketItemID"); bucketItemStr != "" {
-			var bucketItemID int
-			bucketItemID, err = strconv.Atoi(bucketItemStr)
-			bucketItem, err = dbGetBucketItem(bucketItemID)
-		} else {
-			render.Render(w, r, ErrNotFound)
+		bucketItemID, ok := urlParamID(r, "bucketItemID")
+		if !ok {
+			render.Render(w, r, ErrInvalidID("bucketItemID"))
 			return
 		}
+		bucketItem, err := getStore(r).GetBucketItem(bucketItemID)
 		if err != nil {
-			render.Render(w, r, ErrNotFound)
+			render.Render(w, r, ErrStore(err))
 			return
 		}
 
@@ -73,12 +75,20 @@ func createBucketItem(w http.ResponseWriter, r *http.Request) {
 		}
 
 		bucketItem := data.BucketItem
-		if err := dbNewBucketItem(bucketItem); err != nil {
+		bucketItem.TransferID = nil // only /transfers links items
+		bucketItem.DeletedAt = nil  // and only DELETE trashes them
+		bucketItem.Balance = nil    // listings work it out
+		if err := bucketAcceptsItems(getStore(r), "bucketID", bucketItem.BucketID); err != nil {
 			render.Render(w, r, ErrInvalidRequest(err))
 			return
 		}
+		if err := getStore(r).NewBucketItem(bucketItem); err != nil {
+			render.Render(w, r, ErrUpdate(err))
+			return
+		}
+		recordAudit(r, auditBucketItem, bucketItem.ID, auditCreate, nil, snapshot(bucketItem))
 		render.Status(r, http.StatusCreated)
-		render.Render(w, r, newBucketItemResponse(bucketItem))
+		render.Render(w, r, newBucketItemResponse(bucketItem, 0))
 	} else {
 		data := &BucketItemsRequest{}
 		if err := render.Bind(r, data); err != nil {
@@ -86,13 +96,28 @@ func createBucketItem(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Reject the whole batch up front rather than half posting it.
 		bucketItems := data.Items
-		if err := dbNewBucketItems(bucketItems); err != nil {
-			render.Render(w, r, ErrInvalidRequest(err))
+		for _, bucketItem := range bucketItems {
+			if bucketItem != nil {
+				bucketItem.TransferID = nil
+				bucketItem.DeletedAt = nil
+				bucketItem.Balance = nil
+			}
+		}
+		if itemErrors := validateBucketItems(getStore(r), bucketItems); len(itemErrors) > 0 {
+			render.Render(w, r, ErrInvalidBatch(itemErrors))
 			return
 		}
+		if err := getStore(r).NewBucketItems(bucketItems); err != nil {
+			render.Render(w, r, ErrUpdate(err))
+			return
+		}
+		for _, bucketItem := range bucketItems {
+			recordAudit(r, auditBucketItem, bucketItem.ID, auditCreate, nil, snapshot(bucketItem))
+		}
 		render.Status(r, http.StatusCreated)
-		render.Render(w, r, &BucketItemsResponse{count: len(bucketItems)})
+		render.Render(w, r, &BucketItemsResponse{Count: len(bucketItems), Items: bucketItems})
 	}
 }
 
@@ -105,31 +130,79 @@ func getBucketItem(w http.ResponseWriter, r *http.Request) {
 	// context because this handler is a child of the BucketItemCtx
 	// middleware. The worst case, the recoverer middleware will save us.
 	bucketItem := r.Context().Value("bucketItem").(*BucketItem)
+	counterparts, err := bucketItemCounterparts(getStore(r), []*BucketItem{bucketItem})
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
 
-	if err := render.Render(w, r, newBucketItemResponse(bucketItem)); err != nil {
+	setETag(w, bucketItem.Version)
+	if err := render.Render(w, r, newBucketItemResponse(bucketItem, counterparts[bucketItem.ID])); err != nil {
 		render.Render(w, r, ErrRender(err))
 		return
 	}
 }
 
 // updateBucketItem updates an existing BucketItem in our persistent store.
+// Editing one side of a transfer edits the transfer, so its other side
+// follows along.
 func updateBucketItem(w http.ResponseWriter, r *http.Request) {
 	bucketItem := r.Context().Value("bucketItem").(*BucketItem)
+	if !checkIfMatch(w, r, bucketItem.Version) {
+		return
+	}
+	original := *bucketItem
 
 	data := &BucketItemRequest{BucketItem: bucketItem}
-	if err := render.Bind(r, data); err != nil {
+	if err := bindUpdate(r, bucketItem, data); err != nil {
 		render.Render(w, r, ErrInvalidRequest(err))
 		return
 	}
 	bucketItem = data.BucketItem
-	bucketItemID := bucketItem.ID
+	bucketItem.ID = original.ID // the URL names the item, not the body
+	bucketItem.TransferID = original.TransferID
+	bucketItem.DeletedAt = nil
+	bucketItem.Balance = nil
+	bucketItem.Version = original.Version
+	if bucketItem.BucketID != original.BucketID {
+		if err := bucketAcceptsItems(getStore(r), "bucketID", bucketItem.BucketID); err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+	}
+
+	if original.TransferID != nil {
+		before := legSnapshots(getStore(r), *original.TransferID)
+		if err := updateTransferLeg(getStore(r), &original, bucketItem); err != nil {
+			render.Render(w, r, ErrUpdate(err))
+			return
+		}
+		updated, err := getStore(r).GetBucketItem(original.ID)
+		if err != nil {
+			render.Render(w, r, ErrStore(err))
+			return
+		}
+		recordLegsAudit(r, auditUpdate, before, legSnapshots(getStore(r), *original.TransferID))
+		counterparts, err := bucketItemCounterparts(getStore(r), []*BucketItem{updated})
+		if err != nil {
+			render.Render(w, r, ErrStore(err))
+			return
+		}
+		setETag(w, updated.Version)
+		render.Render(w, r, newBucketItemResponse(updated, counterparts[updated.ID]))
+		return
+	}
+
+	bucketItemID := original.ID
 	bucketItem.ID = 0
-	if err := dbUpdateBucketItem(bucketItemID, bucketItem); err != nil {
-		render.Render(w, r, ErrInvalidRequest(err))
+	if err := getStore(r).UpdateBucketItem(bucketItemID, bucketItem); err != nil {
+		render.Render(w, r, ErrUpdate(err))
 		return
 	}
+	recordAudit(r, auditBucketItem, bucketItemID, auditUpdate, snapshot(&original), snapshot(bucketItem))
 
-	render.Render(w, r, newBucketItemResponse(bucketItem))
+	setETag(w, bucketItem.Version)
+	render.Render(w, r, newBucketItemResponse(bucketItem, 0))
 }
 
 func deleteBucketItem(w http.ResponseWriter, r *http.Request) {
@@ -139,23 +212,203 @@ func deleteBucketItem(w http.ResponseWriter, r *http.Request) {
 	// context because this handler is a child of the BucketItemCtx
 	// middleware. The worst case, the recoverer middleware will save us.
 	bucketItem := r.Context().Value("bucketItem").(*BucketItem)
-
-	err = dbRemoveBucketItem(bucketItem.ID)
-	if err != nil {
-		render.Render(w, r, ErrInvalidRequest(err))
+	if !checkIfMatch(w, r, bucketItem.Version) {
 		return
 	}
 
-	render.Render(w, r, newBucketItemResponse(bucketItem))
+	// Both go to the trash, see /trash. A transfer leg never goes alone;
+	// remove the whole transfer.
+	if bucketItem.TransferID != nil {
+		before := legSnapshots(getStore(r), *bucketItem.TransferID)
+		if err = getStore(r).RemoveTransfer(*bucketItem.TransferID); err != nil {
+			render.Render(w, r, ErrUpdate(err))
+			return
+		}
+		recordLegsAudit(r, auditDelete, before, nil)
+	} else {
+		if err = getStore(r).RemoveBucketItem(bucketItem.ID); err != nil {
+			render.Render(w, r, ErrUpdate(err))
+			return
+		}
+		recordAudit(r, auditBucketItem, bucketItem.ID, auditDelete, snapshot(bucketItem), nil)
+	}
+
+	render.Render(w, r, newBucketItemResponse(bucketItem, 0))
 }
 
 type BucketItem struct {
-	ID          int       `db:"id,omitempty" json:"id"`
-	BucketID    int       `db:"bucketID" json:"bucketID"`
-	Name        string    `db:"name" json:"name"`
-	Transaction time.Time `db:"transaction" json:"transaction"`
-	Deposit     float32   `db:"deposit" json:"d"`
-	Withdraw    float32   `db:"withdrawl" json:"w"`
+	ID          int        `db:"id,omitempty" json:"id"`
+	BucketID    int        `db:"bucketID" json:"bucketID" validate:"required,ref=bucket"`
+	Name        string     `db:"name" json:"name" validate:"required,maxlen=100"`
+	Transaction time.Time  `db:"transaction" json:"transaction" validate:"required"`
+	Deposit     Money      `db:"deposit" json:"d" validate:"min=0"`
+	Withdraw    Money      `db:"withdraw" json:"w" validate:"min=0"`
+	Tags        Tags       `db:"tags" json:"tags,omitempty"`
+	TransferID  *int       `db:"transferID,omitempty" json:"transferID,omitempty"` // set on both sides of a Transfer
+	DeletedAt   *time.Time `db:"deletedAt,omitempty" json:"deletedAt,omitempty"`   // set while the item is in the trash
+	Version     int        `db:"version,omitempty" json:"version"`                 // bumped by every update, sent as the ETag
+	Balance     *Money     `db:"balance,omitempty" json:"balance,omitempty"`       // of the bucket after this item, set by GetBucketItems
+}
+
+// checkFields checks the tags, which need more than a validate tag.
+func (b *BucketItem) checkFields(e *ValidationError) {
+	b.Tags.check("tags", e)
+}
+
+// BucketItemFilter narrows down and orders GetBucketItems. Zero fields
+// don't filter.
+type BucketItemFilter struct {
+	BucketIDs   []int     // in any of these buckets
+	CategoryIDs []int     // in a bucket of any of these categories
+	From        time.Time // inclusive
+	To          time.Time // exclusive
+	MinAmount   *Money    // the size of the item, |d - w|, inclusive
+	MaxAmount   *Money    // inclusive
+	Kind        string    // bucketItemDeposit (d > w) or bucketItemWithdraw (w > d)
+	Tags        []string  // tagged with every one of them
+	InName      string    // part of the name, any case
+	Text        string    // every word in the name or the tags, any case
+	Sort        string    // one of bucketItemSorts, "-" in front for descending; "-transaction" when empty
+}
+
+// Kinds of bucket items to filter on.
+const (
+	bucketItemDeposit  = "deposit"
+	bucketItemWithdraw = "withdraw"
+)
+
+// bucketItemSorts are the fields bucket items can be sorted on. Items
+// sorting the same are ordered by id.
+var bucketItemSorts = []string{"transaction", "amount", "name", "bucket", "id"}
+
+// order is the field the filter sorts on, and whether descending.
+func (f BucketItemFilter) order() (field string, desc bool) {
+	if f.Sort == "" {
+		return "transaction", true
+	}
+	return strings.TrimPrefix(f.Sort, "-"), strings.HasPrefix(f.Sort, "-")
+}
+
+// matches reports whether bucketItem passes the filter, given the category
+// of each bucket.
+func (f BucketItemFilter) matches(bucketItem *BucketItem, categories map[int]int) bool {
+	amount := bucketItem.Deposit - bucketItem.Withdraw
+	size := amount
+	if size < 0 {
+		size = -size
+	}
+	name := strings.ToLower(bucketItem.Name)
+	switch {
+	case len(f.BucketIDs) > 0 && !containsInt(f.BucketIDs, bucketItem.BucketID),
+		len(f.CategoryIDs) > 0 && !containsInt(f.CategoryIDs, categories[bucketItem.BucketID]),
+		!f.From.IsZero() && bucketItem.Transaction.Before(f.From),
+		!f.To.IsZero() && !bucketItem.Transaction.Before(f.To),
+		f.MinAmount != nil && size < *f.MinAmount,
+		f.MaxAmount != nil && size > *f.MaxAmount,
+		f.Kind == bucketItemDeposit && amount <= 0,
+		f.Kind == bucketItemWithdraw && amount >= 0,
+		f.InName != "" && !strings.Contains(name, strings.ToLower(f.InName)):
+		return false
+	}
+	for _, tag := range f.Tags {
+		if !bucketItem.Tags.has(tag) {
+			return false
+		}
+	}
+	for _, word := range strings.Fields(strings.ToLower(f.Text)) {
+		if !strings.Contains(name, word) && !strings.Contains(strings.Join(bucketItem.Tags, ","), word) {
+			return false
+		}
+	}
+	return true
+}
+
+// bucketItemFilter reads the BucketItemFilter of GET /bucketItems off the
+// query string:
+//
+//	bid=1,2          in bucket 1 or 2 (cid= likewise for categories)
+//	from=, to=       a 2006-01-02 date (to included) or RFC 3339 timestamp
+//	dstart=, dend=   the same as 01/02/2006 dates, both included
+//	minAmount=, maxAmount=  the size of the item, e.g. 12.50
+//	kind=            deposit or withdraw
+//	tag=a,b          tagged both a and b
+//	namePart=        part of the name
+//	q=               words each found in the name or the tags
+//	sort=-amount     a field of bucketItemSorts, "-" for descending
+//
+// The lists may also be given as repeated parameters.
+func bucketItemFilter(r *http.Request) (BucketItemFilter, error) {
+	qs := r.URL.Query()
+	filter := BucketItemFilter{
+		Tags:   normalizeTags(splitList(qs["tag"])),
+		InName: qs.Get("namePart"),
+		Text:   qs.Get("q"),
+		Kind:   qs.Get("kind"),
+		Sort:   qs.Get("sort"),
+	}
+	var err error
+	if filter.BucketIDs, err = parseIDList(qs["bid"], "bid"); err != nil {
+		return filter, err
+	}
+	if filter.CategoryIDs, err = parseIDList(qs["cid"], "cid"); err != nil {
+		return filter, err
+	}
+
+	if dstart := qs.Get("dstart"); dstart != "" {
+		if filter.From, err = parseStartDate(dstart); err != nil {
+			return filter, fmt.Errorf("invalid dstart %q, use 01/02/2006", dstart)
+		}
+	}
+	if dend := qs.Get("dend"); dend != "" {
+		if filter.To, err = parseStartDate(dend); err != nil {
+			return filter, fmt.Errorf("invalid dend %q, use 01/02/2006", dend)
+		}
+		filter.To = filter.To.AddDate(0, 0, 1)
+	}
+	if from := qs.Get("from"); from != "" {
+		if filter.From, err = parseTimeParam(from, false); err != nil {
+			return filter, err
+		}
+	}
+	if to := qs.Get("to"); to != "" {
+		if filter.To, err = parseTimeParam(to, true); err != nil {
+			return filter, err
+		}
+	}
+
+	for name, amount := range map[string]**Money{"minAmount": &filter.MinAmount, "maxAmount": &filter.MaxAmount} {
+		if value := qs.Get(name); value != "" {
+			m, err := ParseMoney(value)
+			if err != nil || m < 0 {
+				return filter, fmt.Errorf("%s must be an amount such as 12.50", name)
+			}
+			*amount = &m
+		}
+	}
+	if filter.Kind != "" && filter.Kind != bucketItemDeposit && filter.Kind != bucketItemWithdraw {
+		return filter, fmt.Errorf("kind must be %s or %s", bucketItemDeposit, bucketItemWithdraw)
+	}
+	if field, _ := filter.order(); !containsString(bucketItemSorts, field) {
+		return filter, fmt.Errorf("sort must be one of %s, with - in front for descending", strings.Join(bucketItemSorts, ", "))
+	}
+	return filter, nil
+}
+
+// bucketItemCursor places a BucketItem in a list sorted on field, one of
+// bucketItemSorts.
+func bucketItemCursor(bucketItem *BucketItem, field string) Cursor {
+	cursor := Cursor{ID: bucketItem.ID}
+	switch field {
+	case "transaction":
+		cursor.Key = timeKey(bucketItem.Transaction)
+	case "amount":
+		cursor.Key = amountKey(bucketItem.Deposit - bucketItem.Withdraw)
+	case "name":
+		cursor.Key = bucketItem.Name
+	case "bucket":
+		cursor.Key = fmt.Sprintf("%010d", bucketItem.BucketID)
+	}
+	return cursor
 }
 
 // BucketItemRequest is the request payload for BucketItem data model.
@@ -172,20 +425,57 @@ type BucketItemRequest struct {
 }
 
 func (a *BucketItemRequest) Bind(r *http.Request) error {
-	// just a post-process after a decode..
-	return nil
+	if a.BucketItem == nil {
+		return errors.New("missing required BucketItem fields")
+	}
+	return validate(getStore(r), a.BucketItem)
+}
+
+// validateBucketItems checks every item of a batch, including that its
+// bucket exists and takes new items, and reports the problems per item.
+func validateBucketItems(store Store, bucketItems []*BucketItem) []ItemError {
+	var itemErrors []ItemError
+	bucketErrors := map[int]*ValidationError{}
+	for i, bucketItem := range bucketItems {
+		if bucketItem == nil {
+			itemErrors = append(itemErrors, ItemError{Index: i, Errors: []string{"item is empty"}})
+			continue
+		}
+		problems := &ValidationError{}
+		if err := validate(store, bucketItem); err != nil {
+			problems = err.(*ValidationError)
+		}
+		if !problems.has("bucketID") {
+			bucketErr, checked := bucketErrors[bucketItem.BucketID]
+			if !checked {
+				bucketErr = bucketAcceptsItems(store, "bucketID", bucketItem.BucketID)
+				bucketErrors[bucketItem.BucketID] = bucketErr
+			}
+			if bucketErr != nil {
+				problems.Fields = append(problems.Fields, bucketErr.Fields...)
+			}
+		}
+		if len(problems.Fields) > 0 {
+			itemErrors = append(itemErrors, ItemError{Index: i, Errors: problems.messages(), Fields: problems.Fields})
+		}
+	}
+	return itemErrors
 }
 
 type BucketItemsRequest struct {
-	Items []BucketItem `json:"items"`
+	Items []*BucketItem `json:"items" validate:"required"`
 }
 
 func (a *BucketItemsRequest) Bind(r *http.Request) error {
-	return nil
+	return validate(getStore(r), a)
 }
 
+// BucketItemsResponse acknowledges a batch with the created items, IDs
+// included.
 type BucketItemsResponse struct {
-	count int
+	Count  int           `json:"count"`
+	Items  []*BucketItem `json:"items"`
+	DryRun bool          `json:"dryRun,omitempty"` // previewed only, nothing was stored
 }
 
 func (rd *BucketItemsResponse) Render(w http.ResponseWriter, r *http.Request) error {
@@ -201,11 +491,12 @@ func (rd *BucketItemsResponse) Render(w http.ResponseWriter, r *http.Request) er
 // Render is called in top-down order, like a http handler middleware chain.
 type BucketItemResponse struct {
 	*BucketItem
-	// We add an additional field to the response here.. such as this
+	// CounterpartBucketID is the bucket on the other side of a transfer.
+	CounterpartBucketID int `json:"counterpartBucketID,omitempty"`
 }
 
-func newBucketItemResponse(bucketItem *BucketItem) *BucketItemResponse {
-	return &BucketItemResponse{BucketItem: bucketItem}
+func newBucketItemResponse(bucketItem *BucketItem, counterpartBucketID int) *BucketItemResponse {
+	return &BucketItemResponse{BucketItem: bucketItem, CounterpartBucketID: counterpartBucketID}
 }
 
 func (rd *BucketItemResponse) Render(w http.ResponseWriter, r *http.Request) error {
@@ -215,10 +506,10 @@ func (rd *BucketItemResponse) Render(w http.ResponseWriter, r *http.Request) err
 
 type BucketItemListResponse []*BucketItemResponse
 
-func newBucketItemListResponse(bucketItems []*BucketItem) []render.Renderer {
+func newBucketItemListResponse(bucketItems []*BucketItem, counterparts map[int]int) []render.Renderer {
 	list := []render.Renderer{}
 	for _, bucketItem := range bucketItems {
-		list = append(list, newBucketItemResponse(bucketItem))
+		list = append(list, newBucketItemResponse(bucketItem, counterparts[bucketItem.ID]))
 	}
 	return list
 }
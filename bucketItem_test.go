@@ -0,0 +1,259 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBucketItemBatchIsAtomic(t *testing.T) {
+	store := newSeededStore(t)
+	ts := &testServer{t: t, router: newRouter(store)}
+
+	var e errorResponse
+	ts.expect(http.StatusBadRequest, &e, "POST", "/bucketItems?batch=1", `{"items":[
+		{"bucketID":1,"name":"fine","d":"1.00","transaction":"2026-01-01T00:00:00Z"},
+		{"bucketID":99,"name":"no such bucket","d":"1.00","transaction":"2026-01-01T00:00:00Z"},
+		{"bucketID":1,"d":"1.00","transaction":"2026-01-01T00:00:00Z"}
+	]}`)
+	if e.Code != AppCodeInvalidBatch || len(e.Items) != 2 || e.Items[0].Index != 1 || e.Items[1].Index != 2 {
+		t.Errorf("rejected batch: %+v, want items 1 and 2 reported", e)
+	}
+	if len(store.bucketItems) != 1 {
+		t.Errorf("%d bucket items after a rejected batch, want 1", len(store.bucketItems))
+	}
+
+	var created BucketItemsResponse
+	ts.expect(http.StatusCreated, &created, "POST", "/bucketItems?batch=1", `{"items":[
+		{"bucketID":1,"name":"one","d":"1.00","transaction":"2026-01-01T00:00:00Z"},
+		{"bucketID":2,"name":"two","w":"2.00","transaction":"2026-01-02T00:00:00Z"}
+	]}`)
+	if created.Count != 2 || created.Items[0].ID == 0 || created.Items[1].ID == 0 {
+		t.Errorf("created batch: %+v", created)
+	}
+}
+
+// newBucketItemStore returns the seeded memory store, whose bucket item 1
+// is dated now, with bucket 3 in category 2 and these bucket items:
+//
+//	2  bucket 1  2026-01-05  w 45.00    "Groceries 50%_off"  groceries
+//	3  bucket 2  2026-01-15  d 1200.00  "Paycheck"           income
+//	4  bucket 2  2026-02-01  w 900.00   "Rent"               housing
+//	5  bucket 1  2026-02-10  w 30.00    "Fuel"               car, groceries
+//	6  bucket 3  2026-01-20  w 60.00    "Dinner"             food
+func newBucketItemStore(t *testing.T) *memoryStore {
+	t.Helper()
+	store := newSeededStore(t)
+	if err := store.NewBucket(&Bucket{Name: "Eating out", CategoryID: 2, Currency: defaultCurrency}); err != nil {
+		t.Fatal(err)
+	}
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	for _, bucketItem := range []*BucketItem{
+		{BucketID: 1, Name: "Groceries 50%_off", Transaction: day("2026-01-05"), Withdraw: 4500, Tags: Tags{"groceries"}},
+		{BucketID: 2, Name: "Paycheck", Transaction: day("2026-01-15"), Deposit: 120000, Tags: Tags{"income"}},
+		{BucketID: 2, Name: "Rent", Transaction: day("2026-02-01"), Withdraw: 90000, Tags: Tags{"housing"}},
+		{BucketID: 1, Name: "Fuel", Transaction: day("2026-02-10"), Withdraw: 3000, Tags: Tags{"car", "groceries"}},
+		{BucketID: 3, Name: "Dinner", Transaction: day("2026-01-20"), Withdraw: 6000, Tags: Tags{"food"}},
+	} {
+		if err := store.NewBucketItem(bucketItem); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func bucketItemIDs(bucketItems []*BucketItem) []int {
+	var ids []int
+	for _, bucketItem := range bucketItems {
+		ids = append(ids, bucketItem.ID)
+	}
+	return ids
+}
+
+func TestBucketItemFilters(t *testing.T) {
+	store := newBucketItemStore(t)
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"", []int{1, 2, 3, 4, 5, 6}},
+		{"bid=2", []int{3, 4}},
+		{"bid=2,3", []int{3, 4, 6}},
+		{"bid=2&bid=3", []int{3, 4, 6}},
+		{"cid=2", []int{6}},
+		{"from=2026-01-10&to=2026-01-31", []int{3, 6}},
+		{"from=2026-01-15T00:00:00Z&to=2026-02-01T00:00:00Z", []int{3, 6}},
+		{"dstart=01/15/2026&dend=02/01/2026", []int{3, 4, 6}},
+		{"minAmount=50.00", []int{3, 4, 6}},
+		{"maxAmount=45.00", []int{1, 2, 5}},
+		{"minAmount=30&maxAmount=60", []int{2, 5, 6}},
+		{"kind=deposit", []int{1, 3}},
+		{"kind=withdraw", []int{2, 4, 5, 6}},
+		{"tag=groceries", []int{2, 5}},
+		{"tag=Groceries,car", []int{5}},
+		{"namePart=ent", []int{4}},
+		{"namePart=%25_", []int{2}},
+		{"namePart=r_nt", nil},
+		{"q=groceries", []int{2, 5}},
+		{"q=groceries+OFF", []int{2}},
+		{"q=%25", []int{2}},
+		{"bid=1&kind=withdraw&tag=groceries&maxAmount=40", []int{5}},
+	}
+	for _, tt := range tests {
+		filter, err := bucketItemFilter(httptest.NewRequest("GET", "/bucketItems?"+tt.query, nil))
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		bucketItems, _, err := store.GetBucketItems(filter, Page{Limit: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := bucketItemIDs(bucketItems)
+		sort.Ints(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestBucketItemFiltersInvalid(t *testing.T) {
+	for _, query := range []string{
+		"bid=x", "cid=0", "from=yesterday", "to=2026-13-01", "dstart=2026-01-01", "dend=13/01/2026",
+		"minAmount=-1", "maxAmount=abc", "kind=both", "sort=size", "sort=--amount",
+	} {
+		if _, err := bucketItemFilter(httptest.NewRequest("GET", "/bucketItems?"+query, nil)); err == nil {
+			t.Errorf("%s: no error", query)
+		}
+	}
+}
+
+func TestBucketItemSorts(t *testing.T) {
+	store := newBucketItemStore(t)
+	tests := []struct {
+		sort string
+		want []int
+	}{
+		{"", []int{1, 5, 4, 6, 3, 2}},
+		{"transaction", []int{2, 3, 6, 4, 5, 1}},
+		{"-transaction", []int{1, 5, 4, 6, 3, 2}},
+		{"amount", []int{4, 6, 2, 5, 1, 3}},
+		{"-amount", []int{3, 1, 5, 2, 6, 4}},
+		{"name", []int{6, 5, 2, 1, 3, 4}},
+		{"-name", []int{4, 3, 1, 2, 5, 6}},
+		{"bucket", []int{1, 2, 5, 3, 4, 6}},
+		{"-bucket", []int{6, 4, 3, 5, 2, 1}},
+		{"id", []int{1, 2, 3, 4, 5, 6}},
+		{"-id", []int{6, 5, 4, 3, 2, 1}},
+	}
+	for _, tt := range tests {
+		filter := BucketItemFilter{Sort: tt.sort}
+		bucketItems, _, err := store.GetBucketItems(filter, Page{Limit: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bucketItemIDs(bucketItems); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sort=%s: %v, want %v", tt.sort, got, tt.want)
+		}
+
+		// Paging two at a time by cursor walks the same order.
+		var paged []int
+		page := Page{Limit: 2}
+		for i := 0; i < 10; i++ {
+			bucketItems, info, err := store.GetBucketItems(filter, page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Total != len(tt.want) {
+				t.Errorf("sort=%s: total %d, want %d", tt.sort, info.Total, len(tt.want))
+			}
+			paged = append(paged, bucketItemIDs(bucketItems)...)
+			if info.Next == nil {
+				break
+			}
+			cursor, err := parseCursor(info.Next.String())
+			if err != nil {
+				t.Fatalf("sort=%s: cursor %+v: %v", tt.sort, info.Next, err)
+			}
+			page.After = cursor
+		}
+		if !reflect.DeepEqual(paged, tt.want) {
+			t.Errorf("sort=%s paged by 2: %v, want %v", tt.sort, paged, tt.want)
+		}
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := []struct {
+		s, wildcards, want string
+	}{
+		{"rent", "%_", "rent"},
+		{"50%_off", "%_", `50\%\_off`},
+		{`a\b`, "%_", `a\\b`},
+		{"[x]", "%_", "[x]"},
+		{"[x]", "%_[", `\[x]`},
+	}
+	for _, tt := range tests {
+		if got := escapeLike(tt.s, tt.wildcards); got != tt.want {
+			t.Errorf("escapeLike(%q, %q) = %q, want %q", tt.s, tt.wildcards, got, tt.want)
+		}
+	}
+}
+
+func TestRunningBalance(t *testing.T) {
+	ts := newTestServer(t)
+	for _, body := range []string{
+		`{"bucketID":2,"name":"a","d":"10.00","transaction":"2026-01-01T00:00:00Z"}`,
+		`{"bucketID":2,"name":"b","w":"3.00","transaction":"2026-01-02T00:00:00Z"}`,
+		`{"bucketID":2,"name":"c","d":"5.25","transaction":"2026-01-03T00:00:00Z"}`,
+		`{"bucketID":2,"name":"d","w":"0.25","transaction":"2026-01-03T00:00:00Z"}`,
+	} {
+		ts.expect(http.StatusCreated, nil, "POST", "/bucketItems", body)
+	}
+
+	balances := func(path string) []Money {
+		var bucketItems []*BucketItem
+		ts.expect(http.StatusOK, &bucketItems, "GET", path, "")
+		var balances []Money
+		for _, bucketItem := range bucketItems {
+			if bucketItem.Balance == nil {
+				t.Fatalf("%s: bucket item %d has no balance", path, bucketItem.ID)
+			}
+			balances = append(balances, *bucketItem.Balance)
+		}
+		return balances
+	}
+	same := func(got, want []Money) bool {
+		if len(got) != len(want) {
+			return false
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	if got, want := balances("/bucketItems?bid=2&sort=transaction"), []Money{1000, 700, 1225, 1200}; !same(got, want) {
+		t.Errorf("balances oldest first %v, want %v", got, want)
+	}
+	if got, want := balances("/bucketItems?bid=2"), []Money{1200, 1225, 700, 1000}; !same(got, want) {
+		t.Errorf("balances newest first %v, want %v", got, want)
+	}
+	// The balance counts every item of the bucket, whatever the filter.
+	if got, want := balances("/bucketItems?bid=2&kind=withdraw&sort=transaction"), []Money{700, 1200}; !same(got, want) {
+		t.Errorf("balances of the withdrawals %v, want %v", got, want)
+	}
+
+	ts.expect(http.StatusOK, nil, "DELETE", "/bucketItems/3", "")
+	if got, want := balances("/bucketItems?bid=2&sort=transaction"), []Money{1000, 1525, 1500}; !same(got, want) {
+		t.Errorf("balances after trashing an item %v, want %v", got, want)
+	}
+}
@@ -2,28 +2,52 @@ package main
 
 import (
 	"context"
+	"errors"
 	"net/http"
-	"strconv"
 
-	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 )
 
 type Category struct {
-	Name string `db:"name" json:"name"`
+	Name string `db:"name" json:"name" validate:"required,maxlen=100"`
 
 	Id int `db:"id,omitempty" json:"id"`
+
+	// Archived categories archive all of their buckets with them.
+	Archived bool `db:"archived" json:"archived"`
+
+	// Version is bumped by every update and sent as the ETag.
+	Version int `db:"version,omitempty" json:"version"`
 }
 
-// listCategories lists out all the Categories
+// listCategories lists out the Categories, leaving out archived ones unless
+// ?includeArchived=true.
 func listCategories(w http.ResponseWriter, r *http.Request) {
-	categories, err := dbGetCategories()
+	page, err := pageFromRequest(r)
 	if err != nil {
-		render.Render(w, r, ErrRender(err))
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	categories, err := getStore(r).GetCategories()
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
 		return
 	}
 
-	if err := render.RenderList(w, r, newCategoryListResponse(categories)); err != nil {
+	if !includeArchived(r) {
+		var open []*Category
+		for _, category := range categories {
+			if !category.Archived {
+				open = append(open, category)
+			}
+		}
+		categories = open
+	}
+
+	start, end, info := page.paginate(categories, func(i int) Cursor { return Cursor{ID: categories[i].Id} }, false)
+	setPageHeaders(w, r, page, info)
+	if err := render.RenderList(w, r, newCategoryListResponse(categories[start:end])); err != nil {
 		render.Render(w, r, ErrRender(err))
 		return
 	}
@@ -34,18 +58,14 @@ func listCategories(w http.ResponseWriter, r *http.Request) {
 // the Category could not be found, we stop here and return a 404.
 func CategoryCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var category *Category
-		var err error
-
-		if categoryStr := chi.URLParam(r, "categoryID"); categoryStr != "" {
-			categoryID, _ := strconv.Atoi(categoryStr)
-			category, err = dbGetCategory(categoryID)
-		} else {
-			render.Render(w, r, ErrNotFound)
+		categoryID, ok := urlParamID(r, "categoryID")
+		if !ok {
+			render.Render(w, r, ErrInvalidID("categoryID"))
 			return
 		}
+		category, err := getStore(r).GetCategory(categoryID)
 		if err != nil {
-			render.Render(w, r, ErrNotFound)
+			render.Render(w, r, ErrStore(err))
 			return
 		}
 
@@ -63,10 +83,11 @@ func createCategory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := dbNewCategory(data.Category); err != nil {
-		render.Render(w, r, ErrInvalidRequest(err))
+	if err := getStore(r).NewCategory(data.Category); err != nil {
+		render.Render(w, r, ErrUpdate(err))
 		return
 	}
+	recordAudit(r, auditCategory, data.Category.Id, auditCreate, nil, snapshot(data.Category))
 
 	render.Status(r, http.StatusCreated)
 	render.Render(w, r, newCategoryResponse(data.Category))
@@ -82,6 +103,7 @@ func getCategory(w http.ResponseWriter, r *http.Request) {
 	// middleware. The worst case, the recoverer middleware will save us.
 	category := r.Context().Value("category").(*Category)
 
+	setETag(w, category.Version)
 	if err := render.Render(w, r, newCategoryResponse(category)); err != nil {
 		render.Render(w, r, ErrRender(err))
 		return
@@ -91,18 +113,56 @@ func getCategory(w http.ResponseWriter, r *http.Request) {
 // updateCategory updates an existing Category in our persistent store.
 func updateCategory(w http.ResponseWriter, r *http.Request) {
 	category := r.Context().Value("category").(*Category)
+	if !checkIfMatch(w, r, category.Version) {
+		return
+	}
+	archived, version := category.Archived, category.Version
+	categoryID := category.Id
+	before := snapshot(category)
 
 	data := &CategoryRequest{Category: category}
-	if err := render.Bind(r, data); err != nil {
+	if err := bindUpdate(r, category, data); err != nil {
 		render.Render(w, r, ErrInvalidRequest(err))
 		return
 	}
 	category = data.Category
-	dbUpdateCategory(category.Id, category)
+	category.Archived = archived
+	category.Version = version
+	if err := getStore(r).UpdateCategory(categoryID, category); err != nil {
+		render.Render(w, r, ErrUpdate(err))
+		return
+	}
+	recordAudit(r, auditCategory, categoryID, auditUpdate, before, snapshot(category))
 
+	setETag(w, category.Version)
 	render.Render(w, r, newCategoryResponse(category))
 }
 
+// archiveCategory returns the handler archiving (or unarchiving) the
+// Category loaded by CategoryCtx.
+func archiveCategory(archived bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		category := r.Context().Value("category").(*Category)
+		if !checkIfMatch(w, r, category.Version) {
+			return
+		}
+		before := snapshot(category)
+
+		if err := getStore(r).SetCategoryArchived(category.Id, archived); err != nil {
+			render.Render(w, r, ErrUpdate(err))
+			return
+		}
+		category.Archived = archived
+		category.Version++
+		recordAudit(r, auditCategory, category.Id, auditUpdate, before, snapshot(category))
+
+		setETag(w, category.Version)
+		render.Render(w, r, newCategoryResponse(category))
+	}
+}
+
+// deleteCategory removes the Category, refusing with a 409 while anything depends
+// on it unless ?cascade=true or ?reassignTo={id} says what to do with that.
 func deleteCategory(w http.ResponseWriter, r *http.Request) {
 	var err error
 
@@ -110,12 +170,22 @@ func deleteCategory(w http.ResponseWriter, r *http.Request) {
 	// context because this handler is a child of the CategoryCtx
 	// middleware. The worst case, the recoverer middleware will save us.
 	category := r.Context().Value("category").(*Category)
+	if !checkIfMatch(w, r, category.Version) {
+		return
+	}
 
-	err = dbRemoveCategory(category.Id)
+	opts, err := removeOptions(r)
 	if err != nil {
 		render.Render(w, r, ErrInvalidRequest(err))
 		return
 	}
+	changes, err := getStore(r).RemoveCategory(category.Id, opts)
+	if err != nil {
+		render.Render(w, r, ErrRemove(err))
+		return
+	}
+	recordChanges(r, changes)
+	recordAudit(r, auditCategory, category.Id, auditDelete, snapshot(category), nil)
 
 	render.Render(w, r, newCategoryResponse(category))
 }
@@ -137,8 +207,11 @@ type CategoryRequest struct {
 func (a *CategoryRequest) Bind(r *http.Request) error {
 	// just a post-process after a decode..
 	a.ProtectedID = "" // unset the protected ID
+	if a.Category == nil {
+		return errors.New("missing required Category fields")
+	}
 	// a.Category.Name = strings.ToLower(a.Category.Name) // as an example, we down-case
-	return nil
+	return validate(getStore(r), a.Category)
 }
 
 // CategoryResponse is the response payload for the Category data model.
@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	db "upper.io/db.v3"
 	"upper.io/db.v3/lib/sqlbuilder"
-	"upper.io/db.v3/mssql"
 )
 
 type dbError struct {
@@ -18,205 +19,159 @@ func (e *dbError) Error() string {
 	return e.s
 }
 
-var settings = mssql.ConnectionURL{
-	Host:     readEnvOrDefault("DB_HOST_NAME", "127.0.0.1"), // MSSQL server IP or name.
-	Database: readEnvOrDefault("DB_NAME", "budget2"),        // Database name.
-	User:     readEnvOrDefault("DB_USER", "budgetUser"),
-	Password: readEnvOrDefault("DB_PASSWORD", "budgetPassword"),
+// sqlDialect holds the statements that differ between the SQL backends.
+type sqlDialect struct {
+	schemaVersionTable string // creates schema_version when missing
+	migrations         []migration
+	summarizeBuckets   string
+	dayColumn          string // the day of a bucketitem row as 2006-01-02 text
+	likeOperator       string // case insensitive pattern match
+	likeWildcards      string // the characters a LIKE pattern treats specially, see contains
+	bucketItemBalance  string // the balance column of a bucketitem row, see GetBucketItems
 }
 
-func dbInit() {
-	// Attemping to establish a connection to the database.
-	sess, err := mssql.Open(settings)
-	if err != nil {
-		log.Fatalf("db.Open(): %q\n", err)
-	}
-	defer sess.Close() // Remember to close the database session.
-
-	sess.Collection("category").Truncate()
-	sess.Collection("template").Truncate()
-	sess.Collection("templateitem").Truncate()
-	sess.Collection("bucket").Truncate()
-	sess.Collection("bucketitem").Truncate()
-
-	categoryCollection := sess.Collection("category")
-	categoryCollection.Insert(Category{
-		Name: "house",
-	})
-	categoryCollection.Insert(Category{
-		Name: "living",
-	})
-
-	bucketCollection := sess.Collection("bucket")
-	bucketCollection.Insert(Bucket{
-		Name:       "Gas",
-		CategoryID: 1,
-		IsLiquid:   true,
-	})
-	bucketCollection.Insert(Bucket{
-		Name:       "Gabe's Personal",
-		CategoryID: 1,
-		IsLiquid:   false,
-	})
-
-	bucketItemCollection := sess.Collection("bucketitem")
-	bucketItemCollection.Insert(BucketItem{
-		Name:        "Initial Deposit",
-		BucketID:    1,
-		Deposit:     1.99,
-		Withdraw:    0.44,
-		Transaction: time.Now(),
-	})
-	bucketCollection.Insert(Bucket{
-		Name:       "Gabe's Personal",
-		CategoryID: 1,
-		IsLiquid:   false,
-	})
+// contains matches the rows whose column holds part, comparing with
+// operator: LIKE or the dialect's likeOperator. The wildcards in part are
+// escaped so it only matches itself, as strings.Contains does in the memory
+// store.
+func (d sqlDialect) contains(column string, operator string, part string) db.RawValue {
+	return db.Raw(column+" "+operator+" ? ESCAPE '\\'", "%"+escapeLike(part, d.likeWildcards)+"%")
+}
 
-	templateCollection := sess.Collection("template")
-	templateCollection.Insert(Template{
-		Name: "Bimonthly paycheck",
-	})
+// escapeLike puts a backslash before every backslash and wildcard in s.
+func escapeLike(s string, wildcards string) string {
+	var escaped strings.Builder
+	for _, r := range s {
+		if r == '\\' || strings.ContainsRune(wildcards, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
 
-	templateItemCollection := sess.Collection("templateitem")
-	templateItemCollection.Insert(TemplateItem{
-		Name:       "Deposit",
-		BucketID:   1,
-		TemplateID: 1,
-		Deposit:    2.99,
-		Withdraw:   1.45,
-	})
+// sqlStore implements Store on top of any upper.io sql adapter. The
+// backend specific bits live in its sqlDialect.
+type sqlStore struct {
+	sess    sqlbuilder.Database // shared, pooled session
+	dialect sqlDialect
 }
 
-func dbDropTables() error {
-	sess, err := mssql.Open(settings)
+// updateVersioned writes record over the row of table with the given id,
+// provided the row is still at *version, and moves *version on to the next
+// version. A row changed (or removed) since it was read is left alone and
+// ErrVersionConflict returned.
+func updateVersioned(sess sqlbuilder.SQLBuilder, table string, id int, record interface{}, version *int) error {
+	expected := *version
+	*version = expected + 1
+	res, err := sess.Update(table).Set(record).Where(db.Cond{"id": id, "version": expected}).Exec()
 	if err != nil {
 		return err
 	}
-	defer sess.Close() // Remember to close the database session.
-
-	if _, err = sess.Exec("drop TABLE [dbo].[category];"); err != nil {
-		fmt.Printf("Err: %q\n", err)
-	}
-
-	if _, err = sess.Exec("drop TABLE [dbo].[bucket];"); err != nil {
-		fmt.Printf("Err: %q\n", err)
-	}
-
-	if _, err = sess.Exec("drop TABLE [dbo].[bucketitem];"); err != nil {
-		fmt.Printf("Err: %q\n", err)
-	}
-
-	if _, err = sess.Exec("drop TABLE [dbo].[template];"); err != nil {
-		fmt.Printf("Err: %q\n", err)
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
 	}
-
-	if _, err = sess.Exec("drop TABLE [dbo].[templateitem];"); err != nil {
-		fmt.Printf("Err: %q\n", err)
+	if updated == 0 {
+		return ErrVersionConflict
 	}
-
-	return err
+	return nil
 }
 
-func dbCreateTables() error {
-	sess, err := mssql.Open(settings)
+// connectSQLStore opens the pooled session every request shares, sized by
+// the DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS and DB_CONN_MAX_LIFETIME settings,
+// and makes sure the database can actually be reached.
+func connectSQLStore(open func() (sqlbuilder.Database, error), dialect sqlDialect) (*sqlStore, error) {
+	maxOpen, err := strconv.Atoi(readEnvOrDefault("DB_MAX_OPEN_CONNS", "10"))
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("DB_MAX_OPEN_CONNS: %v", err)
 	}
-	defer sess.Close() // Remember to close the database session.
-
-	_, err = sess.Exec(`
-		CREATE TABLE [dbo].[category] (
-			[id] [int] IDENTITY(1,1) NOT NULL,
-			[name] nvarchar(100) NOT NULL,
-			CONSTRAINT [PK_category] PRIMARY KEY CLUSTERED 
-			(
-				[id] ASC
-			)WITH (PAD_INDEX = OFF, STATISTICS_NORECOMPUTE = OFF, IGNORE_DUP_KEY = OFF, ALLOW_ROW_LOCKS = ON, ALLOW_PAGE_LOCKS = ON) ON [PRIMARY]
-			) ON [PRIMARY]
-		`)
-	if err != nil {
-		fmt.Printf("Table already created %q\n", err)
-	}
-	_, err = sess.Exec(`
-		CREATE TABLE [dbo].[bucket] (
-			[id] [int] IDENTITY(1,1) NOT NULL,
-			[categoryID] [int] NOT NULL,
-			[name] nvarchar(100) NOT NULL,
-			[description] nvarchar(1000) NOT NULL DEFAULT N'',
-			[isLiquid] bit NOT NULL DEFAULT 1
-		   CONSTRAINT [PK_bucket] PRIMARY KEY CLUSTERED ([id] ASC)
-			  WITH (PAD_INDEX = OFF, STATISTICS_NORECOMPUTE = OFF, IGNORE_DUP_KEY = OFF, ALLOW_ROW_LOCKS = ON, ALLOW_PAGE_LOCKS = ON) ON [PRIMARY]
-		   CONSTRAINT FK_bucket_category FOREIGN KEY (categoryID) REFERENCES dbo.category ([id])
-		  ) ON [PRIMARY]
-		`)
-	if err != nil {
-		fmt.Printf("Table already created %q\n", err)
-	}
-	_, err = sess.Exec(`
-		CREATE TABLE [dbo].[bucketitem] (
-			[id] [int] IDENTITY(1,1) NOT NULL,
-			[bucketID] [int] NOT NULL,
-			[transaction] datetime2(0) NOT NULL,
-			[name] nvarchar(100) NOT NULL,
-			[deposit] decimal(10,2) NOT NULL DEFAULT 0.00,
-			[withdrawl] decimal(10,2) NOT NULL DEFAULT 0.00
-		   CONSTRAINT [PK_bucketitem] PRIMARY KEY CLUSTERED ([id] ASC)
-			WITH (PAD_INDEX = OFF, STATISTICS_NORECOMPUTE = OFF, IGNORE_DUP_KEY = OFF, ALLOW_ROW_LOCKS = ON, ALLOW_PAGE_LOCKS = ON) ON [PRIMARY],
-		   CONSTRAINT FK_bucketitem_bucket FOREIGN KEY (bucketID) REFERENCES dbo.bucket ([id])
-		  ) ON [PRIMARY]
-		  `)
+	maxIdle, err := strconv.Atoi(readEnvOrDefault("DB_MAX_IDLE_CONNS", "5"))
 	if err != nil {
-		fmt.Printf("Table already created %q\n", err)
-	}
-	_, err = sess.Exec(`
-		CREATE TABLE [dbo].[template] (
-			  [id] [int] IDENTITY(1,1) NOT NULL,
-			  [name] nvarchar(100) NOT NULL,
-			 CONSTRAINT [PK_template] PRIMARY KEY CLUSTERED 
-			(
-				[id] ASC
-			)WITH (PAD_INDEX = OFF, STATISTICS_NORECOMPUTE = OFF, IGNORE_DUP_KEY = OFF, ALLOW_ROW_LOCKS = ON, ALLOW_PAGE_LOCKS = ON) ON [PRIMARY]
-			) ON [PRIMARY]
-			`)
-	if err != nil {
-		fmt.Printf("Table already created %q\n", err)
-	}
-	_, err = sess.Exec(`
-		CREATE TABLE [dbo].[templateitem] (
-			[id] [int] IDENTITY(1,1) NOT NULL,
-			[templateID] int NOT NULL,
-			[bucketID] int NOT NULL,
-			[name] nvarchar(100) NOT NULL,
-			[deposit] decimal(10,2) NOT NULL DEFAULT 0.00,
-			[withdraw] decimal(10,2) NOT NULL DEFAULT 0.00
-		   CONSTRAINT [PK_templateitem] PRIMARY KEY CLUSTERED 
-		  (
-			  [id] ASC
-		  )WITH (PAD_INDEX = OFF, STATISTICS_NORECOMPUTE = OFF, IGNORE_DUP_KEY = OFF, ALLOW_ROW_LOCKS = ON, ALLOW_PAGE_LOCKS = ON) ON [PRIMARY]
-		  ) ON [PRIMARY]
-		  `)
+		return nil, fmt.Errorf("DB_MAX_IDLE_CONNS: %v", err)
+	}
+	maxLifetime, err := time.ParseDuration(readEnvOrDefault("DB_CONN_MAX_LIFETIME", "30m"))
 	if err != nil {
-		fmt.Printf("Table already created %q\n", err)
+		return nil, fmt.Errorf("DB_CONN_MAX_LIFETIME: %v", err)
 	}
 
-	return err
-}
-
-func dbSummarizeBuckets() ([]BucketSummary, error) {
-	sess, err := mssql.Open(settings)
+	sess, err := open()
 	if err != nil {
 		return nil, err
 	}
-	defer sess.Close()
+	sess.SetMaxOpenConns(maxOpen)
+	sess.SetMaxIdleConns(maxIdle)
+	sess.SetConnMaxLifetime(maxLifetime)
+
+	if err := sess.Ping(); err != nil {
+		sess.Close()
+		return nil, err
+	}
+
+	return &sqlStore{sess: sess, dialect: dialect}, nil
+}
 
-	bucketSummaryRows, err := sess.Query(`
-SELECT bucket.id AS bucketID, category.id as categoryID, category.name AS categoryName, bucket.name AS bucketName, bucket.isLiquid, SUM(bucketitem.deposit) - SUM(bucketitem.withdrawl) AS total
-FROM bucket LEFT JOIN bucketItem ON bucketItem.bucketID = bucket.id
-INNER JOIN category ON bucket.categoryID = category.id
-GROUP BY bucket.id, category.id, category.name, bucket.name, bucket.isLiquid
-ORDER BY category.name, bucket.name;
-	`)
+// Close releases the pooled session.
+func (s *sqlStore) Close() error {
+	return s.sess.Close()
+}
+
+// Seed replaces the data with the sample records, in one transaction.
+// Tables are emptied children first so no foreign key is left dangling,
+// and the records link up by the ids they were given.
+func (s *sqlStore) Seed() error {
+	return s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		for _, table := range []string{"scheduleoccurrence", "schedule", "templateitem", "template", "bucketitem", "transfer", "bucket", "category"} {
+			if err := tx.Collection(table).Find().Delete(); err != nil {
+				return fmt.Errorf("emptying %s: %v", table, err)
+			}
+		}
+
+		house := &Category{Name: "house"}
+		if err := tx.Collection("category").InsertReturning(house); err != nil {
+			return err
+		}
+		if err := tx.Collection("category").InsertReturning(&Category{Name: "living"}); err != nil {
+			return err
+		}
+
+		gas := &Bucket{Name: "Gas", CategoryID: house.Id, IsLiquid: true, Currency: defaultCurrency}
+		if err := tx.Collection("bucket").InsertReturning(gas); err != nil {
+			return err
+		}
+		if err := tx.Collection("bucket").InsertReturning(&Bucket{Name: "Gabe's Personal", CategoryID: house.Id, Currency: defaultCurrency}); err != nil {
+			return err
+		}
+
+		err := tx.Collection("bucketitem").InsertReturning(&BucketItem{
+			Name:        "Initial Deposit",
+			BucketID:    gas.Id,
+			Deposit:     199,
+			Withdraw:    44,
+			Transaction: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+
+		paycheck := &Template{Name: "Bimonthly paycheck"}
+		if err := tx.Collection("template").InsertReturning(paycheck); err != nil {
+			return err
+		}
+
+		return tx.Collection("templateitem").InsertReturning(&TemplateItem{
+			Name:       "Deposit",
+			BucketID:   gas.Id,
+			TemplateID: paycheck.Id,
+			Deposit:    299,
+			Withdraw:   145,
+			Position:   1,
+		})
+	})
+}
+
+func (s *sqlStore) SummarizeBuckets() ([]BucketSummary, error) {
+	bucketSummaryRows, err := s.sess.Query(s.dialect.summarizeBuckets)
 	if err != nil {
 		return nil, err
 	}
@@ -227,32 +182,57 @@ ORDER BY category.name, bucket.name;
 	return bs, err
 }
 
-func dbNewBucketItem(bucketItem *BucketItem) error {
-	sess, err := mssql.Open(settings)
-	if err != nil {
-		return err
+func (s *sqlStore) GetBucketDailyTotals(filter DailyTotalFilter) ([]BucketDailyTotal, error) {
+	conds := []interface{}{db.Cond{"deletedAt": nil}}
+	if len(filter.BucketIDs) > 0 {
+		conds = append(conds, db.Cond{"bucketID IN": filter.BucketIDs})
+	}
+	if !filter.To.IsZero() {
+		conds = append(conds, db.Cond{"transaction <": filter.To.UTC().AddDate(0, 0, 1).Format("2006-01-02")})
+	}
+	total := db.Raw("SUM(deposit) - SUM(withdraw) AS total")
+
+	var totals []BucketDailyTotal
+	if !filter.From.IsZero() {
+		from := filter.From.UTC().Format("2006-01-02")
+		res := s.sess.Collection("bucketitem").Find(append(conds, db.Cond{"transaction <": from})...)
+		if err := res.Select("bucketID", total).Group("bucketID").All(&totals); err != nil {
+			return nil, err
+		}
+		for i := range totals {
+			totals[i].Day = filter.opening()
+		}
+		conds = append(conds, db.Cond{"transaction >=": from})
 	}
-	defer sess.Close()
 
-	bucketItemCollection := sess.Collection("bucketitem")
-	return bucketItemCollection.InsertReturning(bucketItem)
+	var days []BucketDailyTotal
+	res := s.sess.Collection("bucketitem").Find(conds...)
+	day := db.Raw(s.dialect.dayColumn)
+	if err := res.Select("bucketID", db.Raw(s.dialect.dayColumn+" AS day"), total).Group("bucketID", day).All(&days); err != nil {
+		return nil, err
+	}
+	return append(totals, days...), nil
 }
 
-func dbNewBucketItems(bucketItems []BucketItem) error {
-	sess, err := mssql.Open(settings)
-	if err != nil {
-		return err
-	}
-	defer sess.Close()
+func (s *sqlStore) NewBucketItem(bucketItem *BucketItem) error {
+	bucketItemCollection := s.sess.Collection("bucketitem")
+	bucketItem.Version = 1
+	return bucketItemCollection.InsertReturning(bucketItem)
+}
 
-	bucketItemsCollection := sess.Collection("bucketitem")
-	for _, bucketItem := range bucketItems {
-		fmt.Println("Enter bucketitem ", bucketItem)
-		if _, err := bucketItemsCollection.Insert(bucketItem); err != nil {
-			return err
+// NewBucketItems inserts all of the bucketItems in one transaction, so
+// either every item is stored (and gets its ID) or none are.
+func (s *sqlStore) NewBucketItems(bucketItems []*BucketItem) error {
+	return s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		bucketItemsCollection := tx.Collection("bucketitem")
+		for _, bucketItem := range bucketItems {
+			bucketItem.Version = 1
+			if err := bucketItemsCollection.InsertReturning(bucketItem); err != nil {
+				return err
+			}
 		}
-	}
-	return err
+		return nil
+	})
 }
 
 func parseStartDate(dateStr string) (time.Time, error) {
@@ -263,388 +243,806 @@ func parseStartDate(dateStr string) (time.Time, error) {
 	return timeVal, err
 }
 
-func parseEndDate(dateStr string) (time.Time, error) {
-	timeVal, err := parseStartDate(dateStr)
-	if err == nil {
-		timeVal = timeVal.Add(time.Duration(24*time.Hour - 1*time.Second))
-	}
-	return timeVal, err
+// amountColumn is a bucket item's amount, d - w. It is rounded to the cent
+// so backends keeping decimals as floats compare it exactly.
+const amountColumn = "ROUND(deposit - withdraw, 2)"
+
+// bucketItemColumns are the columns of the bucketItemSorts other than
+// amount.
+var bucketItemColumns = map[string]string{
+	"transaction": "transaction",
+	"name":        "name",
+	"bucket":      "bucketID",
+	"id":          "id",
 }
 
-func dbGetBucketItems(bucketID int, dateStart string, dateEnd string, inName string, pageSize int, pageStart int) ([]*BucketItem, error) {
-	sess, err := mssql.Open(settings)
-	if err != nil {
-		return nil, err
+func (s *sqlStore) GetBucketItems(filter BucketItemFilter, page Page) ([]*BucketItem, PageInfo, error) {
+	conds := []interface{}{db.Cond{"deletedAt": nil}}
+	if len(filter.BucketIDs) > 0 {
+		conds = append(conds, db.Cond{"bucketID IN": filter.BucketIDs})
 	}
-	defer sess.Close()
-
-	var bucketItems []*BucketItem
-	bucketItemSelector := sess.SelectFrom("bucketitem")
-	if bucketID != 0 {
-		bucketItemSelector = bucketItemSelector.Where("bucketID = ?", bucketID)
+	if len(filter.CategoryIDs) > 0 {
+		var buckets []*Bucket
+		if err := s.sess.Collection("bucket").Find(db.Cond{"categoryID IN": filter.CategoryIDs}).All(&buckets); err != nil {
+			return nil, PageInfo{}, err
+		}
+		if len(buckets) == 0 {
+			return nil, PageInfo{}, nil
+		}
+		bucketIDs := make([]int, len(buckets))
+		for i, bucket := range buckets {
+			bucketIDs[i] = bucket.Id
+		}
+		conds = append(conds, db.Cond{"bucketID IN": bucketIDs})
 	}
-	if date, err := parseStartDate(dateStart); err == nil {
-		bucketItemSelector = bucketItemSelector.Where("[transaction] >= ?", date.Format("2006-01-02 15:04:05"))
+	// the bounds are formatted without a zone, so they are put in UTC first
+	if !filter.From.IsZero() {
+		conds = append(conds, db.Cond{"transaction >=": filter.From.UTC().Format("2006-01-02 15:04:05")})
 	}
-
-	if date, err := parseEndDate(dateEnd); err == nil {
-		bucketItemSelector = bucketItemSelector.Where("[transaction] < ?", date.Format("2006-01-02 15:04:05"))
+	if !filter.To.IsZero() {
+		conds = append(conds, db.Cond{"transaction <": filter.To.UTC().Format("2006-01-02 15:04:05")})
+	}
+	if filter.MinAmount != nil {
+		conds = append(conds, db.Raw("ABS("+amountColumn+") >= ?", filter.MinAmount.float()))
+	}
+	if filter.MaxAmount != nil {
+		conds = append(conds, db.Raw("ABS("+amountColumn+") <= ?", filter.MaxAmount.float()))
+	}
+	switch filter.Kind {
+	case bucketItemDeposit:
+		conds = append(conds, db.Raw("deposit > withdraw"))
+	case bucketItemWithdraw:
+		conds = append(conds, db.Raw("withdraw > deposit"))
+	}
+	for _, tag := range filter.Tags {
+		conds = append(conds, s.dialect.contains("tags", "LIKE", ","+tag+","))
+	}
+	if filter.InName != "" {
+		conds = append(conds, s.dialect.contains("name", s.dialect.likeOperator, filter.InName))
+	}
+	for _, word := range strings.Fields(strings.ToLower(filter.Text)) {
+		conds = append(conds, db.Or(
+			s.dialect.contains("name", s.dialect.likeOperator, word),
+			s.dialect.contains("tags", "LIKE", word),
+		))
 	}
 
-	if inName != "" {
-		bucketItemSelector = bucketItemSelector.Where("name like ?", "%"+inName+"%")
+	field, desc := filter.order()
+	direction := ""
+	if desc {
+		direction = "-"
 	}
-	bucketItemSelector = bucketItemSelector.OrderBy("-transaction")
-	if pageSize <= 0 {
-		pageSize = 50
+	var sortBy interface{} = direction + bucketItemColumns[field]
+	if field == "amount" && desc {
+		sortBy = db.Raw(amountColumn + " DESC")
+	} else if field == "amount" {
+		sortBy = db.Raw(amountColumn)
 	}
-	if pageStart < 0 {
-		pageStart = 0
+	after := func(cursor *Cursor) (db.Compound, error) {
+		return bucketItemsAfter(field, desc, cursor)
 	}
-	query := bucketItemSelector.Paginate(uint(pageSize)).Page(uint(pageStart))
-	err = query.All(&bucketItems)
+	// The balance adds up every item of the bucket up to this one, the filter
+	// notwithstanding, so it is worked out per row rather than with a window
+	// over the filtered rows. It doesn't depend on the sort or the page.
+	res := s.sess.Collection("bucketitem").Find(conds...).Select("*", db.Raw(s.dialect.bucketItemBalance))
+	res, total, err := pageResult(res, page, after, sortBy, direction+"id")
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
+	var bucketItems []*BucketItem
+	if err := res.All(&bucketItems); err != nil {
+		return nil, PageInfo{}, err
+	}
+	info := PageInfo{Total: total}
+	if len(bucketItems) > page.Limit {
+		bucketItems = bucketItems[:page.Limit]
+		next := bucketItemCursor(bucketItems[page.Limit-1], field)
+		info.Next = &next
+	}
+	return bucketItems, info, nil
+}
 
-	return bucketItems, err
+// bucketItemsAfter is the condition picking the bucket items that follow
+// cursor in a list sorted on field, then id.
+func bucketItemsAfter(field string, desc bool, cursor *Cursor) (db.Compound, error) {
+	op := " >"
+	if desc {
+		op = " <"
+	}
+	var value interface{}
+	var err error
+	switch field {
+	case "id":
+		return db.Cond{"id" + op: cursor.ID}, nil
+	case "amount":
+		amount, err := parseAmountKey(cursor.Key)
+		if err != nil {
+			return nil, errInvalidCursor
+		}
+		return db.Or(
+			db.Raw(amountColumn+op+" ?", amount.float()),
+			db.And(db.Raw(amountColumn+" = ?", amount.float()), db.Cond{"id" + op: cursor.ID}),
+		), nil
+	case "transaction":
+		value, err = time.Parse(cursorTimeFormat, cursor.Key)
+	case "bucket":
+		value, err = strconv.Atoi(cursor.Key)
+	default:
+		value = cursor.Key
+	}
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	column := bucketItemColumns[field]
+	return db.Or(db.Cond{column + op: value}, db.Cond{column: value, "id" + op: cursor.ID}), nil
 }
 
-func dbGetBucketItem(id int) (*BucketItem, error) {
-	sess, err := mssql.Open(settings)
+// pageResult narrows res down to one page: the records after the page's
+// cursor, as picked by after, in the order given. It fetches one record
+// more than the page holds, telling whether another page follows, and
+// counts the whole list.
+func pageResult(res db.Result, page Page, after func(cursor *Cursor) (db.Compound, error), orderBy ...interface{}) (db.Result, int, error) {
+	total, err := res.Count()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	if page.After != nil {
+		cond, err := after(page.After)
+		if err != nil {
+			return nil, 0, err
+		}
+		res = res.And(cond)
 	}
-	defer sess.Close()
+	return res.OrderBy(orderBy...).Limit(page.Limit + 1), int(total), nil
+}
 
+func (s *sqlStore) GetBucketItem(id int) (*BucketItem, error) {
 	var bucketItem BucketItem
-	bucketItemCollection := sess.Collection("bucketitem")
-	res := bucketItemCollection.Find(db.Cond{"id": id})
-	err = res.One(&bucketItem)
+	bucketItemCollection := s.sess.Collection("bucketitem")
+	res := bucketItemCollection.Find(db.Cond{"id": id, "deletedAt": nil})
+	err := res.One(&bucketItem)
 
 	return &bucketItem, err
 }
 
-func dbUpdateBucketItem(id int, bucketItem *BucketItem) error {
-	sess, err := mssql.Open(settings)
-	if err != nil {
+func (s *sqlStore) UpdateBucketItem(id int, bucketItem *BucketItem) error {
+	if err := updateVersioned(s.sess, "bucketitem", id, bucketItem, &bucketItem.Version); err != nil {
 		return err
 	}
-	defer sess.Close()
-
-	bucketItemCollection := sess.Collection("bucketitem")
+	bucketItemCollection := s.sess.Collection("bucketitem")
 	res := bucketItemCollection.Find(db.Cond{"id": id})
-	err = res.Update(bucketItem)
-	if err != nil {
-		return err
-	}
-	err = res.One(bucketItem)
+	err := res.One(bucketItem)
 
 	return err
 }
 
-func dbRemoveBucketItem(id int) error {
-	sess, err := mssql.Open(settings)
-	if err != nil {
-		return err
-	}
-	defer sess.Close()
-
-	bucketItemCollection := sess.Collection("bucketitem")
-	res := bucketItemCollection.Find(db.Cond{"id": id})
-	err = res.Delete()
+// RemoveBucketItem moves the bucket item to the trash; PurgeTrash deletes
+// it for good later.
+func (s *sqlStore) RemoveBucketItem(id int) error {
+	bucketItemCollection := s.sess.Collection("bucketitem")
+	res := bucketItemCollection.Find(db.Cond{"id": id, "deletedAt": nil})
+	err := res.Update(map[string]interface{}{"deletedAt": time.Now().UTC()})
 
 	return err
 }
 
-func dbNewBucket(bucket *Bucket) error {
-	sess, err := mssql.Open(settings)
-	if err != nil {
-		return err
-	}
-	defer sess.Close()
+// GetDeletedBucketItems lists the bucket items in the trash, leaving out
+// the legs of trashed transfers.
+func (s *sqlStore) GetDeletedBucketItems() ([]*BucketItem, error) {
+	var bucketItems []*BucketItem
+	bucketItemCollection := s.sess.Collection("bucketitem")
+	res := bucketItemCollection.Find(db.Cond{"deletedAt IS NOT": nil, "transferID": nil}).OrderBy("-deletedAt")
+	err := res.All(&bucketItems)
 
-	bucketCollection := sess.Collection("bucket")
-	return bucketCollection.InsertReturning(bucket)
+	return bucketItems, err
 }
 
-func dbGetBuckets() ([]*Bucket, error) {
-	sess, err := mssql.Open(settings)
-	if err != nil {
-		return nil, err
+func (s *sqlStore) RestoreBucketItem(id int) error {
+	bucketItemCollection := s.sess.Collection("bucketitem")
+	res := bucketItemCollection.Find(db.Cond{"id": id, "deletedAt IS NOT": nil, "transferID": nil})
+	if exists, err := res.Exists(); err != nil || !exists {
+		return db.ErrNoMoreRows
 	}
-	defer sess.Close()
+	return res.Update(map[string]interface{}{"deletedAt": nil})
+}
 
+func (s *sqlStore) NewBucket(bucket *Bucket) error {
+	bucketCollection := s.sess.Collection("bucket")
+	bucket.Version = 1
+	return bucketCollection.InsertReturning(bucket)
+}
+
+func (s *sqlStore) GetBuckets() ([]*Bucket, error) {
 	var buckets []*Bucket
-	bucketCollection := sess.Collection("bucket")
+	bucketCollection := s.sess.Collection("bucket")
 	res := bucketCollection.Find()
-	err = res.All(&buckets)
+	err := res.All(&buckets)
 
 	return buckets, err
 }
 
-func dbGetBucket(id int) (*Bucket, error) {
-	sess, err := mssql.Open(settings)
-	if err != nil {
-		return nil, err
-	}
-	defer sess.Close()
-
+func (s *sqlStore) GetBucket(id int) (*Bucket, error) {
 	var bucket Bucket
-	bucketCollection := sess.Collection("bucket")
+	bucketCollection := s.sess.Collection("bucket")
 	res := bucketCollection.Find(db.Cond{"id": id})
-	err = res.One(&bucket)
+	err := res.One(&bucket)
 
 	return &bucket, err
 }
 
-func dbUpdateBucket(id int, bucket *Bucket) error {
-	sess, err := mssql.Open(settings)
-	if err != nil {
+func (s *sqlStore) UpdateBucket(id int, bucket *Bucket) error {
+	if err := updateVersioned(s.sess, "bucket", id, bucket, &bucket.Version); err != nil {
 		return err
 	}
-	defer sess.Close()
-
-	bucketCollection := sess.Collection("bucket")
+	bucketCollection := s.sess.Collection("bucket")
 	res := bucketCollection.Find(db.Cond{"id": id})
-	err = res.Update(bucket)
-	if err != nil {
-		return err
-	}
-	err = res.One(bucket)
+	err := res.One(bucket)
 
 	return err
 }
 
-func dbRemoveBucket(id int) error {
-	sess, err := mssql.Open(settings)
-	if err != nil {
-		return err
-	}
-	defer sess.Close()
-
-	bucketCollection := sess.Collection("bucket")
+func (s *sqlStore) SetBucketArchived(id int, archived bool) error {
+	bucketCollection := s.sess.Collection("bucket")
 	res := bucketCollection.Find(db.Cond{"id": id})
-	err = res.Delete()
 
-	return err
+	return res.Update(map[string]interface{}{"archived": archived, "version": db.Raw("version + 1")})
 }
 
-func dbNewCategory(category *Category) error {
-	sess, err := mssql.Open(settings)
-	if err != nil {
+// RemoveBucket deletes the bucket in one transaction with whatever opts
+// says to do with its bucket items, template items and transfers, and
+// returns the records it removed or moved along with it.
+func (s *sqlStore) RemoveBucket(id int, opts RemoveOptions) ([]Change, error) {
+	var changes []Change
+	err := s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		var err error
+		changes, err = removeBucket(tx, id, opts)
 		return err
-	}
-	defer sess.Close()
+	})
+	return changes, err
+}
 
-	categoryCollection := sess.Collection("category")
-	err = categoryCollection.InsertReturning(category)
+func (s *sqlStore) NewCategory(category *Category) error {
+	categoryCollection := s.sess.Collection("category")
+	category.Version = 1
+	err := categoryCollection.InsertReturning(category)
 	return err
 }
 
-func dbGetCategories() ([]*Category, error) {
-	sess, err := mssql.Open(settings)
-	if err != nil {
-		return nil, err
-	}
-	defer sess.Close()
-
+func (s *sqlStore) GetCategories() ([]*Category, error) {
 	var categories []*Category
-	categoryCollection := sess.Collection("category")
+	categoryCollection := s.sess.Collection("category")
 	res := categoryCollection.Find()
-	err = res.All(&categories)
+	err := res.All(&categories)
 
 	return categories, err
 }
 
-func dbGetCategory(id int) (*Category, error) {
-	sess, err := mssql.Open(settings)
-	if err != nil {
-		return nil, err
-	}
-	defer sess.Close()
-
+func (s *sqlStore) GetCategory(id int) (*Category, error) {
 	var category Category
-	categoryCollection := sess.Collection("category")
+	categoryCollection := s.sess.Collection("category")
 	res := categoryCollection.Find(db.Cond{"id": id})
-	err = res.One(&category)
+	err := res.One(&category)
 
 	return &category, err
 }
 
-func dbUpdateCategory(id int, category *Category) error {
-	sess, err := mssql.Open(settings)
-	if err != nil {
+func (s *sqlStore) UpdateCategory(id int, category *Category) error {
+	if err := updateVersioned(s.sess, "category", id, category, &category.Version); err != nil {
 		return err
 	}
-	defer sess.Close()
-
-	categoryCollection := sess.Collection("category")
+	categoryCollection := s.sess.Collection("category")
 	res := categoryCollection.Find(db.Cond{"id": id})
-	err = res.Update(category)
-	if err != nil {
-		return err
-	}
-	err = res.One(category)
+	err := res.One(category)
 
 	return err
 }
 
-func dbRemoveCategory(id int) error {
-	sess, err := mssql.Open(settings)
-	if err != nil {
-		return err
-	}
-	defer sess.Close()
-
-	categoryCollection := sess.Collection("category")
+func (s *sqlStore) SetCategoryArchived(id int, archived bool) error {
+	categoryCollection := s.sess.Collection("category")
 	res := categoryCollection.Find(db.Cond{"id": id})
-	err = res.Delete()
 
-	return err
+	return res.Update(map[string]interface{}{"archived": archived, "version": db.Raw("version + 1")})
 }
 
-func dbNewTemplate(template *Template) error {
-	sess, err := mssql.Open(settings)
-	if err != nil {
+// RemoveCategory deletes the category in one transaction with whatever
+// opts says to do with its buckets.
+func (s *sqlStore) RemoveCategory(id int, opts RemoveOptions) ([]Change, error) {
+	var changes []Change
+	err := s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		var err error
+		changes, err = removeCategory(tx, id, opts)
 		return err
-	}
-	defer sess.Close()
+	})
+	return changes, err
+}
 
-	templateCollection := sess.Collection("template")
-	err = templateCollection.InsertReturning(template)
+func (s *sqlStore) NewTemplate(template *Template) error {
+	templateCollection := s.sess.Collection("template")
+	template.Version = 1
+	err := templateCollection.InsertReturning(template)
 
 	return err
 }
 
-func dbGetTemplates() ([]*Template, error) {
-	sess, err := mssql.Open(settings)
-	if err != nil {
-		return nil, err
-	}
-	defer sess.Close()
-
+func (s *sqlStore) GetTemplates() ([]*Template, error) {
 	var templates []*Template
-	templateCollection := sess.Collection("template")
+	templateCollection := s.sess.Collection("template")
 	res := templateCollection.Find()
-	err = res.All(&templates)
+	err := res.All(&templates)
 
 	return templates, err
 }
 
-func dbGetTemplate(id int) (*Template, error) {
-	sess, err := mssql.Open(settings)
-	if err != nil {
-		return nil, err
-	}
-	defer sess.Close()
-
+func (s *sqlStore) GetTemplate(id int) (*Template, error) {
 	var template Template
-	templateCollection := sess.Collection("template")
+	templateCollection := s.sess.Collection("template")
 	res := templateCollection.Find(db.Cond{"id": id})
-	err = res.One(&template)
+	err := res.One(&template)
 
 	return &template, err
 }
 
-func dbUpdateTemplate(id int, template *Template) error {
-	sess, err := mssql.Open(settings)
-	if err != nil {
+func (s *sqlStore) UpdateTemplate(id int, template *Template) error {
+	if err := updateVersioned(s.sess, "template", id, template, &template.Version); err != nil {
 		return err
 	}
-	defer sess.Close()
-
-	templateCollection := sess.Collection("template")
+	templateCollection := s.sess.Collection("template")
 	res := templateCollection.Find(db.Cond{"id": id})
-	err = res.Update(template)
-	if err != nil {
-		return err
-	}
-	err = res.One(template)
+	err := res.One(template)
 
 	return err
 }
 
-func dbRemoveTemplate(id int) error {
-	sess, err := mssql.Open(settings)
-	if err != nil {
+// RemoveTemplate deletes the template in one transaction with whatever
+// opts says to do with its template items and schedules.
+func (s *sqlStore) RemoveTemplate(id int, opts RemoveOptions) ([]Change, error) {
+	var changes []Change
+	err := s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		var err error
+		changes, err = removeTemplate(tx, id, opts)
 		return err
-	}
-	defer sess.Close()
-
-	templateCollection := sess.Collection("template")
-	res := templateCollection.Find(db.Cond{"id": id})
-	err = res.Delete()
-
-	return err
+	})
+	return changes, err
 }
 
-func dbNewTemplateItem(templateItem *TemplateItem) error {
-	sess, err := mssql.Open(settings)
-	if err != nil {
-		return err
+// NewTemplateItem stores templateItem, placing it after the other items of
+// its template unless it already has a position.
+func (s *sqlStore) NewTemplateItem(templateItem *TemplateItem) error {
+	templateItemCollection := s.sess.Collection("templateitem")
+	if templateItem.Position == 0 {
+		var last TemplateItem
+		err := templateItemCollection.Find(db.Cond{"templateID": templateItem.TemplateID}).OrderBy("-position").Limit(1).One(&last)
+		switch err {
+		case nil:
+			templateItem.Position = last.Position + 1
+		case db.ErrNoMoreRows:
+			templateItem.Position = 1
+		default:
+			return err
+		}
 	}
-	defer sess.Close()
-
-	templateItemCollection := sess.Collection("templateitem")
+	templateItem.Version = 1
 	return templateItemCollection.InsertReturning(templateItem)
 }
 
-func dbGetTemplateItems() ([]*TemplateItem, error) {
-	sess, err := mssql.Open(settings)
+func (s *sqlStore) GetTemplateItems(page Page) ([]*TemplateItem, PageInfo, error) {
+	after := func(cursor *Cursor) (db.Compound, error) {
+		return db.Cond{"id >": cursor.ID}, nil
+	}
+	res, total, err := pageResult(s.sess.Collection("templateitem").Find(), page, after, "id")
 	if err != nil {
-		return nil, err
+		return nil, PageInfo{}, err
+	}
+	var templateItems []*TemplateItem
+	if err := res.All(&templateItems); err != nil {
+		return nil, PageInfo{}, err
+	}
+	info := PageInfo{Total: total}
+	if len(templateItems) > page.Limit {
+		templateItems = templateItems[:page.Limit]
+		next := templateItemCursor(templateItems[page.Limit-1])
+		info.Next = &next
 	}
-	defer sess.Close()
+	return templateItems, info, nil
+}
 
+func (s *sqlStore) GetTemplateItemsByTemplate(templateID int) ([]*TemplateItem, error) {
 	var templateItems []*TemplateItem
-	templateItemCollection := sess.Collection("templateitem")
-	res := templateItemCollection.Find()
-	err = res.All(&templateItems)
+	templateItemCollection := s.sess.Collection("templateitem")
+	res := templateItemCollection.Find(db.Cond{"templateID": templateID}).OrderBy("position", "id")
+	err := res.All(&templateItems)
 
 	return templateItems, err
 }
 
-func dbGetTemplateItem(id int) (*TemplateItem, error) {
-	sess, err := mssql.Open(settings)
-	if err != nil {
-		return nil, err
+func (s *sqlStore) SearchTemplateItems(templateID int, bucketID int, inName string) ([]*TemplateItem, error) {
+	var templateItems []*TemplateItem
+	templateItemSelector := s.sess.SelectFrom("templateitem")
+	if templateID != 0 {
+		templateItemSelector = templateItemSelector.Where(db.Cond{"templateID": templateID})
+	}
+	if bucketID != 0 {
+		templateItemSelector = templateItemSelector.Where(db.Cond{"bucketID": bucketID})
 	}
-	defer sess.Close()
+	if inName != "" {
+		templateItemSelector = templateItemSelector.Where(s.dialect.contains("name", s.dialect.likeOperator, inName))
+	}
+	err := templateItemSelector.OrderBy("templateID", "position", "id").All(&templateItems)
+
+	return templateItems, err
+}
+
+// ReorderTemplateItems numbers the items of the template in the order of
+// ids, in one transaction.
+func (s *sqlStore) ReorderTemplateItems(templateID int, ids []int) error {
+	return s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		templateItemCollection := tx.Collection("templateitem")
+		for i, id := range ids {
+			// Items already in place keep their version.
+			res := templateItemCollection.Find(db.Cond{"id": id, "templateID": templateID, "position <>": i + 1})
+			if err := res.Update(map[string]interface{}{"position": i + 1, "version": db.Raw("version + 1")}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
+func (s *sqlStore) GetTemplateItem(id int) (*TemplateItem, error) {
 	var templateItem TemplateItem
-	templateItemCollection := sess.Collection("templateitem")
+	templateItemCollection := s.sess.Collection("templateitem")
 	res := templateItemCollection.Find(db.Cond{"id": id})
-	err = res.One(&templateItem)
+	err := res.One(&templateItem)
 
 	return &templateItem, err
 }
 
-func dbUpdateTemplateItem(id int, templateItem *TemplateItem) error {
-	sess, err := mssql.Open(settings)
-	if err != nil {
+func (s *sqlStore) UpdateTemplateItem(id int, templateItem *TemplateItem) error {
+	if err := updateVersioned(s.sess, "templateitem", id, templateItem, &templateItem.Version); err != nil {
 		return err
 	}
-	defer sess.Close()
+	templateItemCollection := s.sess.Collection("templateitem")
+	res := templateItemCollection.Find(db.Cond{"id": id})
+	err := res.One(templateItem)
+
+	return err
+}
 
-	templateItemCollection := sess.Collection("templateitem")
+func (s *sqlStore) RemoveTemplateItem(id int) error {
+	templateItemCollection := s.sess.Collection("templateitem")
 	res := templateItemCollection.Find(db.Cond{"id": id})
-	err = res.Update(templateItem)
-	if err != nil {
+	err := res.Delete()
+
+	return err
+}
+
+func (s *sqlStore) NewExchangeRate(exchangeRate *ExchangeRate) error {
+	exchangeRateCollection := s.sess.Collection("exchangerate")
+	exchangeRate.Version = 1
+	return exchangeRateCollection.InsertReturning(exchangeRate)
+}
+
+func (s *sqlStore) GetExchangeRates() ([]*ExchangeRate, error) {
+	var exchangeRates []*ExchangeRate
+	exchangeRateCollection := s.sess.Collection("exchangerate")
+	res := exchangeRateCollection.Find().OrderBy("fromCurrency", "toCurrency", "effective")
+	err := res.All(&exchangeRates)
+
+	return exchangeRates, err
+}
+
+func (s *sqlStore) GetExchangeRate(id int) (*ExchangeRate, error) {
+	var exchangeRate ExchangeRate
+	exchangeRateCollection := s.sess.Collection("exchangerate")
+	res := exchangeRateCollection.Find(db.Cond{"id": id})
+	err := res.One(&exchangeRate)
+
+	return &exchangeRate, err
+}
+
+func (s *sqlStore) UpdateExchangeRate(id int, exchangeRate *ExchangeRate) error {
+	if err := updateVersioned(s.sess, "exchangerate", id, exchangeRate, &exchangeRate.Version); err != nil {
 		return err
 	}
-	err = res.One(templateItem)
+	exchangeRateCollection := s.sess.Collection("exchangerate")
+	res := exchangeRateCollection.Find(db.Cond{"id": id})
 
-	return err
+	return res.One(exchangeRate)
 }
 
-func dbRemoveTemplateItem(id int) error {
-	sess, err := mssql.Open(settings)
+func (s *sqlStore) RemoveExchangeRate(id int) error {
+	exchangeRateCollection := s.sess.Collection("exchangerate")
+	res := exchangeRateCollection.Find(db.Cond{"id": id})
+
+	return res.Delete()
+}
+
+// NewTransfer stores the transfer and both of its bucket items in one
+// transaction.
+func (s *sqlStore) NewTransfer(transfer *Transfer) error {
+	return s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		transfer.Version = 1
+		if err := tx.Collection("transfer").InsertReturning(transfer); err != nil {
+			return err
+		}
+		bucketItemCollection := tx.Collection("bucketitem")
+		if err := bucketItemCollection.InsertReturning(transfer.withdrawLeg()); err != nil {
+			return err
+		}
+		return bucketItemCollection.InsertReturning(transfer.depositLeg())
+	})
+}
+
+func (s *sqlStore) GetTransfers(page Page) ([]*Transfer, PageInfo, error) {
+	after := func(cursor *Cursor) (db.Compound, error) {
+		transaction, err := time.Parse(cursorTimeFormat, cursor.Key)
+		if err != nil {
+			return nil, errInvalidCursor
+		}
+		return db.Or(db.Cond{"transaction <": transaction}, db.Cond{"transaction": transaction, "id <": cursor.ID}), nil
+	}
+	res, total, err := pageResult(s.sess.Collection("transfer").Find(db.Cond{"deletedAt": nil}), page, after, "-transaction", "-id")
 	if err != nil {
+		return nil, PageInfo{}, err
+	}
+	var transfers []*Transfer
+	if err := res.All(&transfers); err != nil {
+		return nil, PageInfo{}, err
+	}
+	info := PageInfo{Total: total}
+	if len(transfers) > page.Limit {
+		transfers = transfers[:page.Limit]
+		next := transferCursor(transfers[page.Limit-1])
+		info.Next = &next
+	}
+	return transfers, info, nil
+}
+
+func (s *sqlStore) GetTransfersByID(ids []int) ([]*Transfer, error) {
+	var transfers []*Transfer
+	transferCollection := s.sess.Collection("transfer")
+	res := transferCollection.Find(db.Cond{"id IN": ids, "deletedAt": nil})
+	err := res.All(&transfers)
+
+	return transfers, err
+}
+
+func (s *sqlStore) GetTransfer(id int) (*Transfer, error) {
+	var transfer Transfer
+	transferCollection := s.sess.Collection("transfer")
+	res := transferCollection.Find(db.Cond{"id": id, "deletedAt": nil})
+	err := res.One(&transfer)
+
+	return &transfer, err
+}
+
+func (s *sqlStore) GetTransferBucketItems(id int) ([]*BucketItem, error) {
+	var bucketItems []*BucketItem
+	bucketItemCollection := s.sess.Collection("bucketitem")
+	res := bucketItemCollection.Find(db.Cond{"transferID": id, "deletedAt": nil}).OrderBy("id")
+	err := res.All(&bucketItems)
+
+	return bucketItems, err
+}
+
+// UpdateTransfer updates the transfer and rewrites both of its bucket items
+// to match, in one transaction.
+func (s *sqlStore) UpdateTransfer(id int, transfer *Transfer) error {
+	return s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		if err := updateVersioned(tx, "transfer", id, transfer, &transfer.Version); err != nil {
+			return err
+		}
+		res := tx.Collection("transfer").Find(db.Cond{"id": id})
+		if err := res.One(transfer); err != nil {
+			return err
+		}
+
+		bucketItemCollection := tx.Collection("bucketitem")
+		withdraw := bucketItemCollection.Find(db.Cond{"transferID": id, "withdraw >": 0})
+		err := withdraw.Update(map[string]interface{}{
+			"bucketID":    transfer.FromBucketID,
+			"name":        transfer.Name,
+			"transaction": transfer.Transaction,
+			"withdraw":    transfer.Amount,
+			"version":     db.Raw("version + 1"),
+		})
+		if err != nil {
+			return err
+		}
+		deposit := bucketItemCollection.Find(db.Cond{"transferID": id, "deposit >": 0})
+		return deposit.Update(map[string]interface{}{
+			"bucketID":    transfer.ToBucketID,
+			"name":        transfer.Name,
+			"transaction": transfer.Transaction,
+			"deposit":     transfer.ToAmount,
+			"version":     db.Raw("version + 1"),
+		})
+	})
+}
+
+// RemoveTransfer moves the transfer together with both of its bucket items
+// to the trash.
+func (s *sqlStore) RemoveTransfer(id int) error {
+	now := time.Now().UTC()
+	return s.setTransferDeletedAt(id, &now)
+}
+
+// GetDeletedTransfers lists the transfers in the trash.
+func (s *sqlStore) GetDeletedTransfers() ([]*Transfer, error) {
+	var transfers []*Transfer
+	transferCollection := s.sess.Collection("transfer")
+	res := transferCollection.Find(db.Cond{"deletedAt IS NOT": nil}).OrderBy("-deletedAt")
+	err := res.All(&transfers)
+
+	return transfers, err
+}
+
+// RestoreTransfer takes the transfer and both of its bucket items back out
+// of the trash.
+func (s *sqlStore) RestoreTransfer(id int) error {
+	return s.setTransferDeletedAt(id, nil)
+}
+
+// setTransferDeletedAt trashes (or restores, given nil) the transfer and
+// its bucket items in one transaction.
+func (s *sqlStore) setTransferDeletedAt(id int, deletedAt *time.Time) error {
+	return s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		cond := db.Cond{"id": id, "deletedAt": nil}
+		if deletedAt == nil {
+			cond = db.Cond{"id": id, "deletedAt IS NOT": nil}
+		}
+		res := tx.Collection("transfer").Find(cond)
+		if exists, err := res.Exists(); err != nil || !exists {
+			return db.ErrNoMoreRows
+		}
+		if err := res.Update(map[string]interface{}{"deletedAt": deletedAt}); err != nil {
+			return err
+		}
+		legs := tx.Collection("bucketitem").Find(db.Cond{"transferID": id})
+		return legs.Update(map[string]interface{}{"deletedAt": deletedAt})
+	})
+}
+
+// PurgeTrash deletes for good whatever went to the trash before
+// deletedBefore.
+func (s *sqlStore) PurgeTrash(deletedBefore time.Time) error {
+	return s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		var transfers []Transfer
+		expired := tx.Collection("transfer").Find(db.Cond{"deletedAt <": deletedBefore})
+		if err := expired.All(&transfers); err != nil {
+			return err
+		}
+		if len(transfers) > 0 {
+			var transferIDs []int
+			for _, transfer := range transfers {
+				transferIDs = append(transferIDs, transfer.ID)
+			}
+			if err := tx.Collection("bucketitem").Find(db.Cond{"transferID IN": transferIDs}).Delete(); err != nil {
+				return err
+			}
+			if err := tx.Collection("transfer").Find(db.Cond{"id IN": transferIDs}).Delete(); err != nil {
+				return err
+			}
+		}
+		return tx.Collection("bucketitem").Find(db.Cond{"deletedAt <": deletedBefore, "transferID": nil}).Delete()
+	})
+}
+
+func (s *sqlStore) NewSchedule(schedule *Schedule) error {
+	scheduleCollection := s.sess.Collection("schedule")
+	schedule.Version = 1
+	return scheduleCollection.InsertReturning(schedule)
+}
+
+func (s *sqlStore) GetSchedules() ([]*Schedule, error) {
+	var schedules []*Schedule
+	scheduleCollection := s.sess.Collection("schedule")
+	res := scheduleCollection.Find().OrderBy("id")
+	err := res.All(&schedules)
+
+	return schedules, err
+}
+
+func (s *sqlStore) GetSchedule(id int) (*Schedule, error) {
+	var schedule Schedule
+	scheduleCollection := s.sess.Collection("schedule")
+	res := scheduleCollection.Find(db.Cond{"id": id})
+	err := res.One(&schedule)
+
+	return &schedule, err
+}
+
+func (s *sqlStore) UpdateSchedule(id int, schedule *Schedule) error {
+	if err := updateVersioned(s.sess, "schedule", id, schedule, &schedule.Version); err != nil {
 		return err
 	}
-	defer sess.Close()
+	scheduleCollection := s.sess.Collection("schedule")
+	res := scheduleCollection.Find(db.Cond{"id": id})
 
-	templateItemCollection := sess.Collection("templateitem")
-	res := templateItemCollection.Find(db.Cond{"id": id})
-	err = res.Delete()
+	return res.One(schedule)
+}
 
-	return err
+// RemoveSchedule deletes the schedule and its posted occurrences.
+func (s *sqlStore) RemoveSchedule(id int) error {
+	return s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		if err := tx.Collection("scheduleoccurrence").Find(db.Cond{"scheduleID": id}).Delete(); err != nil {
+			return err
+		}
+		return tx.Collection("schedule").Find(db.Cond{"id": id}).Delete()
+	})
+}
+
+func (s *sqlStore) GetScheduleOccurrences(scheduleID int) ([]*ScheduleOccurrence, error) {
+	var occurrences []*ScheduleOccurrence
+	occurrenceCollection := s.sess.Collection("scheduleoccurrence")
+	res := occurrenceCollection.Find(db.Cond{"scheduleID": scheduleID}).OrderBy("occurrence")
+	err := res.All(&occurrences)
+
+	return occurrences, err
+}
+
+// PostScheduleOccurrence records the occurrence and inserts its bucket items
+// in one transaction. The unique (scheduleID, occurrence) constraint turns
+// a second attempt at the same occurrence into an error.
+func (s *sqlStore) PostScheduleOccurrence(occurrence *ScheduleOccurrence, bucketItems []*BucketItem) error {
+	return s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		if err := tx.Collection("scheduleoccurrence").InsertReturning(occurrence); err != nil {
+			return err
+		}
+		bucketItemCollection := tx.Collection("bucketitem")
+		for _, bucketItem := range bucketItems {
+			bucketItem.Version = 1
+			if err := bucketItemCollection.InsertReturning(bucketItem); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlStore) NewAuditEntry(entry *AuditEntry) error {
+	auditCollection := s.sess.Collection("auditentry")
+	return auditCollection.InsertReturning(entry)
+}
+
+func (s *sqlStore) GetAuditEntries(filter AuditFilter, page Page) ([]*AuditEntry, PageInfo, error) {
+	cond := db.Cond{}
+	if filter.Resource != "" {
+		cond["resource"] = filter.Resource
+	}
+	if filter.ResourceID != 0 {
+		cond["resourceID"] = filter.ResourceID
+	}
+	if filter.Actor != "" {
+		cond["actor"] = filter.Actor
+	}
+	if !filter.From.IsZero() {
+		cond["changedAt >="] = filter.From
+	}
+	if !filter.To.IsZero() {
+		cond["changedAt <"] = filter.To
+	}
+
+	after := func(cursor *Cursor) (db.Compound, error) {
+		changedAt, err := time.Parse(cursorTimeFormat, cursor.Key)
+		if err != nil {
+			return nil, errInvalidCursor
+		}
+		return db.Or(db.Cond{"changedAt <": changedAt}, db.Cond{"changedAt": changedAt, "id <": cursor.ID}), nil
+	}
+	res, total, err := pageResult(s.sess.Collection("auditentry").Find(cond), page, after, "-changedAt", "-id")
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
+	var entries []*AuditEntry
+	if err := res.All(&entries); err != nil {
+		return nil, PageInfo{}, err
+	}
+	info := PageInfo{Total: total}
+	if len(entries) > page.Limit {
+		entries = entries[:page.Limit]
+		next := auditEntryCursor(entries[page.Limit-1])
+		info.Next = &next
+	}
+	return entries, info, nil
 }
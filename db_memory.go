@@ -0,0 +1,1343 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNoRecord = &dbError{"record not found"}
+
+// memoryStore is a Store that keeps everything in process memory. It is
+// meant for tests and demos; nothing survives a restart.
+type memoryStore struct {
+	mu sync.Mutex
+
+	lastIDs       map[string]int
+	categories    map[int]Category
+	buckets       map[int]Bucket
+	bucketItems   map[int]BucketItem
+	templates     map[int]Template
+	templateItems map[int]TemplateItem
+	exchangeRates map[int]ExchangeRate
+	transfers     map[int]Transfer
+	schedules     map[int]Schedule
+	occurrences   map[int]ScheduleOccurrence
+	auditEntries  []AuditEntry // kept across Seed, like the sql backends
+}
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{}
+	s.reset()
+	return s
+}
+
+func (s *memoryStore) reset() {
+	s.lastIDs = map[string]int{}
+	s.categories = map[int]Category{}
+	s.buckets = map[int]Bucket{}
+	s.bucketItems = map[int]BucketItem{}
+	s.templates = map[int]Template{}
+	s.templateItems = map[int]TemplateItem{}
+	s.exchangeRates = map[int]ExchangeRate{}
+	s.transfers = map[int]Transfer{}
+	s.schedules = map[int]Schedule{}
+	s.occurrences = map[int]ScheduleOccurrence{}
+}
+
+// nextID hands out identity values per table, like the sql backends do.
+func (s *memoryStore) nextID(table string) int {
+	s.lastIDs[table]++
+	return s.lastIDs[table]
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// Seed replaces the contents of the store with the same sample data the
+// sql backends load on /db/init.
+func (s *memoryStore) Seed() error {
+	s.mu.Lock()
+	s.reset()
+	s.mu.Unlock()
+
+	house := &Category{Name: "house"}
+	if err := s.NewCategory(house); err != nil {
+		return err
+	}
+	if err := s.NewCategory(&Category{Name: "living"}); err != nil {
+		return err
+	}
+
+	gas := &Bucket{Name: "Gas", CategoryID: house.Id, IsLiquid: true, Currency: defaultCurrency}
+	if err := s.NewBucket(gas); err != nil {
+		return err
+	}
+	if err := s.NewBucket(&Bucket{Name: "Gabe's Personal", CategoryID: house.Id, Currency: defaultCurrency}); err != nil {
+		return err
+	}
+
+	err := s.NewBucketItem(&BucketItem{
+		Name:        "Initial Deposit",
+		BucketID:    gas.Id,
+		Deposit:     199,
+		Withdraw:    44,
+		Transaction: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	paycheck := &Template{Name: "Bimonthly paycheck"}
+	if err := s.NewTemplate(paycheck); err != nil {
+		return err
+	}
+
+	return s.NewTemplateItem(&TemplateItem{
+		Name:       "Deposit",
+		BucketID:   gas.Id,
+		TemplateID: paycheck.Id,
+		Deposit:    299,
+		Withdraw:   145,
+	})
+}
+
+func (s *memoryStore) SummarizeBuckets() ([]BucketSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	totals := map[int]Money{}
+	for _, bucketItem := range s.bucketItems {
+		if bucketItem.DeletedAt != nil {
+			continue
+		}
+		totals[bucketItem.BucketID] += bucketItem.Deposit - bucketItem.Withdraw
+	}
+
+	var bs []BucketSummary
+	for _, bucket := range s.buckets {
+		category, ok := s.categories[bucket.CategoryID]
+		if !ok {
+			continue
+		}
+		bs = append(bs, BucketSummary{
+			BucketID:         bucket.Id,
+			CategoryName:     category.Name,
+			BucketName:       bucket.Name,
+			Total:            totals[bucket.Id],
+			Currency:         bucket.Currency,
+			IsLiquid:         bucket.IsLiquid,
+			Archived:         bucket.Archived,
+			CategoryArchived: category.Archived,
+		})
+	}
+	sort.Slice(bs, func(i, j int) bool {
+		if bs[i].CategoryName != bs[j].CategoryName {
+			return bs[i].CategoryName < bs[j].CategoryName
+		}
+		return bs[i].BucketName < bs[j].BucketName
+	})
+	return bs, nil
+}
+
+func (s *memoryStore) GetBucketDailyTotals(filter DailyTotalFilter) ([]BucketDailyTotal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type bucketDay struct {
+		bucketID int
+		day      string
+	}
+	var from, to string
+	if !filter.From.IsZero() {
+		from = filter.From.UTC().Format("2006-01-02")
+	}
+	if !filter.To.IsZero() {
+		to = filter.To.UTC().Format("2006-01-02")
+	}
+	totals := map[bucketDay]Money{}
+	for _, bucketItem := range s.bucketItems {
+		if bucketItem.DeletedAt != nil || len(filter.BucketIDs) > 0 && !containsInt(filter.BucketIDs, bucketItem.BucketID) {
+			continue
+		}
+		key := bucketDay{bucketItem.BucketID, bucketItem.Transaction.UTC().Format("2006-01-02")}
+		if to != "" && key.day > to {
+			continue
+		}
+		if key.day < from {
+			key.day = filter.opening()
+		}
+		totals[key] += bucketItem.Deposit - bucketItem.Withdraw
+	}
+
+	var dailyTotals []BucketDailyTotal
+	for key, total := range totals {
+		dailyTotals = append(dailyTotals, BucketDailyTotal{BucketID: key.bucketID, Day: key.day, Total: total})
+	}
+	return dailyTotals, nil
+}
+
+func (s *memoryStore) NewBucketItem(bucketItem *BucketItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.buckets[bucketItem.BucketID]; !ok {
+		return &dbError{"bucket does not exist"}
+	}
+	bucketItem.Version = 1
+	bucketItem.ID = s.nextID("bucketitem")
+	s.bucketItems[bucketItem.ID] = *bucketItem
+	return nil
+}
+
+func (s *memoryStore) NewBucketItems(bucketItems []*BucketItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Check everything first so a bad item leaves the store untouched.
+	for _, bucketItem := range bucketItems {
+		if _, ok := s.buckets[bucketItem.BucketID]; !ok {
+			return &dbError{"bucket does not exist"}
+		}
+	}
+	for _, bucketItem := range bucketItems {
+		bucketItem.Version = 1
+		bucketItem.ID = s.nextID("bucketitem")
+		s.bucketItems[bucketItem.ID] = *bucketItem
+	}
+	return nil
+}
+
+func (s *memoryStore) GetBucketItems(filter BucketItemFilter, page Page) ([]*BucketItem, PageInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	categories := map[int]int{}
+	for _, bucket := range s.buckets {
+		categories[bucket.Id] = bucket.CategoryID
+	}
+	var bucketItems []*BucketItem
+	for _, bucketItem := range s.bucketItems {
+		if bucketItem.DeletedAt != nil || !filter.matches(&bucketItem, categories) {
+			continue
+		}
+		bi := bucketItem
+		bucketItems = append(bucketItems, &bi)
+	}
+	field, desc := filter.order()
+	first, last, info := page.paginate(bucketItems, func(i int) Cursor { return bucketItemCursor(bucketItems[i], field) }, desc)
+
+	balances := s.bucketItemBalances()
+	for _, bucketItem := range bucketItems[first:last] {
+		balance := balances[bucketItem.ID]
+		bucketItem.Balance = &balance
+	}
+	return bucketItems[first:last], info, nil
+}
+
+// bucketItemBalances is the balance of its bucket after each bucket item
+// outside the trash, adding the items up in transaction, then id order.
+func (s *memoryStore) bucketItemBalances() map[int]Money {
+	var bucketItems []BucketItem
+	for _, bucketItem := range s.bucketItems {
+		if bucketItem.DeletedAt == nil {
+			bucketItems = append(bucketItems, bucketItem)
+		}
+	}
+	sort.Slice(bucketItems, func(i, j int) bool {
+		if !bucketItems[i].Transaction.Equal(bucketItems[j].Transaction) {
+			return bucketItems[i].Transaction.Before(bucketItems[j].Transaction)
+		}
+		return bucketItems[i].ID < bucketItems[j].ID
+	})
+
+	totals := map[int]Money{}
+	balances := map[int]Money{}
+	for _, bucketItem := range bucketItems {
+		totals[bucketItem.BucketID] += bucketItem.Deposit - bucketItem.Withdraw
+		balances[bucketItem.ID] = totals[bucketItem.BucketID]
+	}
+	return balances
+}
+
+func (s *memoryStore) GetBucketItem(id int) (*BucketItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucketItem, ok := s.bucketItems[id]
+	if !ok || bucketItem.DeletedAt != nil {
+		return nil, errNoRecord
+	}
+	return &bucketItem, nil
+}
+
+func (s *memoryStore) UpdateBucketItem(id int, bucketItem *BucketItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	original, ok := s.bucketItems[id]
+	if !ok || original.DeletedAt != nil {
+		return errNoRecord
+	}
+	if original.Version != bucketItem.Version {
+		return ErrVersionConflict
+	}
+	if _, ok := s.buckets[bucketItem.BucketID]; !ok {
+		return &dbError{"bucket does not exist"}
+	}
+	bucketItem.ID = id
+	bucketItem.Version++
+	s.bucketItems[id] = *bucketItem
+	return nil
+}
+
+func (s *memoryStore) RemoveBucketItem(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucketItem, ok := s.bucketItems[id]
+	if !ok || bucketItem.DeletedAt != nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	bucketItem.DeletedAt = &now
+	s.bucketItems[id] = bucketItem
+	return nil
+}
+
+func (s *memoryStore) GetDeletedBucketItems() ([]*BucketItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var bucketItems []*BucketItem
+	for _, bucketItem := range s.bucketItems {
+		if bucketItem.DeletedAt != nil && bucketItem.TransferID == nil {
+			bi := bucketItem
+			bucketItems = append(bucketItems, &bi)
+		}
+	}
+	sort.Slice(bucketItems, func(i, j int) bool {
+		return bucketItems[i].DeletedAt.After(*bucketItems[j].DeletedAt)
+	})
+	return bucketItems, nil
+}
+
+func (s *memoryStore) RestoreBucketItem(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucketItem, ok := s.bucketItems[id]
+	if !ok || bucketItem.DeletedAt == nil || bucketItem.TransferID != nil {
+		return errNoRecord
+	}
+	bucketItem.DeletedAt = nil
+	s.bucketItems[id] = bucketItem
+	return nil
+}
+
+func (s *memoryStore) NewBucket(bucket *Bucket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.categories[bucket.CategoryID]; !ok {
+		return &dbError{"category does not exist"}
+	}
+	bucket.Version = 1
+	bucket.Id = s.nextID("bucket")
+	s.buckets[bucket.Id] = *bucket
+	return nil
+}
+
+func (s *memoryStore) GetBuckets() ([]*Bucket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buckets []*Bucket
+	for _, bucket := range s.buckets {
+		r := bucket
+		buckets = append(buckets, &r)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Id < buckets[j].Id })
+	return buckets, nil
+}
+
+func (s *memoryStore) GetBucket(id int) (*Bucket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, ok := s.buckets[id]
+	if !ok {
+		return nil, errNoRecord
+	}
+	return &bucket, nil
+}
+
+func (s *memoryStore) UpdateBucket(id int, bucket *Bucket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	original, ok := s.buckets[id]
+	if !ok {
+		return errNoRecord
+	}
+	if original.Version != bucket.Version {
+		return ErrVersionConflict
+	}
+	if _, ok := s.categories[bucket.CategoryID]; !ok {
+		return &dbError{"category does not exist"}
+	}
+	bucket.Id = id
+	bucket.Version++
+	s.buckets[id] = *bucket
+	return nil
+}
+
+func (s *memoryStore) SetBucketArchived(id int, archived bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, ok := s.buckets[id]
+	if !ok {
+		return errNoRecord
+	}
+	bucket.Archived = archived
+	bucket.Version++
+	s.buckets[id] = bucket
+	return nil
+}
+
+func (s *memoryStore) RemoveBucket(id int, opts RemoveOptions) ([]Change, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.removeBucket(id, opts)
+}
+
+// removeBucket mirrors the sql backends: everything is checked before
+// anything changes, so a refused removal leaves the store as it was.
+func (s *memoryStore) removeBucket(id int, opts RemoveOptions) ([]Change, error) {
+	dependents := Dependents{}
+	for _, bucketItem := range s.bucketItems {
+		switch {
+		case bucketItem.BucketID != id:
+		case bucketItem.DeletedAt == nil:
+			dependents["bucketItems"]++
+		default:
+			dependents["trashedBucketItems"]++
+		}
+	}
+	for _, templateItem := range s.templateItems {
+		if templateItem.BucketID == id {
+			dependents["templateItems"]++
+		}
+	}
+	for _, transfer := range s.transfers {
+		switch {
+		case transfer.FromBucketID != id && transfer.ToBucketID != id:
+		case transfer.DeletedAt == nil:
+			dependents["transfers"]++
+		default:
+			dependents["trashedTransfers"]++
+		}
+	}
+
+	var changes []Change
+	switch {
+	case opts.ReassignTo != 0:
+		var err error
+		if changes, err = s.reassignBucket(id, opts.ReassignTo); err != nil {
+			return nil, err
+		}
+	case opts.Cascade || len(dependents) == 0:
+		var removed, removedTemplateItems []Change
+		for transferID, transfer := range s.transfers {
+			if transfer.FromBucketID == id || transfer.ToBucketID == id {
+				for itemID, bucketItem := range s.bucketItems {
+					if bucketItem.TransferID != nil && *bucketItem.TransferID == transferID {
+						removed = append(removed, Change{Resource: auditBucketItem, ID: itemID, Before: bucketItem})
+						delete(s.bucketItems, itemID)
+					}
+				}
+				delete(s.transfers, transferID)
+			}
+		}
+		for itemID, bucketItem := range s.bucketItems {
+			if bucketItem.BucketID == id {
+				removed = append(removed, Change{Resource: auditBucketItem, ID: itemID, Before: bucketItem})
+				delete(s.bucketItems, itemID)
+			}
+		}
+		for itemID, templateItem := range s.templateItems {
+			if templateItem.BucketID == id {
+				removedTemplateItems = append(removedTemplateItems, Change{Resource: auditTemplateItem, ID: itemID, Before: templateItem})
+				delete(s.templateItems, itemID)
+			}
+		}
+		sortChanges(removed)
+		sortChanges(removedTemplateItems)
+		changes = append(removed, removedTemplateItems...)
+	default:
+		return nil, &DependentsError{Resource: "bucket", ID: id, Dependents: dependents}
+	}
+
+	delete(s.buckets, id)
+	return changes, nil
+}
+
+// sortChanges puts changes to records of one kind in the order of their
+// ids, as the sql backends list them.
+func sortChanges(changes []Change) {
+	sort.Slice(changes, func(i, j int) bool { return changes[i].ID < changes[j].ID })
+}
+
+func (s *memoryStore) reassignBucket(id int, to int) ([]Change, error) {
+	if to == id {
+		return nil, &dbError{"cannot reassign a bucket to itself"}
+	}
+	target, ok := s.buckets[to]
+	if !ok {
+		return nil, &dbError{fmt.Sprintf("bucket %d does not exist", to)}
+	}
+	if category, ok := s.categories[target.CategoryID]; target.Archived || ok && category.Archived {
+		return nil, &dbError{fmt.Sprintf("bucket %d is archived", to)}
+	}
+	if from := s.buckets[id]; from.Currency != target.Currency {
+		return nil, &dbError{fmt.Sprintf("bucket %d holds %s, not %s", to, target.Currency, from.Currency)}
+	}
+	for _, transfer := range s.transfers {
+		if transfer.FromBucketID == to && transfer.ToBucketID == id || transfer.FromBucketID == id && transfer.ToBucketID == to {
+			return nil, &dbError{fmt.Sprintf("bucket %d has transfers with bucket %d, which can't move into one bucket", id, to)}
+		}
+	}
+
+	var moved, movedTemplateItems []Change
+	for itemID, bucketItem := range s.bucketItems {
+		if bucketItem.BucketID == id {
+			before := bucketItem
+			bucketItem.BucketID = to
+			bucketItem.Version++
+			s.bucketItems[itemID] = bucketItem
+			moved = append(moved, Change{Resource: auditBucketItem, ID: itemID, Before: before, After: bucketItem})
+		}
+	}
+	for itemID, templateItem := range s.templateItems {
+		if templateItem.BucketID == id {
+			before := templateItem
+			templateItem.BucketID = to
+			templateItem.Version++
+			s.templateItems[itemID] = templateItem
+			movedTemplateItems = append(movedTemplateItems, Change{Resource: auditTemplateItem, ID: itemID, Before: before, After: templateItem})
+		}
+	}
+	for transferID, transfer := range s.transfers {
+		switch id {
+		case transfer.FromBucketID:
+			transfer.FromBucketID = to
+		case transfer.ToBucketID:
+			transfer.ToBucketID = to
+		default:
+			continue
+		}
+		transfer.Version++
+		s.transfers[transferID] = transfer
+	}
+	sortChanges(moved)
+	sortChanges(movedTemplateItems)
+	return append(moved, movedTemplateItems...), nil
+}
+
+func (s *memoryStore) NewCategory(category *Category) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	category.Version = 1
+	category.Id = s.nextID("category")
+	s.categories[category.Id] = *category
+	return nil
+}
+
+func (s *memoryStore) GetCategories() ([]*Category, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var categories []*Category
+	for _, category := range s.categories {
+		r := category
+		categories = append(categories, &r)
+	}
+	sort.Slice(categories, func(i, j int) bool { return categories[i].Id < categories[j].Id })
+	return categories, nil
+}
+
+func (s *memoryStore) GetCategory(id int) (*Category, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	category, ok := s.categories[id]
+	if !ok {
+		return nil, errNoRecord
+	}
+	return &category, nil
+}
+
+func (s *memoryStore) UpdateCategory(id int, category *Category) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	original, ok := s.categories[id]
+	if !ok {
+		return errNoRecord
+	}
+	if original.Version != category.Version {
+		return ErrVersionConflict
+	}
+	category.Id = id
+	category.Version++
+	s.categories[id] = *category
+	return nil
+}
+
+func (s *memoryStore) SetCategoryArchived(id int, archived bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	category, ok := s.categories[id]
+	if !ok {
+		return errNoRecord
+	}
+	category.Archived = archived
+	category.Version++
+	s.categories[id] = category
+	return nil
+}
+
+func (s *memoryStore) RemoveCategory(id int, opts RemoveOptions) ([]Change, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dependents := Dependents{}
+	for _, bucket := range s.buckets {
+		if bucket.CategoryID == id {
+			dependents["buckets"]++
+		}
+	}
+
+	var bucketIDs []int
+	for bucketID, bucket := range s.buckets {
+		if bucket.CategoryID == id {
+			bucketIDs = append(bucketIDs, bucketID)
+		}
+	}
+	sort.Ints(bucketIDs)
+
+	var changes []Change
+	switch {
+	case len(dependents) == 0:
+	case opts.ReassignTo != 0:
+		if opts.ReassignTo == id {
+			return nil, &dbError{"cannot reassign a category to itself"}
+		}
+		if _, ok := s.categories[opts.ReassignTo]; !ok {
+			return nil, &dbError{fmt.Sprintf("category %d does not exist", opts.ReassignTo)}
+		}
+		for _, bucketID := range bucketIDs {
+			bucket := s.buckets[bucketID]
+			before := bucket
+			bucket.CategoryID = opts.ReassignTo
+			bucket.Version++
+			s.buckets[bucketID] = bucket
+			changes = append(changes, Change{Resource: auditBucket, ID: bucketID, Before: before, After: bucket})
+		}
+	case opts.Cascade:
+		for _, bucketID := range bucketIDs {
+			bucket := s.buckets[bucketID]
+			removed, err := s.removeBucket(bucketID, opts)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, removed...)
+			changes = append(changes, Change{Resource: auditBucket, ID: bucketID, Before: bucket})
+		}
+	default:
+		return nil, &DependentsError{Resource: "category", ID: id, Dependents: dependents}
+	}
+
+	delete(s.categories, id)
+	return changes, nil
+}
+
+func (s *memoryStore) NewTemplate(template *Template) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	template.Version = 1
+	template.Id = s.nextID("template")
+	s.templates[template.Id] = *template
+	return nil
+}
+
+func (s *memoryStore) GetTemplates() ([]*Template, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var templates []*Template
+	for _, template := range s.templates {
+		r := template
+		templates = append(templates, &r)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Id < templates[j].Id })
+	return templates, nil
+}
+
+func (s *memoryStore) GetTemplate(id int) (*Template, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	template, ok := s.templates[id]
+	if !ok {
+		return nil, errNoRecord
+	}
+	return &template, nil
+}
+
+func (s *memoryStore) UpdateTemplate(id int, template *Template) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	original, ok := s.templates[id]
+	if !ok {
+		return errNoRecord
+	}
+	if original.Version != template.Version {
+		return ErrVersionConflict
+	}
+	template.Id = id
+	template.Version++
+	s.templates[id] = *template
+	return nil
+}
+
+func (s *memoryStore) RemoveTemplate(id int, opts RemoveOptions) ([]Change, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dependents := Dependents{}
+	for _, templateItem := range s.templateItems {
+		if templateItem.TemplateID == id {
+			dependents["templateItems"]++
+		}
+	}
+	for _, schedule := range s.schedules {
+		if schedule.TemplateID == id {
+			dependents["schedules"]++
+		}
+	}
+
+	var changes []Change
+	switch {
+	case len(dependents) == 0:
+	case opts.ReassignTo != 0:
+		if opts.ReassignTo == id {
+			return nil, &dbError{"cannot reassign a template to itself"}
+		}
+		if _, ok := s.templates[opts.ReassignTo]; !ok {
+			return nil, &dbError{fmt.Sprintf("template %d does not exist", opts.ReassignTo)}
+		}
+		var moved []*TemplateItem
+		position := 0
+		for _, templateItem := range s.templateItems {
+			if templateItem.TemplateID == opts.ReassignTo && templateItem.Position > position {
+				position = templateItem.Position
+			}
+			if templateItem.TemplateID == id {
+				r := templateItem
+				moved = append(moved, &r)
+			}
+		}
+		sortTemplateItems(moved)
+		for _, templateItem := range moved {
+			before := *templateItem
+			position++
+			templateItem.TemplateID = opts.ReassignTo
+			templateItem.Position = position
+			templateItem.Version++
+			s.templateItems[templateItem.ID] = *templateItem
+			changes = append(changes, Change{Resource: auditTemplateItem, ID: templateItem.ID, Before: before, After: *templateItem})
+		}
+		for scheduleID, schedule := range s.schedules {
+			if schedule.TemplateID == id {
+				schedule.TemplateID = opts.ReassignTo
+				schedule.Version++
+				s.schedules[scheduleID] = schedule
+			}
+		}
+	case opts.Cascade:
+		for scheduleID, schedule := range s.schedules {
+			if schedule.TemplateID != id {
+				continue
+			}
+			for occurrenceID, occurrence := range s.occurrences {
+				if occurrence.ScheduleID == scheduleID {
+					delete(s.occurrences, occurrenceID)
+				}
+			}
+			delete(s.schedules, scheduleID)
+		}
+		for itemID, templateItem := range s.templateItems {
+			if templateItem.TemplateID == id {
+				changes = append(changes, Change{Resource: auditTemplateItem, ID: itemID, Before: templateItem})
+				delete(s.templateItems, itemID)
+			}
+		}
+		sortChanges(changes)
+	default:
+		return nil, &DependentsError{Resource: "template", ID: id, Dependents: dependents}
+	}
+
+	delete(s.templates, id)
+	return changes, nil
+}
+
+// checkTemplateItem stands in for the template and bucket foreign keys.
+func (s *memoryStore) checkTemplateItem(templateItem *TemplateItem) error {
+	if _, ok := s.templates[templateItem.TemplateID]; !ok {
+		return &dbError{"template does not exist"}
+	}
+	if _, ok := s.buckets[templateItem.BucketID]; !ok {
+		return &dbError{"bucket does not exist"}
+	}
+	return nil
+}
+
+func (s *memoryStore) NewTemplateItem(templateItem *TemplateItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkTemplateItem(templateItem); err != nil {
+		return err
+	}
+	if templateItem.Position == 0 {
+		for _, other := range s.templateItems {
+			if other.TemplateID == templateItem.TemplateID && other.Position > templateItem.Position {
+				templateItem.Position = other.Position
+			}
+		}
+		templateItem.Position++
+	}
+	templateItem.Version = 1
+	templateItem.ID = s.nextID("templateitem")
+	s.templateItems[templateItem.ID] = *templateItem
+	return nil
+}
+
+func (s *memoryStore) GetTemplateItems(page Page) ([]*TemplateItem, PageInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var templateItems []*TemplateItem
+	for _, templateItem := range s.templateItems {
+		r := templateItem
+		templateItems = append(templateItems, &r)
+	}
+	start, end, info := page.paginate(templateItems, func(i int) Cursor { return templateItemCursor(templateItems[i]) }, false)
+	return templateItems[start:end], info, nil
+}
+
+func (s *memoryStore) GetTemplateItemsByTemplate(templateID int) ([]*TemplateItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var templateItems []*TemplateItem
+	for _, templateItem := range s.templateItems {
+		if templateItem.TemplateID != templateID {
+			continue
+		}
+		r := templateItem
+		templateItems = append(templateItems, &r)
+	}
+	sortTemplateItems(templateItems)
+	return templateItems, nil
+}
+
+func (s *memoryStore) SearchTemplateItems(templateID int, bucketID int, inName string) ([]*TemplateItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inName = strings.ToLower(inName)
+	var templateItems []*TemplateItem
+	for _, templateItem := range s.templateItems {
+		if templateID != 0 && templateItem.TemplateID != templateID {
+			continue
+		}
+		if bucketID != 0 && templateItem.BucketID != bucketID {
+			continue
+		}
+		if inName != "" && !strings.Contains(strings.ToLower(templateItem.Name), inName) {
+			continue
+		}
+		r := templateItem
+		templateItems = append(templateItems, &r)
+	}
+	sortTemplateItems(templateItems)
+	return templateItems, nil
+}
+
+// sortTemplateItems orders items by template, then position, like the sql
+// backends do.
+func sortTemplateItems(templateItems []*TemplateItem) {
+	sort.Slice(templateItems, func(i, j int) bool {
+		a, b := templateItems[i], templateItems[j]
+		if a.TemplateID != b.TemplateID {
+			return a.TemplateID < b.TemplateID
+		}
+		if a.Position != b.Position {
+			return a.Position < b.Position
+		}
+		return a.ID < b.ID
+	})
+}
+
+func (s *memoryStore) ReorderTemplateItems(templateID int, ids []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		if templateItem, ok := s.templateItems[id]; !ok || templateItem.TemplateID != templateID {
+			return errNoRecord
+		}
+	}
+	for i, id := range ids {
+		templateItem := s.templateItems[id]
+		if templateItem.Position == i+1 {
+			continue
+		}
+		templateItem.Position = i + 1
+		templateItem.Version++
+		s.templateItems[id] = templateItem
+	}
+	return nil
+}
+
+func (s *memoryStore) GetTemplateItem(id int) (*TemplateItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	templateItem, ok := s.templateItems[id]
+	if !ok {
+		return nil, errNoRecord
+	}
+	return &templateItem, nil
+}
+
+func (s *memoryStore) UpdateTemplateItem(id int, templateItem *TemplateItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	original, ok := s.templateItems[id]
+	if !ok {
+		return errNoRecord
+	}
+	if original.Version != templateItem.Version {
+		return ErrVersionConflict
+	}
+	if err := s.checkTemplateItem(templateItem); err != nil {
+		return err
+	}
+	templateItem.ID = id
+	templateItem.Version++
+	s.templateItems[id] = *templateItem
+	return nil
+}
+
+func (s *memoryStore) RemoveTemplateItem(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.templateItems, id)
+	return nil
+}
+
+func (s *memoryStore) NewExchangeRate(exchangeRate *ExchangeRate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exchangeRate.Version = 1
+	exchangeRate.ID = s.nextID("exchangerate")
+	s.exchangeRates[exchangeRate.ID] = *exchangeRate
+	return nil
+}
+
+func (s *memoryStore) GetExchangeRates() ([]*ExchangeRate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var exchangeRates []*ExchangeRate
+	for _, exchangeRate := range s.exchangeRates {
+		r := exchangeRate
+		exchangeRates = append(exchangeRates, &r)
+	}
+	sort.Slice(exchangeRates, func(i, j int) bool { return exchangeRates[i].ID < exchangeRates[j].ID })
+	return exchangeRates, nil
+}
+
+func (s *memoryStore) GetExchangeRate(id int) (*ExchangeRate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exchangeRate, ok := s.exchangeRates[id]
+	if !ok {
+		return nil, errNoRecord
+	}
+	return &exchangeRate, nil
+}
+
+func (s *memoryStore) UpdateExchangeRate(id int, exchangeRate *ExchangeRate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	original, ok := s.exchangeRates[id]
+	if !ok {
+		return errNoRecord
+	}
+	if original.Version != exchangeRate.Version {
+		return ErrVersionConflict
+	}
+	exchangeRate.ID = id
+	exchangeRate.Version++
+	s.exchangeRates[id] = *exchangeRate
+	return nil
+}
+
+func (s *memoryStore) RemoveExchangeRate(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.exchangeRates, id)
+	return nil
+}
+
+func (s *memoryStore) NewTransfer(transfer *Transfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.buckets[transfer.FromBucketID]; !ok {
+		return &dbError{"bucket does not exist"}
+	}
+	if _, ok := s.buckets[transfer.ToBucketID]; !ok {
+		return &dbError{"bucket does not exist"}
+	}
+	transfer.Version = 1
+	transfer.ID = s.nextID("transfer")
+	s.transfers[transfer.ID] = *transfer
+	for _, leg := range []*BucketItem{transfer.withdrawLeg(), transfer.depositLeg()} {
+		leg.ID = s.nextID("bucketitem")
+		s.bucketItems[leg.ID] = *leg
+	}
+	return nil
+}
+
+func (s *memoryStore) GetTransfers(page Page) ([]*Transfer, PageInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var transfers []*Transfer
+	for _, transfer := range s.transfers {
+		if transfer.DeletedAt != nil {
+			continue
+		}
+		r := transfer
+		transfers = append(transfers, &r)
+	}
+	start, end, info := page.paginate(transfers, func(i int) Cursor { return transferCursor(transfers[i]) }, true)
+	return transfers[start:end], info, nil
+}
+
+func (s *memoryStore) GetTransfersByID(ids []int) ([]*Transfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var transfers []*Transfer
+	for _, id := range ids {
+		if transfer, ok := s.transfers[id]; ok && transfer.DeletedAt == nil {
+			transfers = append(transfers, &transfer)
+		}
+	}
+	return transfers, nil
+}
+
+func (s *memoryStore) GetTransfer(id int) (*Transfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transfer, ok := s.transfers[id]
+	if !ok || transfer.DeletedAt != nil {
+		return nil, errNoRecord
+	}
+	return &transfer, nil
+}
+
+func (s *memoryStore) GetTransferBucketItems(id int) ([]*BucketItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var bucketItems []*BucketItem
+	for _, bucketItem := range s.bucketItems {
+		if bucketItem.TransferID != nil && *bucketItem.TransferID == id && bucketItem.DeletedAt == nil {
+			bi := bucketItem
+			bucketItems = append(bucketItems, &bi)
+		}
+	}
+	sort.Slice(bucketItems, func(i, j int) bool { return bucketItems[i].ID < bucketItems[j].ID })
+	return bucketItems, nil
+}
+
+func (s *memoryStore) UpdateTransfer(id int, transfer *Transfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	original, ok := s.transfers[id]
+	if !ok || original.DeletedAt != nil {
+		return errNoRecord
+	}
+	if original.Version != transfer.Version {
+		return ErrVersionConflict
+	}
+	if _, ok := s.buckets[transfer.FromBucketID]; !ok {
+		return &dbError{"bucket does not exist"}
+	}
+	if _, ok := s.buckets[transfer.ToBucketID]; !ok {
+		return &dbError{"bucket does not exist"}
+	}
+	transfer.ID = id
+	transfer.Version++
+	s.transfers[id] = *transfer
+
+	for itemID, bucketItem := range s.bucketItems {
+		if bucketItem.TransferID == nil || *bucketItem.TransferID != id {
+			continue
+		}
+		leg := transfer.depositLeg()
+		if bucketItem.Withdraw > 0 {
+			leg = transfer.withdrawLeg()
+		}
+		leg.ID = itemID
+		leg.Version = bucketItem.Version + 1
+		s.bucketItems[itemID] = *leg
+	}
+	return nil
+}
+
+func (s *memoryStore) RemoveTransfer(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	if err := s.setTransferDeletedAt(id, &now); err != nil && err != errNoRecord {
+		return err
+	}
+	return nil
+}
+
+func (s *memoryStore) GetDeletedTransfers() ([]*Transfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var transfers []*Transfer
+	for _, transfer := range s.transfers {
+		if transfer.DeletedAt != nil {
+			r := transfer
+			transfers = append(transfers, &r)
+		}
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].DeletedAt.After(*transfers[j].DeletedAt)
+	})
+	return transfers, nil
+}
+
+func (s *memoryStore) RestoreTransfer(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.setTransferDeletedAt(id, nil)
+}
+
+// setTransferDeletedAt trashes (or restores, given nil) the transfer and
+// its bucket items.
+func (s *memoryStore) setTransferDeletedAt(id int, deletedAt *time.Time) error {
+	transfer, ok := s.transfers[id]
+	if !ok || (transfer.DeletedAt == nil) == (deletedAt == nil) {
+		return errNoRecord
+	}
+	transfer.DeletedAt = deletedAt
+	s.transfers[id] = transfer
+	for itemID, bucketItem := range s.bucketItems {
+		if bucketItem.TransferID != nil && *bucketItem.TransferID == id {
+			bucketItem.DeletedAt = deletedAt
+			s.bucketItems[itemID] = bucketItem
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) PurgeTrash(deletedBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for transferID, transfer := range s.transfers {
+		if transfer.DeletedAt != nil && transfer.DeletedAt.Before(deletedBefore) {
+			for itemID, bucketItem := range s.bucketItems {
+				if bucketItem.TransferID != nil && *bucketItem.TransferID == transferID {
+					delete(s.bucketItems, itemID)
+				}
+			}
+			delete(s.transfers, transferID)
+		}
+	}
+	for itemID, bucketItem := range s.bucketItems {
+		if bucketItem.DeletedAt != nil && bucketItem.TransferID == nil && bucketItem.DeletedAt.Before(deletedBefore) {
+			delete(s.bucketItems, itemID)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) NewSchedule(schedule *Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.templates[schedule.TemplateID]; !ok {
+		return &dbError{"template does not exist"}
+	}
+	schedule.Version = 1
+	schedule.ID = s.nextID("schedule")
+	s.schedules[schedule.ID] = *schedule
+	return nil
+}
+
+func (s *memoryStore) GetSchedules() ([]*Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var schedules []*Schedule
+	for _, schedule := range s.schedules {
+		r := schedule
+		schedules = append(schedules, &r)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].ID < schedules[j].ID })
+	return schedules, nil
+}
+
+func (s *memoryStore) GetSchedule(id int) (*Schedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedule, ok := s.schedules[id]
+	if !ok {
+		return nil, errNoRecord
+	}
+	return &schedule, nil
+}
+
+func (s *memoryStore) UpdateSchedule(id int, schedule *Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	original, ok := s.schedules[id]
+	if !ok {
+		return errNoRecord
+	}
+	if original.Version != schedule.Version {
+		return ErrVersionConflict
+	}
+	if _, ok := s.templates[schedule.TemplateID]; !ok {
+		return &dbError{"template does not exist"}
+	}
+	schedule.ID = id
+	schedule.Version++
+	s.schedules[id] = *schedule
+	return nil
+}
+
+func (s *memoryStore) RemoveSchedule(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for occurrenceID, occurrence := range s.occurrences {
+		if occurrence.ScheduleID == id {
+			delete(s.occurrences, occurrenceID)
+		}
+	}
+	delete(s.schedules, id)
+	return nil
+}
+
+func (s *memoryStore) GetScheduleOccurrences(scheduleID int) ([]*ScheduleOccurrence, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var occurrences []*ScheduleOccurrence
+	for _, occurrence := range s.occurrences {
+		if occurrence.ScheduleID != scheduleID {
+			continue
+		}
+		r := occurrence
+		occurrences = append(occurrences, &r)
+	}
+	sort.Slice(occurrences, func(i, j int) bool { return occurrences[i].Occurrence.Before(occurrences[j].Occurrence) })
+	return occurrences, nil
+}
+
+func (s *memoryStore) PostScheduleOccurrence(occurrence *ScheduleOccurrence, bucketItems []*BucketItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.schedules[occurrence.ScheduleID]; !ok {
+		return &dbError{"schedule does not exist"}
+	}
+	for _, posted := range s.occurrences {
+		if posted.ScheduleID == occurrence.ScheduleID && posted.Occurrence.Equal(occurrence.Occurrence) {
+			return &dbError{"occurrence already posted"}
+		}
+	}
+	for _, bucketItem := range bucketItems {
+		if _, ok := s.buckets[bucketItem.BucketID]; !ok {
+			return &dbError{"bucket does not exist"}
+		}
+	}
+
+	occurrence.ID = s.nextID("scheduleoccurrence")
+	s.occurrences[occurrence.ID] = *occurrence
+	for _, bucketItem := range bucketItems {
+		bucketItem.Version = 1
+		bucketItem.ID = s.nextID("bucketitem")
+		s.bucketItems[bucketItem.ID] = *bucketItem
+	}
+	return nil
+}
+
+func (s *memoryStore) NewAuditEntry(entry *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.ID = len(s.auditEntries) + 1
+	s.auditEntries = append(s.auditEntries, *entry)
+	return nil
+}
+
+func (s *memoryStore) GetAuditEntries(filter AuditFilter, page Page) ([]*AuditEntry, PageInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []*AuditEntry
+	for i := len(s.auditEntries) - 1; i >= 0; i-- {
+		if entry := s.auditEntries[i]; filter.matches(&entry) {
+			entries = append(entries, &entry)
+		}
+	}
+	start, end, info := page.paginate(entries, func(i int) Cursor { return auditEntryCursor(entries[i]) }, true)
+	return entries[start:end], info, nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"upper.io/db.v3/lib/sqlbuilder"
+	"upper.io/db.v3/mssql"
+)
+
+var mssqlDialect = sqlDialect{
+	schemaVersionTable: `
+		IF OBJECT_ID(N'dbo.schema_version', N'U') IS NULL
+		CREATE TABLE [dbo].[schema_version] (
+			[version] [int] NOT NULL,
+			[name] nvarchar(100) NOT NULL,
+			[applied] datetime2(0) NOT NULL,
+			CONSTRAINT [PK_schema_version] PRIMARY KEY CLUSTERED ([version] ASC)
+		) ON [PRIMARY]
+		`,
+	migrations: []migration{
+		{
+			version: 1,
+			name:    "initial schema",
+			// Guarded so databases set up before migrations existed are adopted as is.
+			up: []string{
+				`
+				IF OBJECT_ID(N'dbo.category', N'U') IS NULL
+				CREATE TABLE [dbo].[category] (
+					[id] [int] IDENTITY(1,1) NOT NULL,
+					[name] nvarchar(100) NOT NULL,
+					CONSTRAINT [PK_category] PRIMARY KEY CLUSTERED 
+					(
+						[id] ASC
+					)WITH (PAD_INDEX = OFF, STATISTICS_NORECOMPUTE = OFF, IGNORE_DUP_KEY = OFF, ALLOW_ROW_LOCKS = ON, ALLOW_PAGE_LOCKS = ON) ON [PRIMARY]
+					) ON [PRIMARY]
+				`,
+				`
+				IF OBJECT_ID(N'dbo.bucket', N'U') IS NULL
+				CREATE TABLE [dbo].[bucket] (
+					[id] [int] IDENTITY(1,1) NOT NULL,
+					[categoryID] [int] NOT NULL,
+					[name] nvarchar(100) NOT NULL,
+					[description] nvarchar(1000) NOT NULL DEFAULT N'',
+					[isLiquid] bit NOT NULL DEFAULT 1
+				   CONSTRAINT [PK_bucket] PRIMARY KEY CLUSTERED ([id] ASC)
+					  WITH (PAD_INDEX = OFF, STATISTICS_NORECOMPUTE = OFF, IGNORE_DUP_KEY = OFF, ALLOW_ROW_LOCKS = ON, ALLOW_PAGE_LOCKS = ON) ON [PRIMARY]
+				   CONSTRAINT FK_bucket_category FOREIGN KEY (categoryID) REFERENCES dbo.category ([id])
+				  ) ON [PRIMARY]
+				`,
+				`
+				IF OBJECT_ID(N'dbo.bucketitem', N'U') IS NULL
+				CREATE TABLE [dbo].[bucketitem] (
+					[id] [int] IDENTITY(1,1) NOT NULL,
+					[bucketID] [int] NOT NULL,
+					[transaction] datetime2(0) NOT NULL,
+					[name] nvarchar(100) NOT NULL,
+					[deposit] decimal(10,2) NOT NULL DEFAULT 0.00,
+					[withdrawl] decimal(10,2) NOT NULL DEFAULT 0.00
+				   CONSTRAINT [PK_bucketitem] PRIMARY KEY CLUSTERED ([id] ASC)
+					WITH (PAD_INDEX = OFF, STATISTICS_NORECOMPUTE = OFF, IGNORE_DUP_KEY = OFF, ALLOW_ROW_LOCKS = ON, ALLOW_PAGE_LOCKS = ON) ON [PRIMARY],
+				   CONSTRAINT FK_bucketitem_bucket FOREIGN KEY (bucketID) REFERENCES dbo.bucket ([id])
+				  ) ON [PRIMARY]
+				`,
+				`
+				IF OBJECT_ID(N'dbo.template', N'U') IS NULL
+				CREATE TABLE [dbo].[template] (
+					  [id] [int] IDENTITY(1,1) NOT NULL,
+					  [name] nvarchar(100) NOT NULL,
+					 CONSTRAINT [PK_template] PRIMARY KEY CLUSTERED 
+					(
+						[id] ASC
+					)WITH (PAD_INDEX = OFF, STATISTICS_NORECOMPUTE = OFF, IGNORE_DUP_KEY = OFF, ALLOW_ROW_LOCKS = ON, ALLOW_PAGE_LOCKS = ON) ON [PRIMARY]
+					) ON [PRIMARY]
+				`,
+				`
+				IF OBJECT_ID(N'dbo.templateitem', N'U') IS NULL
+				CREATE TABLE [dbo].[templateitem] (
+					[id] [int] IDENTITY(1,1) NOT NULL,
+					[templateID] int NOT NULL,
+					[bucketID] int NOT NULL,
+					[name] nvarchar(100) NOT NULL,
+					[deposit] decimal(10,2) NOT NULL DEFAULT 0.00,
+					[withdraw] decimal(10,2) NOT NULL DEFAULT 0.00
+				   CONSTRAINT [PK_templateitem] PRIMARY KEY CLUSTERED 
+				  (
+					  [id] ASC
+				  )WITH (PAD_INDEX = OFF, STATISTICS_NORECOMPUTE = OFF, IGNORE_DUP_KEY = OFF, ALLOW_ROW_LOCKS = ON, ALLOW_PAGE_LOCKS = ON) ON [PRIMARY]
+				  ) ON [PRIMARY]
+				`,
+			},
+			down: []string{
+				"DROP TABLE [dbo].[templateitem];",
+				"DROP TABLE [dbo].[template];",
+				"DROP TABLE [dbo].[bucketitem];",
+				"DROP TABLE [dbo].[bucket];",
+				"DROP TABLE [dbo].[category];",
+			},
+		},
+		{
+			version: 2,
+			name:    "rename bucketitem withdrawl",
+			up: []string{
+				"EXEC sp_rename 'dbo.bucketitem.withdrawl', 'withdraw', 'COLUMN';",
+			},
+			down: []string{
+				"EXEC sp_rename 'dbo.bucketitem.withdraw', 'withdrawl', 'COLUMN';",
+			},
+		},
+		{
+			version: 3,
+			name:    "currencies and exchange rates",
+			up: []string{
+				"ALTER TABLE [dbo].[bucket] ADD [currency] char(3) NOT NULL CONSTRAINT [DF_bucket_currency] DEFAULT 'USD';",
+				`
+				CREATE TABLE [dbo].[exchangerate] (
+					[id] [int] IDENTITY(1,1) NOT NULL,
+					[fromCurrency] char(3) NOT NULL,
+					[toCurrency] char(3) NOT NULL,
+					[rate] decimal(18,8) NOT NULL,
+					[effective] date NOT NULL,
+					CONSTRAINT [PK_exchangerate] PRIMARY KEY CLUSTERED ([id] ASC),
+					CONSTRAINT [UQ_exchangerate] UNIQUE ([fromCurrency], [toCurrency], [effective])
+				) ON [PRIMARY]
+				`,
+			},
+			down: []string{
+				"DROP TABLE [dbo].[exchangerate];",
+				"ALTER TABLE [dbo].[bucket] DROP CONSTRAINT [DF_bucket_currency];",
+				"ALTER TABLE [dbo].[bucket] DROP COLUMN [currency];",
+			},
+		},
+		{
+			version: 4,
+			name:    "transfers",
+			up: []string{
+				`
+				CREATE TABLE [dbo].[transfer] (
+					[id] [int] IDENTITY(1,1) NOT NULL,
+					[fromBucketID] [int] NOT NULL,
+					[toBucketID] [int] NOT NULL,
+					[name] nvarchar(100) NOT NULL,
+					[transaction] datetime2(0) NOT NULL,
+					[amount] decimal(10,2) NOT NULL,
+					[toAmount] decimal(10,2) NOT NULL,
+					CONSTRAINT [PK_transfer] PRIMARY KEY CLUSTERED ([id] ASC),
+					CONSTRAINT [FK_transfer_from_bucket] FOREIGN KEY ([fromBucketID]) REFERENCES [dbo].[bucket] ([id]),
+					CONSTRAINT [FK_transfer_to_bucket] FOREIGN KEY ([toBucketID]) REFERENCES [dbo].[bucket] ([id])
+				) ON [PRIMARY]
+				`,
+				"ALTER TABLE [dbo].[bucketitem] ADD [transferID] [int] NULL CONSTRAINT [FK_bucketitem_transfer] FOREIGN KEY REFERENCES [dbo].[transfer] ([id]);",
+			},
+			down: []string{
+				"ALTER TABLE [dbo].[bucketitem] DROP CONSTRAINT [FK_bucketitem_transfer];",
+				"ALTER TABLE [dbo].[bucketitem] DROP COLUMN [transferID];",
+				"DROP TABLE [dbo].[transfer];",
+			},
+		},
+		{
+			version: 5,
+			name:    "template schedules",
+			up: []string{
+				`
+				CREATE TABLE [dbo].[schedule] (
+					[id] [int] IDENTITY(1,1) NOT NULL,
+					[templateID] [int] NOT NULL,
+					[rule] varchar(20) NOT NULL,
+					[day] [int] NOT NULL DEFAULT 0,
+					[start] date NOT NULL,
+					CONSTRAINT [PK_schedule] PRIMARY KEY CLUSTERED ([id] ASC),
+					CONSTRAINT [FK_schedule_template] FOREIGN KEY ([templateID]) REFERENCES [dbo].[template] ([id])
+				) ON [PRIMARY]
+				`,
+				`
+				CREATE TABLE [dbo].[scheduleoccurrence] (
+					[id] [int] IDENTITY(1,1) NOT NULL,
+					[scheduleID] [int] NOT NULL,
+					[occurrence] date NOT NULL,
+					[posted] datetime2(0) NOT NULL,
+					[skipped] [bit] NOT NULL DEFAULT 0,
+					CONSTRAINT [PK_scheduleoccurrence] PRIMARY KEY CLUSTERED ([id] ASC),
+					CONSTRAINT [FK_scheduleoccurrence_schedule] FOREIGN KEY ([scheduleID]) REFERENCES [dbo].[schedule] ([id]),
+					CONSTRAINT [UQ_scheduleoccurrence] UNIQUE ([scheduleID], [occurrence])
+				) ON [PRIMARY]
+				`,
+			},
+			down: []string{
+				"DROP TABLE [dbo].[scheduleoccurrence];",
+				"DROP TABLE [dbo].[schedule];",
+			},
+		},
+		{
+			version: 6,
+			name:    "template item positions",
+			up: []string{
+				"ALTER TABLE [dbo].[templateitem] ADD [position] [int] NOT NULL CONSTRAINT [DF_templateitem_position] DEFAULT 0;",
+				"UPDATE [dbo].[templateitem] SET [position] = [id];",
+			},
+			down: []string{
+				"ALTER TABLE [dbo].[templateitem] DROP CONSTRAINT [DF_templateitem_position];",
+				"ALTER TABLE [dbo].[templateitem] DROP COLUMN [position];",
+			},
+		},
+		{
+			version: 7,
+			name:    "template item foreign keys",
+			up: []string{
+				"DELETE FROM [dbo].[templateitem] WHERE [templateID] NOT IN (SELECT [id] FROM [dbo].[template]) OR [bucketID] NOT IN (SELECT [id] FROM [dbo].[bucket]);",
+				"ALTER TABLE [dbo].[templateitem] ADD CONSTRAINT [FK_templateitem_template] FOREIGN KEY ([templateID]) REFERENCES [dbo].[template] ([id]);",
+				"ALTER TABLE [dbo].[templateitem] ADD CONSTRAINT [FK_templateitem_bucket] FOREIGN KEY ([bucketID]) REFERENCES [dbo].[bucket] ([id]);",
+			},
+			down: []string{
+				"ALTER TABLE [dbo].[templateitem] DROP CONSTRAINT [FK_templateitem_bucket];",
+				"ALTER TABLE [dbo].[templateitem] DROP CONSTRAINT [FK_templateitem_template];",
+			},
+		},
+		{
+			version: 8,
+			name:    "archive buckets and categories",
+			up: []string{
+				"ALTER TABLE [dbo].[bucket] ADD [archived] [bit] NOT NULL CONSTRAINT [DF_bucket_archived] DEFAULT 0;",
+				"ALTER TABLE [dbo].[category] ADD [archived] [bit] NOT NULL CONSTRAINT [DF_category_archived] DEFAULT 0;",
+			},
+			down: []string{
+				"ALTER TABLE [dbo].[category] DROP CONSTRAINT [DF_category_archived];",
+				"ALTER TABLE [dbo].[category] DROP COLUMN [archived];",
+				"ALTER TABLE [dbo].[bucket] DROP CONSTRAINT [DF_bucket_archived];",
+				"ALTER TABLE [dbo].[bucket] DROP COLUMN [archived];",
+			},
+		},
+		{
+			version: 9,
+			name:    "bucket item and transfer trash",
+			up: []string{
+				"ALTER TABLE [dbo].[bucketitem] ADD [deletedAt] datetime2(0) NULL;",
+				"ALTER TABLE [dbo].[transfer] ADD [deletedAt] datetime2(0) NULL;",
+			},
+			down: []string{
+				"DELETE FROM [dbo].[bucketitem] WHERE [deletedAt] IS NOT NULL;",
+				"DELETE FROM [dbo].[transfer] WHERE [deletedAt] IS NOT NULL;",
+				"ALTER TABLE [dbo].[transfer] DROP COLUMN [deletedAt];",
+				"ALTER TABLE [dbo].[bucketitem] DROP COLUMN [deletedAt];",
+			},
+		},
+		{
+			version: 10,
+			name:    "audit log",
+			up: []string{
+				`
+				CREATE TABLE [dbo].[auditentry] (
+					[id] [int] IDENTITY(1,1) NOT NULL,
+					[actor] nvarchar(100) NOT NULL,
+					[changedAt] datetime2(3) NOT NULL,
+					[resource] varchar(20) NOT NULL,
+					[resourceID] [int] NOT NULL,
+					[action] varchar(20) NOT NULL,
+					[beforeJSON] nvarchar(max) NULL,
+					[afterJSON] nvarchar(max) NULL,
+					CONSTRAINT [PK_auditentry] PRIMARY KEY CLUSTERED ([id] ASC)
+				) ON [PRIMARY]
+				`,
+				"CREATE INDEX [IX_auditentry_resource] ON [dbo].[auditentry] ([resource], [resourceID]);",
+			},
+			down: []string{
+				"DROP TABLE [dbo].[auditentry];",
+			},
+		},
+		{
+			version: 11,
+			name:    "row versions",
+			up: []string{
+				"ALTER TABLE [dbo].[bucket] ADD [version] [int] NOT NULL CONSTRAINT [DF_bucket_version] DEFAULT 1;",
+				"ALTER TABLE [dbo].[bucketitem] ADD [version] [int] NOT NULL CONSTRAINT [DF_bucketitem_version] DEFAULT 1;",
+				"ALTER TABLE [dbo].[category] ADD [version] [int] NOT NULL CONSTRAINT [DF_category_version] DEFAULT 1;",
+				"ALTER TABLE [dbo].[template] ADD [version] [int] NOT NULL CONSTRAINT [DF_template_version] DEFAULT 1;",
+				"ALTER TABLE [dbo].[templateitem] ADD [version] [int] NOT NULL CONSTRAINT [DF_templateitem_version] DEFAULT 1;",
+				"ALTER TABLE [dbo].[exchangerate] ADD [version] [int] NOT NULL CONSTRAINT [DF_exchangerate_version] DEFAULT 1;",
+				"ALTER TABLE [dbo].[transfer] ADD [version] [int] NOT NULL CONSTRAINT [DF_transfer_version] DEFAULT 1;",
+				"ALTER TABLE [dbo].[schedule] ADD [version] [int] NOT NULL CONSTRAINT [DF_schedule_version] DEFAULT 1;",
+			},
+			down: []string{
+				"ALTER TABLE [dbo].[schedule] DROP CONSTRAINT [DF_schedule_version];",
+				"ALTER TABLE [dbo].[schedule] DROP COLUMN [version];",
+				"ALTER TABLE [dbo].[transfer] DROP CONSTRAINT [DF_transfer_version];",
+				"ALTER TABLE [dbo].[transfer] DROP COLUMN [version];",
+				"ALTER TABLE [dbo].[exchangerate] DROP CONSTRAINT [DF_exchangerate_version];",
+				"ALTER TABLE [dbo].[exchangerate] DROP COLUMN [version];",
+				"ALTER TABLE [dbo].[templateitem] DROP CONSTRAINT [DF_templateitem_version];",
+				"ALTER TABLE [dbo].[templateitem] DROP COLUMN [version];",
+				"ALTER TABLE [dbo].[template] DROP CONSTRAINT [DF_template_version];",
+				"ALTER TABLE [dbo].[template] DROP COLUMN [version];",
+				"ALTER TABLE [dbo].[category] DROP CONSTRAINT [DF_category_version];",
+				"ALTER TABLE [dbo].[category] DROP COLUMN [version];",
+				"ALTER TABLE [dbo].[bucketitem] DROP CONSTRAINT [DF_bucketitem_version];",
+				"ALTER TABLE [dbo].[bucketitem] DROP COLUMN [version];",
+				"ALTER TABLE [dbo].[bucket] DROP CONSTRAINT [DF_bucket_version];",
+				"ALTER TABLE [dbo].[bucket] DROP COLUMN [version];",
+			},
+		},
+		{
+			version: 12,
+			name:    "page indexes",
+			up: []string{
+				"CREATE INDEX [IX_bucketitem_transaction] ON [dbo].[bucketitem] ([transaction], [id]);",
+				"CREATE INDEX [IX_auditentry_changedAt] ON [dbo].[auditentry] ([changedAt], [id]);",
+			},
+			down: []string{
+				"DROP INDEX [IX_auditentry_changedAt] ON [dbo].[auditentry];",
+				"DROP INDEX [IX_bucketitem_transaction] ON [dbo].[bucketitem];",
+			},
+		},
+		{
+			version: 13,
+			name:    "bucket item tags",
+			up: []string{
+				"ALTER TABLE [dbo].[bucketitem] ADD [tags] nvarchar(400) NULL;",
+			},
+			down: []string{
+				"ALTER TABLE [dbo].[bucketitem] DROP COLUMN [tags];",
+			},
+		},
+		{
+			version: 14,
+			name:    "bucket item balance index",
+			up: []string{
+				"CREATE INDEX [IX_bucketitem_bucketID_transaction] ON [dbo].[bucketitem] ([bucketID], [transaction], [id]);",
+			},
+			down: []string{
+				"DROP INDEX [IX_bucketitem_bucketID_transaction] ON [dbo].[bucketitem];",
+			},
+		},
+	},
+	summarizeBuckets: `
+SELECT bucket.id AS bucketID, category.id as categoryID, category.name AS categoryName, bucket.name AS bucketName, bucket.isLiquid, bucket.currency, bucket.archived, category.archived AS categoryArchived, SUM(bucketitem.deposit) - SUM(bucketitem.withdraw) AS total
+FROM bucket LEFT JOIN bucketItem ON bucketItem.bucketID = bucket.id AND bucketItem.deletedAt IS NULL
+INNER JOIN category ON bucket.categoryID = category.id
+GROUP BY bucket.id, category.id, category.name, bucket.name, bucket.isLiquid, bucket.currency, bucket.archived, category.archived
+ORDER BY category.name, bucket.name;
+	`,
+	dayColumn:     `CONVERT(char(10), [transaction], 23)`,
+	likeOperator:  "LIKE",
+	likeWildcards: "%_[", // [ opens a character class
+	bucketItemBalance: `(
+SELECT SUM(b.deposit - b.withdraw) FROM bucketitem b
+WHERE b.bucketID = bucketitem.bucketID AND b.deletedAt IS NULL
+AND (b.[transaction] < bucketitem.[transaction] OR (b.[transaction] = bucketitem.[transaction] AND b.id <= bucketitem.id))
+) AS balance`,
+}
+
+// newMssqlStore returns a Store backed by the SQL Server described by the
+// DB_HOST_NAME, DB_NAME, DB_USER and DB_PASSWORD environment settings.
+func newMssqlStore() (*sqlStore, error) {
+	settings := mssql.ConnectionURL{
+		Host:     readEnvOrDefault("DB_HOST_NAME", "127.0.0.1"), // MSSQL server IP or name.
+		Database: readEnvOrDefault("DB_NAME", "budget2"),        // Database name.
+		User:     readEnvOrDefault("DB_USER", "budgetUser"),
+		Password: readEnvOrDefault("DB_PASSWORD", "budgetPassword"),
+	}
+
+	return connectSQLStore(func() (sqlbuilder.Database, error) {
+		return mssql.Open(settings)
+	}, mssqlDialect)
+}
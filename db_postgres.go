@@ -0,0 +1,335 @@
+package main
+
+import (
+	"upper.io/db.v3/lib/sqlbuilder"
+	"upper.io/db.v3/postgresql"
+)
+
+// Postgres folds unquoted identifiers to lower case, so the mixed case
+// column names used by the db struct tags are always quoted.
+var postgresDialect = sqlDialect{
+	schemaVersionTable: `
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER NOT NULL,
+			name VARCHAR(100) NOT NULL,
+			applied TIMESTAMP(0) NOT NULL,
+			CONSTRAINT PK_schema_version PRIMARY KEY (version)
+		)
+		`,
+	migrations: []migration{
+		{
+			version: 1,
+			name:    "initial schema",
+			up: []string{
+				`
+				CREATE TABLE category (
+					id SERIAL NOT NULL,
+					name VARCHAR(100) NOT NULL,
+					CONSTRAINT PK_category PRIMARY KEY (id)
+				)
+				`,
+				`
+				CREATE TABLE bucket (
+					id SERIAL NOT NULL,
+					"categoryID" INTEGER NOT NULL,
+					name VARCHAR(100) NOT NULL,
+					description VARCHAR(1000) NOT NULL DEFAULT '',
+					"isLiquid" BOOLEAN NOT NULL DEFAULT TRUE,
+					CONSTRAINT PK_bucket PRIMARY KEY (id),
+					CONSTRAINT FK_bucket_category FOREIGN KEY ("categoryID") REFERENCES category (id)
+				)
+				`,
+				`
+				CREATE TABLE bucketitem (
+					id SERIAL NOT NULL,
+					"bucketID" INTEGER NOT NULL,
+					"transaction" TIMESTAMP(0) NOT NULL,
+					name VARCHAR(100) NOT NULL,
+					deposit DECIMAL(10,2) NOT NULL DEFAULT 0.00,
+					withdrawl DECIMAL(10,2) NOT NULL DEFAULT 0.00,
+					CONSTRAINT PK_bucketitem PRIMARY KEY (id),
+					CONSTRAINT FK_bucketitem_bucket FOREIGN KEY ("bucketID") REFERENCES bucket (id)
+				)
+				`,
+				`
+				CREATE TABLE template (
+					id SERIAL NOT NULL,
+					name VARCHAR(100) NOT NULL,
+					CONSTRAINT PK_template PRIMARY KEY (id)
+				)
+				`,
+				`
+				CREATE TABLE templateitem (
+					id SERIAL NOT NULL,
+					"templateID" INTEGER NOT NULL,
+					"bucketID" INTEGER NOT NULL,
+					name VARCHAR(100) NOT NULL,
+					deposit DECIMAL(10,2) NOT NULL DEFAULT 0.00,
+					withdraw DECIMAL(10,2) NOT NULL DEFAULT 0.00,
+					CONSTRAINT PK_templateitem PRIMARY KEY (id)
+				)
+				`,
+			},
+			down: []string{
+				"DROP TABLE templateitem;",
+				"DROP TABLE template;",
+				"DROP TABLE bucketitem;",
+				"DROP TABLE bucket;",
+				"DROP TABLE category;",
+			},
+		},
+		{
+			version: 2,
+			name:    "rename bucketitem withdrawl",
+			up: []string{
+				"ALTER TABLE bucketitem RENAME COLUMN withdrawl TO withdraw;",
+			},
+			down: []string{
+				"ALTER TABLE bucketitem RENAME COLUMN withdraw TO withdrawl;",
+			},
+		},
+		{
+			version: 3,
+			name:    "currencies and exchange rates",
+			up: []string{
+				"ALTER TABLE bucket ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD';",
+				`
+				CREATE TABLE exchangerate (
+					id SERIAL NOT NULL,
+					"fromCurrency" CHAR(3) NOT NULL,
+					"toCurrency" CHAR(3) NOT NULL,
+					rate DECIMAL(18,8) NOT NULL,
+					effective DATE NOT NULL,
+					CONSTRAINT PK_exchangerate PRIMARY KEY (id),
+					CONSTRAINT UQ_exchangerate UNIQUE ("fromCurrency", "toCurrency", effective)
+				)
+				`,
+			},
+			down: []string{
+				"DROP TABLE exchangerate;",
+				"ALTER TABLE bucket DROP COLUMN currency;",
+			},
+		},
+		{
+			version: 4,
+			name:    "transfers",
+			up: []string{
+				`
+				CREATE TABLE transfer (
+					id SERIAL NOT NULL,
+					"fromBucketID" INTEGER NOT NULL,
+					"toBucketID" INTEGER NOT NULL,
+					name VARCHAR(100) NOT NULL,
+					"transaction" TIMESTAMP(0) NOT NULL,
+					amount DECIMAL(10,2) NOT NULL,
+					"toAmount" DECIMAL(10,2) NOT NULL,
+					CONSTRAINT PK_transfer PRIMARY KEY (id),
+					CONSTRAINT FK_transfer_from_bucket FOREIGN KEY ("fromBucketID") REFERENCES bucket (id),
+					CONSTRAINT FK_transfer_to_bucket FOREIGN KEY ("toBucketID") REFERENCES bucket (id)
+				)
+				`,
+				"ALTER TABLE bucketitem ADD COLUMN \"transferID\" INTEGER NULL CONSTRAINT FK_bucketitem_transfer REFERENCES transfer (id);",
+			},
+			down: []string{
+				"ALTER TABLE bucketitem DROP COLUMN \"transferID\";",
+				"DROP TABLE transfer;",
+			},
+		},
+		{
+			version: 5,
+			name:    "template schedules",
+			up: []string{
+				`
+				CREATE TABLE schedule (
+					id SERIAL NOT NULL,
+					"templateID" INTEGER NOT NULL,
+					rule VARCHAR(20) NOT NULL,
+					day INTEGER NOT NULL DEFAULT 0,
+					start DATE NOT NULL,
+					CONSTRAINT PK_schedule PRIMARY KEY (id),
+					CONSTRAINT FK_schedule_template FOREIGN KEY ("templateID") REFERENCES template (id)
+				)
+				`,
+				`
+				CREATE TABLE scheduleoccurrence (
+					id SERIAL NOT NULL,
+					"scheduleID" INTEGER NOT NULL,
+					occurrence DATE NOT NULL,
+					posted TIMESTAMP(0) NOT NULL,
+					skipped BOOLEAN NOT NULL DEFAULT FALSE,
+					CONSTRAINT PK_scheduleoccurrence PRIMARY KEY (id),
+					CONSTRAINT FK_scheduleoccurrence_schedule FOREIGN KEY ("scheduleID") REFERENCES schedule (id),
+					CONSTRAINT UQ_scheduleoccurrence UNIQUE ("scheduleID", occurrence)
+				)
+				`,
+			},
+			down: []string{
+				"DROP TABLE scheduleoccurrence;",
+				"DROP TABLE schedule;",
+			},
+		},
+		{
+			version: 6,
+			name:    "template item positions",
+			up: []string{
+				"ALTER TABLE templateitem ADD COLUMN position INTEGER NOT NULL DEFAULT 0;",
+				"UPDATE templateitem SET position = id;",
+			},
+			down: []string{
+				"ALTER TABLE templateitem DROP COLUMN position;",
+			},
+		},
+		{
+			version: 7,
+			name:    "template item foreign keys",
+			up: []string{
+				"DELETE FROM templateitem WHERE \"templateID\" NOT IN (SELECT id FROM template) OR \"bucketID\" NOT IN (SELECT id FROM bucket);",
+				"ALTER TABLE templateitem ADD CONSTRAINT FK_templateitem_template FOREIGN KEY (\"templateID\") REFERENCES template (id);",
+				"ALTER TABLE templateitem ADD CONSTRAINT FK_templateitem_bucket FOREIGN KEY (\"bucketID\") REFERENCES bucket (id);",
+			},
+			down: []string{
+				"ALTER TABLE templateitem DROP CONSTRAINT FK_templateitem_bucket;",
+				"ALTER TABLE templateitem DROP CONSTRAINT FK_templateitem_template;",
+			},
+		},
+		{
+			version: 8,
+			name:    "archive buckets and categories",
+			up: []string{
+				"ALTER TABLE bucket ADD COLUMN archived BOOLEAN NOT NULL DEFAULT FALSE;",
+				"ALTER TABLE category ADD COLUMN archived BOOLEAN NOT NULL DEFAULT FALSE;",
+			},
+			down: []string{
+				"ALTER TABLE category DROP COLUMN archived;",
+				"ALTER TABLE bucket DROP COLUMN archived;",
+			},
+		},
+		{
+			version: 9,
+			name:    "bucket item and transfer trash",
+			up: []string{
+				"ALTER TABLE bucketitem ADD COLUMN \"deletedAt\" TIMESTAMP(0) NULL;",
+				"ALTER TABLE transfer ADD COLUMN \"deletedAt\" TIMESTAMP(0) NULL;",
+			},
+			down: []string{
+				"DELETE FROM bucketitem WHERE \"deletedAt\" IS NOT NULL;",
+				"DELETE FROM transfer WHERE \"deletedAt\" IS NOT NULL;",
+				"ALTER TABLE transfer DROP COLUMN \"deletedAt\";",
+				"ALTER TABLE bucketitem DROP COLUMN \"deletedAt\";",
+			},
+		},
+		{
+			version: 10,
+			name:    "audit log",
+			up: []string{
+				`
+				CREATE TABLE auditentry (
+					id SERIAL NOT NULL,
+					actor VARCHAR(100) NOT NULL,
+					"changedAt" TIMESTAMP(3) NOT NULL,
+					resource VARCHAR(20) NOT NULL,
+					"resourceID" INTEGER NOT NULL,
+					action VARCHAR(20) NOT NULL,
+					"beforeJSON" TEXT NULL,
+					"afterJSON" TEXT NULL,
+					CONSTRAINT PK_auditentry PRIMARY KEY (id)
+				)
+				`,
+				"CREATE INDEX IX_auditentry_resource ON auditentry (resource, \"resourceID\");",
+			},
+			down: []string{
+				"DROP TABLE auditentry;",
+			},
+		},
+		{
+			version: 11,
+			name:    "row versions",
+			up: []string{
+				"ALTER TABLE bucket ADD COLUMN version INTEGER NOT NULL DEFAULT 1;",
+				"ALTER TABLE bucketitem ADD COLUMN version INTEGER NOT NULL DEFAULT 1;",
+				"ALTER TABLE category ADD COLUMN version INTEGER NOT NULL DEFAULT 1;",
+				"ALTER TABLE template ADD COLUMN version INTEGER NOT NULL DEFAULT 1;",
+				"ALTER TABLE templateitem ADD COLUMN version INTEGER NOT NULL DEFAULT 1;",
+				"ALTER TABLE exchangerate ADD COLUMN version INTEGER NOT NULL DEFAULT 1;",
+				"ALTER TABLE transfer ADD COLUMN version INTEGER NOT NULL DEFAULT 1;",
+				"ALTER TABLE schedule ADD COLUMN version INTEGER NOT NULL DEFAULT 1;",
+			},
+			down: []string{
+				"ALTER TABLE schedule DROP COLUMN version;",
+				"ALTER TABLE transfer DROP COLUMN version;",
+				"ALTER TABLE exchangerate DROP COLUMN version;",
+				"ALTER TABLE templateitem DROP COLUMN version;",
+				"ALTER TABLE template DROP COLUMN version;",
+				"ALTER TABLE category DROP COLUMN version;",
+				"ALTER TABLE bucketitem DROP COLUMN version;",
+				"ALTER TABLE bucket DROP COLUMN version;",
+			},
+		},
+		{
+			version: 12,
+			name:    "page indexes",
+			up: []string{
+				"CREATE INDEX IX_bucketitem_transaction ON bucketitem (\"transaction\", id);",
+				"CREATE INDEX IX_auditentry_changedAt ON auditentry (\"changedAt\", id);",
+			},
+			down: []string{
+				"DROP INDEX IX_auditentry_changedAt;",
+				"DROP INDEX IX_bucketitem_transaction;",
+			},
+		},
+		{
+			version: 13,
+			name:    "bucket item tags",
+			up: []string{
+				"ALTER TABLE bucketitem ADD COLUMN tags VARCHAR(400) NULL;",
+			},
+			down: []string{
+				"ALTER TABLE bucketitem DROP COLUMN tags;",
+			},
+		},
+		{
+			version: 14,
+			name:    "bucket item balance index",
+			up: []string{
+				"CREATE INDEX IX_bucketitem_bucketID_transaction ON bucketitem (\"bucketID\", \"transaction\", id);",
+			},
+			down: []string{
+				"DROP INDEX IX_bucketitem_bucketID_transaction;",
+			},
+		},
+	},
+	summarizeBuckets: `
+SELECT bucket.id AS "bucketID", category.id AS "categoryID", category.name AS "categoryName", bucket.name AS "bucketName", bucket."isLiquid", bucket.currency, bucket.archived, category.archived AS "categoryArchived", COALESCE(SUM(bucketitem.deposit) - SUM(bucketitem.withdraw), 0) AS total
+FROM bucket LEFT JOIN bucketitem ON bucketitem."bucketID" = bucket.id AND bucketitem."deletedAt" IS NULL
+INNER JOIN category ON bucket."categoryID" = category.id
+GROUP BY bucket.id, category.id, category.name, bucket.name, bucket."isLiquid", bucket.currency, bucket.archived, category.archived
+ORDER BY category.name, bucket.name;
+	`,
+	dayColumn:     `to_char("transaction", 'YYYY-MM-DD')`,
+	likeOperator:  "ILIKE",
+	likeWildcards: "%_",
+	bucketItemBalance: `(
+SELECT SUM(b.deposit - b.withdraw) FROM bucketitem b
+WHERE b."bucketID" = bucketitem."bucketID" AND b."deletedAt" IS NULL
+AND (b."transaction" < bucketitem."transaction" OR (b."transaction" = bucketitem."transaction" AND b.id <= bucketitem.id))
+) AS balance`,
+}
+
+// newPostgresStore returns a Store backed by the PostgreSQL server described
+// by the DB_HOST_NAME, DB_NAME, DB_USER, DB_PASSWORD and DB_SSLMODE
+// environment settings.
+func newPostgresStore() (*sqlStore, error) {
+	settings := postgresql.ConnectionURL{
+		Host:     readEnvOrDefault("DB_HOST_NAME", "127.0.0.1"),
+		Database: readEnvOrDefault("DB_NAME", "budget2"),
+		User:     readEnvOrDefault("DB_USER", "budgetUser"),
+		Password: readEnvOrDefault("DB_PASSWORD", "budgetPassword"),
+		Options: map[string]string{
+			"sslmode": readEnvOrDefault("DB_SSLMODE", "disable"),
+		},
+	}
+
+	return connectSQLStore(func() (sqlbuilder.Database, error) {
+		return postgresql.Open(settings)
+	}, postgresDialect)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+
+	db "upper.io/db.v3"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+// countDependents counts the rows each result finds, leaving out the kinds
+// with none.
+func countDependents(results map[string]db.Result) (Dependents, error) {
+	dependents := Dependents{}
+	for kind, res := range results {
+		count, err := res.Count()
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			dependents[kind] = int(count)
+		}
+	}
+	return dependents, nil
+}
+
+// bucketTransfers finds the transfers into or out of the bucket.
+func bucketTransfers(tx sqlbuilder.Tx, id int) db.Result {
+	return tx.Collection("transfer").Find(db.Or(db.Cond{"fromBucketID": id}, db.Cond{"toBucketID": id}))
+}
+
+// removeBucket counts trashed bucket items and transfers as dependents of
+// their own kinds, so a plain removal doesn't purge them before
+// TRASH_RETENTION is up. Cascading removes them with the rest, reassigning
+// moves them along.
+func removeBucket(tx sqlbuilder.Tx, id int, opts RemoveOptions) ([]Change, error) {
+	dependents, err := countDependents(map[string]db.Result{
+		"bucketItems":        tx.Collection("bucketitem").Find(db.Cond{"bucketID": id, "deletedAt": nil}),
+		"templateItems":      tx.Collection("templateitem").Find(db.Cond{"bucketID": id}),
+		"transfers":          bucketTransfers(tx, id).And(db.Cond{"deletedAt": nil}),
+		"trashedBucketItems": tx.Collection("bucketitem").Find(db.Cond{"bucketID": id, "deletedAt IS NOT": nil}),
+		"trashedTransfers":   bucketTransfers(tx, id).And(db.Cond{"deletedAt IS NOT": nil}),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	switch {
+	case opts.ReassignTo != 0:
+		if changes, err = reassignBucket(tx, id, opts.ReassignTo); err != nil {
+			return nil, err
+		}
+	case opts.Cascade || len(dependents) == 0:
+		if changes, err = cascadeBucket(tx, id); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, &DependentsError{Resource: "bucket", ID: id, Dependents: dependents}
+	}
+
+	return changes, tx.Collection("bucket").Find(db.Cond{"id": id}).Delete()
+}
+
+// reassignBucket moves everything recorded against bucket id to bucket to,
+// which must hold the same currency and, like any bucket taking new bucket
+// items, be archived neither itself nor by its category.
+func reassignBucket(tx sqlbuilder.Tx, id int, to int) ([]Change, error) {
+	if to == id {
+		return nil, &dbError{"cannot reassign a bucket to itself"}
+	}
+	var from, target Bucket
+	if err := tx.Collection("bucket").Find(db.Cond{"id": id}).One(&from); err != nil {
+		return nil, err
+	}
+	if err := tx.Collection("bucket").Find(db.Cond{"id": to}).One(&target); err != nil {
+		return nil, &dbError{fmt.Sprintf("bucket %d does not exist", to)}
+	}
+	categoryArchived, err := tx.Collection("category").Find(db.Cond{"id": target.CategoryID, "archived": true}).Exists()
+	if err != nil {
+		return nil, err
+	}
+	if target.Archived || categoryArchived {
+		return nil, &dbError{fmt.Sprintf("bucket %d is archived", to)}
+	}
+	if from.Currency != target.Currency {
+		return nil, &dbError{fmt.Sprintf("bucket %d holds %s, not %s", to, target.Currency, from.Currency)}
+	}
+	between, err := tx.Collection("transfer").Find(db.Or(
+		db.Cond{"fromBucketID": id, "toBucketID": to},
+		db.Cond{"fromBucketID": to, "toBucketID": id},
+	)).Count()
+	if err != nil {
+		return nil, err
+	}
+	if between > 0 {
+		return nil, &dbError{fmt.Sprintf("bucket %d has transfers with bucket %d, which can't move into one bucket", id, to)}
+	}
+
+	var changes []Change
+	var bucketItems []BucketItem
+	if err := tx.Collection("bucketitem").Find(db.Cond{"bucketID": id}).OrderBy("id").All(&bucketItems); err != nil {
+		return nil, err
+	}
+	for _, bucketItem := range bucketItems {
+		moved := bucketItem
+		moved.BucketID = to
+		moved.Version++
+		changes = append(changes, Change{Resource: auditBucketItem, ID: bucketItem.ID, Before: bucketItem, After: moved})
+	}
+	var templateItems []TemplateItem
+	if err := tx.Collection("templateitem").Find(db.Cond{"bucketID": id}).OrderBy("id").All(&templateItems); err != nil {
+		return nil, err
+	}
+	for _, templateItem := range templateItems {
+		moved := templateItem
+		moved.BucketID = to
+		moved.Version++
+		changes = append(changes, Change{Resource: auditTemplateItem, ID: templateItem.ID, Before: templateItem, After: moved})
+	}
+
+	moves := []struct {
+		table, column string
+	}{
+		{"bucketitem", "bucketID"},
+		{"templateitem", "bucketID"},
+		{"transfer", "fromBucketID"},
+		{"transfer", "toBucketID"},
+	}
+	for _, move := range moves {
+		res := tx.Collection(move.table).Find(db.Cond{move.column: id})
+		if err := res.Update(map[string]interface{}{move.column: to, "version": db.Raw("version + 1")}); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// cascadeBucket removes everything recorded against the bucket. Transfers
+// go as a whole, the leg in the other bucket included.
+func cascadeBucket(tx sqlbuilder.Tx, id int) ([]Change, error) {
+	var transfers []Transfer
+	if err := bucketTransfers(tx, id).All(&transfers); err != nil {
+		return nil, err
+	}
+	var transferIDs []int
+	for _, transfer := range transfers {
+		transferIDs = append(transferIDs, transfer.ID)
+	}
+
+	bucketItems := tx.Collection("bucketitem").Find(db.Cond{"bucketID": id})
+	if len(transferIDs) > 0 {
+		bucketItems = tx.Collection("bucketitem").Find(db.Or(db.Cond{"bucketID": id}, db.Cond{"transferID IN": transferIDs}))
+	}
+	var removed []BucketItem
+	if err := bucketItems.OrderBy("id").All(&removed); err != nil {
+		return nil, err
+	}
+	var changes []Change
+	for _, bucketItem := range removed {
+		changes = append(changes, Change{Resource: auditBucketItem, ID: bucketItem.ID, Before: bucketItem})
+	}
+	templateItems := tx.Collection("templateitem").Find(db.Cond{"bucketID": id})
+	var removedTemplateItems []TemplateItem
+	if err := templateItems.OrderBy("id").All(&removedTemplateItems); err != nil {
+		return nil, err
+	}
+	for _, templateItem := range removedTemplateItems {
+		changes = append(changes, Change{Resource: auditTemplateItem, ID: templateItem.ID, Before: templateItem})
+	}
+
+	if err := bucketItems.Delete(); err != nil {
+		return nil, err
+	}
+	if len(transferIDs) > 0 {
+		if err := tx.Collection("transfer").Find(db.Cond{"id IN": transferIDs}).Delete(); err != nil {
+			return nil, err
+		}
+	}
+	return changes, templateItems.Delete()
+}
+
+func removeCategory(tx sqlbuilder.Tx, id int, opts RemoveOptions) ([]Change, error) {
+	buckets := tx.Collection("bucket").Find(db.Cond{"categoryID": id})
+	dependents, err := countDependents(map[string]db.Result{"buckets": buckets})
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	switch {
+	case len(dependents) == 0:
+	case opts.ReassignTo != 0:
+		if opts.ReassignTo == id {
+			return nil, &dbError{"cannot reassign a category to itself"}
+		}
+		if exists, err := tx.Collection("category").Find(db.Cond{"id": opts.ReassignTo}).Exists(); err != nil || !exists {
+			return nil, &dbError{fmt.Sprintf("category %d does not exist", opts.ReassignTo)}
+		}
+		var moved []Bucket
+		if err := buckets.OrderBy("id").All(&moved); err != nil {
+			return nil, err
+		}
+		for _, bucket := range moved {
+			after := bucket
+			after.CategoryID = opts.ReassignTo
+			after.Version++
+			changes = append(changes, Change{Resource: auditBucket, ID: bucket.Id, Before: bucket, After: after})
+		}
+		if err := buckets.Update(map[string]interface{}{"categoryID": opts.ReassignTo, "version": db.Raw("version + 1")}); err != nil {
+			return nil, err
+		}
+	case opts.Cascade:
+		var cascaded []Bucket
+		if err := buckets.OrderBy("id").All(&cascaded); err != nil {
+			return nil, err
+		}
+		for _, bucket := range cascaded {
+			removed, err := removeBucket(tx, bucket.Id, opts)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, removed...)
+			changes = append(changes, Change{Resource: auditBucket, ID: bucket.Id, Before: bucket})
+		}
+	default:
+		return nil, &DependentsError{Resource: "category", ID: id, Dependents: dependents}
+	}
+
+	return changes, tx.Collection("category").Find(db.Cond{"id": id}).Delete()
+}
+
+func removeTemplate(tx sqlbuilder.Tx, id int, opts RemoveOptions) ([]Change, error) {
+	templateItems := tx.Collection("templateitem").Find(db.Cond{"templateID": id})
+	schedules := tx.Collection("schedule").Find(db.Cond{"templateID": id})
+	dependents, err := countDependents(map[string]db.Result{
+		"templateItems": templateItems,
+		"schedules":     schedules,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	switch {
+	case len(dependents) == 0:
+	case opts.ReassignTo != 0:
+		if changes, err = reassignTemplate(tx, id, opts.ReassignTo); err != nil {
+			return nil, err
+		}
+	case opts.Cascade:
+		var cascaded []Schedule
+		if err := schedules.All(&cascaded); err != nil {
+			return nil, err
+		}
+		for _, schedule := range cascaded {
+			if err := tx.Collection("scheduleoccurrence").Find(db.Cond{"scheduleID": schedule.ID}).Delete(); err != nil {
+				return nil, err
+			}
+		}
+		if err := schedules.Delete(); err != nil {
+			return nil, err
+		}
+		var removed []TemplateItem
+		if err := templateItems.OrderBy("id").All(&removed); err != nil {
+			return nil, err
+		}
+		for _, templateItem := range removed {
+			changes = append(changes, Change{Resource: auditTemplateItem, ID: templateItem.ID, Before: templateItem})
+		}
+		if err := templateItems.Delete(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, &DependentsError{Resource: "template", ID: id, Dependents: dependents}
+	}
+
+	return changes, tx.Collection("template").Find(db.Cond{"id": id}).Delete()
+}
+
+// reassignTemplate moves the items of template id after the items of
+// template to, and its schedules along with them.
+func reassignTemplate(tx sqlbuilder.Tx, id int, to int) ([]Change, error) {
+	if to == id {
+		return nil, &dbError{"cannot reassign a template to itself"}
+	}
+	if exists, err := tx.Collection("template").Find(db.Cond{"id": to}).Exists(); err != nil || !exists {
+		return nil, &dbError{fmt.Sprintf("template %d does not exist", to)}
+	}
+
+	templateItemCollection := tx.Collection("templateitem")
+	position := 0
+	var last TemplateItem
+	switch err := templateItemCollection.Find(db.Cond{"templateID": to}).OrderBy("-position").Limit(1).One(&last); err {
+	case nil:
+		position = last.Position
+	case db.ErrNoMoreRows:
+	default:
+		return nil, err
+	}
+
+	var moved []TemplateItem
+	if err := templateItemCollection.Find(db.Cond{"templateID": id}).OrderBy("position", "id").All(&moved); err != nil {
+		return nil, err
+	}
+	var changes []Change
+	for _, templateItem := range moved {
+		position++
+		res := templateItemCollection.Find(db.Cond{"id": templateItem.ID})
+		if err := res.Update(map[string]interface{}{"templateID": to, "position": position, "version": db.Raw("version + 1")}); err != nil {
+			return nil, err
+		}
+		after := templateItem
+		after.TemplateID = to
+		after.Position = position
+		after.Version++
+		changes = append(changes, Change{Resource: auditTemplateItem, ID: templateItem.ID, Before: templateItem, After: after})
+	}
+
+	schedules := tx.Collection("schedule").Find(db.Cond{"templateID": id})
+	return changes, schedules.Update(map[string]interface{}{"templateID": to, "version": db.Raw("version + 1")})
+}
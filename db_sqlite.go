@@ -0,0 +1,360 @@
+package main
+
+import (
+	"upper.io/db.v3/lib/sqlbuilder"
+	"upper.io/db.v3/sqlite"
+)
+
+var sqliteDialect = sqlDialect{
+	schemaVersionTable: `
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER NOT NULL PRIMARY KEY,
+			name VARCHAR(100) NOT NULL,
+			applied DATETIME NOT NULL
+		)
+		`,
+	migrations: []migration{
+		{
+			version: 1,
+			name:    "initial schema",
+			up: []string{
+				`
+				CREATE TABLE category (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					name VARCHAR(100) NOT NULL
+				)
+				`,
+				`
+				CREATE TABLE bucket (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					categoryID INTEGER NOT NULL,
+					name VARCHAR(100) NOT NULL,
+					description VARCHAR(1000) NOT NULL DEFAULT '',
+					isLiquid BOOLEAN NOT NULL DEFAULT 1,
+					CONSTRAINT FK_bucket_category FOREIGN KEY (categoryID) REFERENCES category (id)
+				)
+				`,
+				`
+				CREATE TABLE bucketitem (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					bucketID INTEGER NOT NULL,
+					"transaction" DATETIME NOT NULL,
+					name VARCHAR(100) NOT NULL,
+					deposit DECIMAL(10,2) NOT NULL DEFAULT 0.00,
+					withdrawl DECIMAL(10,2) NOT NULL DEFAULT 0.00,
+					CONSTRAINT FK_bucketitem_bucket FOREIGN KEY (bucketID) REFERENCES bucket (id)
+				)
+				`,
+				`
+				CREATE TABLE template (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					name VARCHAR(100) NOT NULL
+				)
+				`,
+				`
+				CREATE TABLE templateitem (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					templateID INTEGER NOT NULL,
+					bucketID INTEGER NOT NULL,
+					name VARCHAR(100) NOT NULL,
+					deposit DECIMAL(10,2) NOT NULL DEFAULT 0.00,
+					withdraw DECIMAL(10,2) NOT NULL DEFAULT 0.00
+				)
+				`,
+			},
+			down: []string{
+				"DROP TABLE templateitem;",
+				"DROP TABLE template;",
+				"DROP TABLE bucketitem;",
+				"DROP TABLE bucket;",
+				"DROP TABLE category;",
+			},
+		},
+		{
+			version: 2,
+			name:    "rename bucketitem withdrawl",
+			up: []string{
+				"ALTER TABLE bucketitem RENAME COLUMN withdrawl TO withdraw;",
+			},
+			down: []string{
+				"ALTER TABLE bucketitem RENAME COLUMN withdraw TO withdrawl;",
+			},
+		},
+		{
+			version: 3,
+			name:    "currencies and exchange rates",
+			up: []string{
+				"ALTER TABLE bucket ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD';",
+				`
+				CREATE TABLE exchangerate (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					fromCurrency CHAR(3) NOT NULL,
+					toCurrency CHAR(3) NOT NULL,
+					rate DECIMAL(18,8) NOT NULL,
+					effective DATE NOT NULL,
+					CONSTRAINT UQ_exchangerate UNIQUE (fromCurrency, toCurrency, effective)
+				)
+				`,
+			},
+			down: []string{
+				"DROP TABLE exchangerate;",
+				"ALTER TABLE bucket DROP COLUMN currency;",
+			},
+		},
+		{
+			version: 4,
+			name:    "transfers",
+			up: []string{
+				`
+				CREATE TABLE transfer (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					fromBucketID INTEGER NOT NULL,
+					toBucketID INTEGER NOT NULL,
+					name VARCHAR(100) NOT NULL,
+					"transaction" DATETIME NOT NULL,
+					amount DECIMAL(10,2) NOT NULL,
+					toAmount DECIMAL(10,2) NOT NULL,
+					CONSTRAINT FK_transfer_from_bucket FOREIGN KEY (fromBucketID) REFERENCES bucket (id),
+					CONSTRAINT FK_transfer_to_bucket FOREIGN KEY (toBucketID) REFERENCES bucket (id)
+				)
+				`,
+				// No REFERENCES here: SQLite refuses to drop a column that is part
+				// of a foreign key, which would leave the migration irreversible.
+				"ALTER TABLE bucketitem ADD COLUMN transferID INTEGER NULL;",
+			},
+			down: []string{
+				"ALTER TABLE bucketitem DROP COLUMN transferID;",
+				"DROP TABLE transfer;",
+			},
+		},
+		{
+			version: 5,
+			name:    "template schedules",
+			up: []string{
+				`
+				CREATE TABLE schedule (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					templateID INTEGER NOT NULL,
+					rule VARCHAR(20) NOT NULL,
+					day INTEGER NOT NULL DEFAULT 0,
+					start DATE NOT NULL,
+					CONSTRAINT FK_schedule_template FOREIGN KEY (templateID) REFERENCES template (id)
+				)
+				`,
+				`
+				CREATE TABLE scheduleoccurrence (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					scheduleID INTEGER NOT NULL,
+					occurrence DATE NOT NULL,
+					posted DATETIME NOT NULL,
+					skipped BOOLEAN NOT NULL DEFAULT 0,
+					CONSTRAINT FK_scheduleoccurrence_schedule FOREIGN KEY (scheduleID) REFERENCES schedule (id),
+					CONSTRAINT UQ_scheduleoccurrence UNIQUE (scheduleID, occurrence)
+				)
+				`,
+			},
+			down: []string{
+				"DROP TABLE scheduleoccurrence;",
+				"DROP TABLE schedule;",
+			},
+		},
+		{
+			version: 6,
+			name:    "template item positions",
+			up: []string{
+				"ALTER TABLE templateitem ADD COLUMN position INTEGER NOT NULL DEFAULT 0;",
+				"UPDATE templateitem SET position = id;",
+			},
+			down: []string{
+				"ALTER TABLE templateitem DROP COLUMN position;",
+			},
+		},
+		{
+			version: 7,
+			name:    "template item foreign keys",
+			up: []string{
+				// SQLite can't add a constraint to an existing table, so the
+				// table is rebuilt with them, leaving out orphaned rows.
+				`
+				CREATE TABLE templateitem_new (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					templateID INTEGER NOT NULL,
+					bucketID INTEGER NOT NULL,
+					name VARCHAR(100) NOT NULL,
+					deposit DECIMAL(10,2) NOT NULL DEFAULT 0.00,
+					withdraw DECIMAL(10,2) NOT NULL DEFAULT 0.00,
+					position INTEGER NOT NULL DEFAULT 0,
+					CONSTRAINT FK_templateitem_template FOREIGN KEY (templateID) REFERENCES template (id),
+					CONSTRAINT FK_templateitem_bucket FOREIGN KEY (bucketID) REFERENCES bucket (id)
+				)
+				`,
+				`
+				INSERT INTO templateitem_new (id, templateID, bucketID, name, deposit, withdraw, position)
+				SELECT id, templateID, bucketID, name, deposit, withdraw, position FROM templateitem
+				WHERE templateID IN (SELECT id FROM template) AND bucketID IN (SELECT id FROM bucket)
+				`,
+				"DROP TABLE templateitem;",
+				"ALTER TABLE templateitem_new RENAME TO templateitem;",
+			},
+			down: []string{
+				`
+				CREATE TABLE templateitem_old (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					templateID INTEGER NOT NULL,
+					bucketID INTEGER NOT NULL,
+					name VARCHAR(100) NOT NULL,
+					deposit DECIMAL(10,2) NOT NULL DEFAULT 0.00,
+					withdraw DECIMAL(10,2) NOT NULL DEFAULT 0.00,
+					position INTEGER NOT NULL DEFAULT 0
+				)
+				`,
+				"INSERT INTO templateitem_old SELECT id, templateID, bucketID, name, deposit, withdraw, position FROM templateitem;",
+				"DROP TABLE templateitem;",
+				"ALTER TABLE templateitem_old RENAME TO templateitem;",
+			},
+		},
+		{
+			version: 8,
+			name:    "archive buckets and categories",
+			up: []string{
+				"ALTER TABLE bucket ADD COLUMN archived BOOLEAN NOT NULL DEFAULT 0;",
+				"ALTER TABLE category ADD COLUMN archived BOOLEAN NOT NULL DEFAULT 0;",
+			},
+			down: []string{
+				"ALTER TABLE category DROP COLUMN archived;",
+				"ALTER TABLE bucket DROP COLUMN archived;",
+			},
+		},
+		{
+			version: 9,
+			name:    "bucket item and transfer trash",
+			up: []string{
+				"ALTER TABLE bucketitem ADD COLUMN deletedAt DATETIME NULL;",
+				"ALTER TABLE transfer ADD COLUMN deletedAt DATETIME NULL;",
+			},
+			down: []string{
+				"DELETE FROM bucketitem WHERE deletedAt IS NOT NULL;",
+				"DELETE FROM transfer WHERE deletedAt IS NOT NULL;",
+				"ALTER TABLE transfer DROP COLUMN deletedAt;",
+				"ALTER TABLE bucketitem DROP COLUMN deletedAt;",
+			},
+		},
+		{
+			version: 10,
+			name:    "audit log",
+			up: []string{
+				`
+				CREATE TABLE auditentry (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					actor VARCHAR(100) NOT NULL,
+					changedAt DATETIME NOT NULL,
+					resource VARCHAR(20) NOT NULL,
+					resourceID INTEGER NOT NULL,
+					action VARCHAR(20) NOT NULL,
+					beforeJSON TEXT NULL,
+					afterJSON TEXT NULL
+				)
+				`,
+				"CREATE INDEX IX_auditentry_resource ON auditentry (resource, resourceID);",
+			},
+			down: []string{
+				"DROP TABLE auditentry;",
+			},
+		},
+		{
+			version: 11,
+			name:    "row versions",
+			up: []string{
+				"ALTER TABLE bucket ADD COLUMN version INTEGER NOT NULL DEFAULT 1;",
+				"ALTER TABLE bucketitem ADD COLUMN version INTEGER NOT NULL DEFAULT 1;",
+				"ALTER TABLE category ADD COLUMN version INTEGER NOT NULL DEFAULT 1;",
+				"ALTER TABLE template ADD COLUMN version INTEGER NOT NULL DEFAULT 1;",
+				"ALTER TABLE templateitem ADD COLUMN version INTEGER NOT NULL DEFAULT 1;",
+				"ALTER TABLE exchangerate ADD COLUMN version INTEGER NOT NULL DEFAULT 1;",
+				"ALTER TABLE transfer ADD COLUMN version INTEGER NOT NULL DEFAULT 1;",
+				"ALTER TABLE schedule ADD COLUMN version INTEGER NOT NULL DEFAULT 1;",
+			},
+			down: []string{
+				"ALTER TABLE schedule DROP COLUMN version;",
+				"ALTER TABLE transfer DROP COLUMN version;",
+				"ALTER TABLE exchangerate DROP COLUMN version;",
+				"ALTER TABLE templateitem DROP COLUMN version;",
+				"ALTER TABLE template DROP COLUMN version;",
+				"ALTER TABLE category DROP COLUMN version;",
+				"ALTER TABLE bucketitem DROP COLUMN version;",
+				"ALTER TABLE bucket DROP COLUMN version;",
+			},
+		},
+		{
+			version: 12,
+			name:    "page indexes",
+			up: []string{
+				"CREATE INDEX IX_bucketitem_transaction ON bucketitem (\"transaction\", id);",
+				"CREATE INDEX IX_auditentry_changedAt ON auditentry (changedAt, id);",
+			},
+			down: []string{
+				"DROP INDEX IX_auditentry_changedAt;",
+				"DROP INDEX IX_bucketitem_transaction;",
+			},
+		},
+		{
+			version: 13,
+			name:    "bucket item tags",
+			up: []string{
+				"ALTER TABLE bucketitem ADD COLUMN tags VARCHAR(400) NULL;",
+			},
+			down: []string{
+				"ALTER TABLE bucketitem DROP COLUMN tags;",
+			},
+		},
+		{
+			version: 14,
+			name:    "bucket item balance index",
+			up: []string{
+				"CREATE INDEX IX_bucketitem_bucketID_transaction ON bucketitem (bucketID, \"transaction\", id);",
+			},
+			down: []string{
+				"DROP INDEX IX_bucketitem_bucketID_transaction;",
+			},
+		},
+	},
+	summarizeBuckets: `
+SELECT bucket.id AS bucketID, category.id AS categoryID, category.name AS categoryName, bucket.name AS bucketName, bucket.isLiquid, bucket.currency, bucket.archived, category.archived AS categoryArchived, COALESCE(SUM(bucketitem.deposit) - SUM(bucketitem.withdraw), 0) AS total
+FROM bucket LEFT JOIN bucketitem ON bucketitem.bucketID = bucket.id AND bucketitem.deletedAt IS NULL
+INNER JOIN category ON bucket.categoryID = category.id
+GROUP BY bucket.id, category.id, category.name, bucket.name, bucket.isLiquid, bucket.currency, bucket.archived, category.archived
+ORDER BY category.name, bucket.name;
+	`,
+	dayColumn:     `substr("transaction", 1, 10)`,
+	likeOperator:  "LIKE",
+	likeWildcards: "%_",
+	bucketItemBalance: `(
+SELECT SUM(b.deposit - b.withdraw) FROM bucketitem b
+WHERE b.bucketID = bucketitem.bucketID AND b.deletedAt IS NULL
+AND (b."transaction" < bucketitem."transaction" OR (b."transaction" = bucketitem."transaction" AND b.id <= bucketitem.id))
+) AS balance`,
+}
+
+// newSqliteStore returns a Store backed by the SQLite database file named
+// by the DB_FILE environment setting. The file is created when missing.
+//
+// SQLite lets one connection write at a time. In WAL mode readers don't
+// block the writer, the busy timeout makes the pooled connections wait
+// their turn to write instead of failing with "database is locked", and
+// transactions take the write lock as they begin so two of them can't
+// deadlock upgrading their read locks.
+func newSqliteStore() (*sqlStore, error) {
+	settings := sqlite.ConnectionURL{
+		Database: readEnvOrDefault("DB_FILE", "gobudget.db"),
+		Options: map[string]string{
+			"_foreign_keys": "1", // SQLite leaves foreign keys off unless asked.
+			"_journal_mode": "WAL",
+			"_busy_timeout": "5000", // milliseconds
+			"_txlock":       "immediate",
+		},
+	}
+
+	return connectSQLStore(func() (sqlbuilder.Database, error) {
+		return sqlite.Open(settings)
+	}, sqliteDialect)
+}
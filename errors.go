@@ -1,11 +1,47 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/go-chi/render"
+	db "upper.io/db.v3"
 )
 
+// Application error codes, sent as "code" with every error. Clients may rely
+// on them, so a code is never renumbered or reused. The first three digits
+// are the HTTP status it comes with.
+const (
+	AppCodeInvalidRequest   int64 = 40000 // the request can't be processed as sent
+	AppCodeValidation       int64 = 40001 // fields of the body are invalid, see "fields"
+	AppCodeInvalidBatch     int64 = 40002 // entries of a batch are invalid, see "items"
+	AppCodeInvalidID        int64 = 40003 // an id in the URL is not a number
+	AppCodeConstraint       int64 = 40004 // the database refused a value, such as a missing one
+	AppCodeNotFound         int64 = 40400 // no such record
+	AppCodeDependents       int64 = 40900 // other records depend on it, see "dependents"
+	AppCodeDuplicate        int64 = 40901 // a record with the same unique values exists
+	AppCodeReference        int64 = 40902 // refers to a record that is gone, or is still referred to
+	AppCodeVersionConflict  int64 = 41200 // changed by someone else in the meantime
+	AppCodeUnsupportedMedia int64 = 41500 // the Content-Type is not accepted
+	AppCodeInternal         int64 = 50000 // a bug, or an unexpected database error
+	AppCodeRender           int64 = 50001 // the response could not be written
+	AppCodeUnavailable      int64 = 50300 // the database can't be reached
+)
+
+// errorFormat chooses how errors are written: "json" as an ErrResponse,
+// "problem" as RFC 7807 application/problem+json. Set with the ERROR_FORMAT
+// environment setting; clients get problem+json anyway by accepting it.
+var errorFormat = readEnvOrDefault("ERROR_FORMAT", "json")
+
 // ErrResponse renderer type for handling all sorts of errors.
 //
 // In the best case scenario, the excellent github.com/pkg/errors package
@@ -18,29 +54,276 @@ type ErrResponse struct {
 	StatusText string `json:"status"`          // user-level status message
 	AppCode    int64  `json:"code,omitempty"`  // application-specific error code
 	ErrorText  string `json:"error,omitempty"` // application-level error message, for debugging
+
+	FieldErrors []FieldError `json:"fields,omitempty"`     // what is wrong with which field of the request
+	ItemErrors  []ItemError  `json:"items,omitempty"`      // why the entries of a rejected batch failed
+	Dependents  Dependents   `json:"dependents,omitempty"` // what keeps a record from being removed
+}
+
+// ItemError lists the problems found with one entry of a batch request.
+type ItemError struct {
+	Index  int          `json:"index"` // position of the entry in the request
+	Errors []string     `json:"errors"`
+	Fields []FieldError `json:"fields,omitempty"`
 }
 
 func (e *ErrResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	if e.HTTPStatusCode >= 500 && e.Err != nil {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, e.Err)
+	}
 	render.Status(r, e.HTTPStatusCode)
 	return nil
 }
 
-func ErrInvalidRequest(err error) render.Renderer {
-	return &ErrResponse{
+// newErrResponse is the ErrResponse for err with the given status and code.
+func newErrResponse(err error, status int, code int64, statusText string) *ErrResponse {
+	e := &ErrResponse{
 		Err:            err,
-		HTTPStatusCode: 400,
-		StatusText:     "Invalid request.",
-		ErrorText:      err.Error(),
+		HTTPStatusCode: status,
+		StatusText:     statusText,
+		AppCode:        code,
+	}
+	if err != nil {
+		e.ErrorText = err.Error()
 	}
+	return e
+}
+
+func ErrInvalidRequest(err error) render.Renderer {
+	switch err := err.(type) {
+	case *ValidationError:
+		e := newErrResponse(err, 400, AppCodeValidation, "Invalid request.")
+		e.FieldErrors = err.Fields
+		return e
+	case *mediaTypeError:
+		return newErrResponse(err, 415, AppCodeUnsupportedMedia, "Unsupported media type.")
+	}
+	return newErrResponse(err, 400, AppCodeInvalidRequest, "Invalid request.")
+}
+
+func ErrInvalidBatch(itemErrors []ItemError) render.Renderer {
+	e := newErrResponse(fmt.Errorf("%d item(s) rejected, nothing was stored", len(itemErrors)), 400, AppCodeInvalidBatch, "Invalid request.")
+	e.ItemErrors = itemErrors
+	return e
+}
+
+// ErrInvalidID renders a URL whose {name} is not a record id.
+func ErrInvalidID(name string) render.Renderer {
+	return newErrResponse(fmt.Errorf("%s must be a positive whole number", name), 400, AppCodeInvalidID, "Invalid request.")
+}
+
+// ErrConstraint renders a change the database refused for breaking one of
+// its constraints, of the given kind.
+func ErrConstraint(err error, kind constraintKind) render.Renderer {
+	switch kind {
+	case constraintUnique:
+		return newErrResponse(err, 409, AppCodeDuplicate, "Conflict.")
+	case constraintForeignKey:
+		return newErrResponse(err, 409, AppCodeReference, "Conflict.")
+	}
+	return newErrResponse(err, 400, AppCodeConstraint, "Invalid request.")
+}
+
+func ErrConflict(err *DependentsError) render.Renderer {
+	e := newErrResponse(err, 409, AppCodeDependents, "Conflict.")
+	e.Dependents = err.Dependents
+	return e
+}
+
+func ErrPreconditionFailed(err error) render.Renderer {
+	return newErrResponse(err, 412, AppCodeVersionConflict, "Precondition failed.")
+}
+
+func ErrInternal(err error) render.Renderer {
+	return newErrResponse(err, 500, AppCodeInternal, "Internal server error.")
 }
 
 func ErrRender(err error) render.Renderer {
-	return &ErrResponse{
-		Err:            err,
-		HTTPStatusCode: 422,
-		StatusText:     "Error rendering response.",
-		ErrorText:      err.Error(),
+	return newErrResponse(err, 500, AppCodeRender, "Error rendering response.")
+}
+
+func ErrUnavailable(err error) render.Renderer {
+	return newErrResponse(err, 503, AppCodeUnavailable, "Service unavailable.")
+}
+
+var ErrNotFound = &ErrResponse{HTTPStatusCode: 404, StatusText: "Resource not found.", AppCode: AppCodeNotFound}
+
+// ErrStore renders why reading from the Store failed: the record does not
+// exist, the cursor of a page is invalid, the database can't be reached, or
+// something unexpected went wrong.
+func ErrStore(err error) render.Renderer {
+	switch {
+	case isNotFound(err):
+		return ErrNotFound
+	case err == errInvalidCursor:
+		return ErrInvalidRequest(err)
+	case isUnavailable(err):
+		return ErrUnavailable(err)
+	}
+	return ErrInternal(err)
+}
+
+// ErrUpdate renders why a change to the Store failed: a failed precondition
+// when the record changed in the meantime, a conflict when dependents are in
+// the way, not found when the record is gone, an invalid request when the
+// change breaks a rule of the Store or a constraint of the database, an
+// unavailable service when the database can't be reached, and an internal
+// error otherwise.
+func ErrUpdate(err error) render.Renderer {
+	if dependentsErr, ok := err.(*DependentsError); ok {
+		return ErrConflict(dependentsErr)
 	}
+	switch {
+	case err == ErrVersionConflict:
+		return ErrPreconditionFailed(err)
+	case isNotFound(err):
+		return ErrNotFound
+	case isUnavailable(err):
+		return ErrUnavailable(err)
+	}
+	switch err.(type) {
+	case *ValidationError, *mediaTypeError, *dbError:
+		return ErrInvalidRequest(err)
+	}
+	if kind := constraintViolated(err); kind != "" {
+		return ErrConstraint(err, kind)
+	}
+	return ErrInternal(err)
+}
+
+// ErrRemove renders why a removal failed, like ErrUpdate.
+func ErrRemove(err error) render.Renderer {
+	return ErrUpdate(err)
+}
+
+// isNotFound reports whether err is a Store's way of saying the record
+// does not exist.
+func isNotFound(err error) bool {
+	return err == db.ErrNoMoreRows || err == sql.ErrNoRows || err == errNoRecord
+}
+
+// isUnavailable reports whether err means the database could not be reached
+// or did not answer in time, rather than that it refused the request.
+func isUnavailable(err error) bool {
+	if errors.Is(err, db.ErrNotConnected) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// constraintKind is a kind of database constraint.
+type constraintKind string
+
+const (
+	constraintUnique     constraintKind = "unique"
+	constraintForeignKey constraintKind = "foreignKey"
+	constraintValue      constraintKind = "value" // NOT NULL or CHECK
+)
+
+// constraintMessages are how the SQL Server, PostgreSQL and SQLite drivers
+// word a broken constraint of each kind.
+var constraintMessages = []struct {
+	text string
+	kind constraintKind
+}{
+	{"Violation of UNIQUE KEY constraint", constraintUnique},
+	{"Violation of PRIMARY KEY constraint", constraintUnique},
+	{"Cannot insert duplicate key", constraintUnique},
+	{"duplicate key value violates unique constraint", constraintUnique},
+	{"UNIQUE constraint failed", constraintUnique},
+	{"conflicted with the FOREIGN KEY constraint", constraintForeignKey},
+	{"conflicted with the REFERENCE constraint", constraintForeignKey},
+	{"violates foreign key constraint", constraintForeignKey},
+	{"FOREIGN KEY constraint failed", constraintForeignKey},
+	{"Cannot insert the value NULL", constraintValue},
+	{"conflicted with the CHECK constraint", constraintValue},
+	{"violates not-null constraint", constraintValue},
+	{"violates check constraint", constraintValue},
+	{"NOT NULL constraint failed", constraintValue},
+	{"CHECK constraint failed", constraintValue},
+}
+
+// constraintViolated tells which kind of constraint err reports broken, or
+// "" when it reports something else.
+func constraintViolated(err error) constraintKind {
+	message := err.Error()
+	for _, m := range constraintMessages {
+		if strings.Contains(message, m.text) {
+			return m.kind
+		}
+	}
+	return ""
 }
 
-var ErrNotFound = &ErrResponse{HTTPStatusCode: 404, StatusText: "Resource not found."}
+// mediaTypeError is a request body of a Content-Type that is not accepted.
+type mediaTypeError struct {
+	message string
+}
+
+func (e *mediaTypeError) Error() string {
+	return e.message
+}
+
+// Problem is an ErrResponse as an RFC 7807 problem details object. The
+// code, fields, items and dependents of the ErrResponse are kept as
+// extension members.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+
+	Code        int64        `json:"code,omitempty"`
+	FieldErrors []FieldError `json:"fields,omitempty"`
+	ItemErrors  []ItemError  `json:"items,omitempty"`
+	Dependents  Dependents   `json:"dependents,omitempty"`
+}
+
+const problemType = "application/problem+json"
+
+// respond is the render.Respond of the api. It writes an ErrResponse as a
+// Problem when the client accepts problem+json or ERROR_FORMAT asks for it,
+// and anything else like render.DefaultResponder does.
+func respond(w http.ResponseWriter, r *http.Request, v interface{}) {
+	e, ok := v.(*ErrResponse)
+	if !ok || !wantsProblem(r) {
+		render.DefaultResponder(w, r, v)
+		return
+	}
+
+	problem := Problem{
+		Type:        fmt.Sprintf("urn:gobudget:error:%d", e.AppCode),
+		Title:       strings.TrimSuffix(e.StatusText, "."),
+		Status:      e.HTTPStatusCode,
+		Detail:      e.ErrorText,
+		Instance:    r.URL.RequestURI(),
+		Code:        e.AppCode,
+		FieldErrors: e.FieldErrors,
+		ItemErrors:  e.ItemErrors,
+		Dependents:  e.Dependents,
+	}
+	body, err := json.Marshal(problem)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", problemType)
+	w.WriteHeader(e.HTTPStatusCode)
+	w.Write(body)
+}
+
+// wantsProblem reports whether errors go out as problem+json to r.
+func wantsProblem(r *http.Request) bool {
+	if errorFormat == "problem" {
+		return true
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted)); err == nil && mediaType == problemType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/render"
+)
+
+// entityTag is the ETag of a record at the given row version.
+func entityTag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// setETag tags the response with the version of the record it renders, to
+// be sent back in If-Match when changing the record.
+func setETag(w http.ResponseWriter, version int) {
+	w.Header().Set("ETag", entityTag(version))
+}
+
+// checkIfMatch holds a PUT, DELETE or POST changing a record at version to
+// the request's If-Match header, if it has one. When no entity tag matches
+// it renders a 412 and returns false.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, version int) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" || etagsMatch(ifMatch, entityTag(version), false) {
+		return true
+	}
+	render.Render(w, r, ErrPreconditionFailed(errors.New("If-Match does not match the current version "+entityTag(version))))
+	return false
+}
+
+// etagsMatch reports whether the comma separated list of entity tags holds
+// tag, or is "*". The weak comparison (If-None-Match) ignores the W/ of a
+// weak tag, the strong one (If-Match) never matches one.
+func etagsMatch(list string, tag string, weak bool) bool {
+	if weak {
+		tag = strings.TrimPrefix(tag, "W/")
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		} else if strings.HasPrefix(candidate, "W/") || strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ConditionalGet answers a GET whose If-None-Match holds the ETag of the
+// response with a 304 Not Modified. The response is held back until the
+// handler is done; one the handler didn't tag itself (lists, summaries)
+// gets a weak ETag hashed from its body.
+func ConditionalGet(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		held := &heldResponse{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(held, r)
+
+		if held.status == http.StatusOK {
+			etag := w.Header().Get("ETag")
+			if etag == "" {
+				etag = fmt.Sprintf(`W/"%x"`, sha1.Sum(held.body.Bytes()))
+				w.Header().Set("ETag", etag)
+			}
+			if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagsMatch(ifNoneMatch, etag, true) {
+				w.Header().Del("Content-Type")
+				w.Header().Del("Content-Length")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.WriteHeader(held.status)
+		w.Write(held.body.Bytes())
+	})
+}
+
+// heldResponse keeps what the handler writes until ConditionalGet has
+// decided on the response.
+type heldResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (h *heldResponse) WriteHeader(status int) {
+	h.status = status
+}
+
+func (h *heldResponse) Write(data []byte) (int, error) {
+	return h.body.Write(data)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestConditionalRequests(t *testing.T) {
+	ts := newTestServer(t)
+
+	rec := ts.expect(http.StatusOK, nil, "GET", "/buckets/1", "")
+	etag := rec.Header().Get("ETag")
+	if etag != `"1"` {
+		t.Fatalf("ETag %s, want \"1\"", etag)
+	}
+	ts.expect(http.StatusNotModified, nil, "GET", "/buckets/1", "", "If-None-Match", etag)
+
+	var e errorResponse
+	ts.expect(http.StatusPreconditionFailed, &e, "PUT", "/buckets/1", `{"name":"Fuel","categoryID":1,"liq":true}`, "If-Match", `"2"`)
+	if e.Code != AppCodeVersionConflict {
+		t.Errorf("stale If-Match: code %d, want %d", e.Code, AppCodeVersionConflict)
+	}
+	rec = ts.expect(http.StatusOK, nil, "PUT", "/buckets/1", `{"name":"Fuel","categoryID":1,"liq":true}`, "If-Match", etag)
+	if rec.Header().Get("ETag") != `"2"` {
+		t.Errorf("ETag after the update %s, want \"2\"", rec.Header().Get("ETag"))
+	}
+	ts.expect(http.StatusOK, nil, "GET", "/buckets/1", "", "If-None-Match", etag)
+	ts.expect(http.StatusPreconditionFailed, nil, "DELETE", "/buckets/1", "", "If-Match", etag)
+
+	// Lists get a weak ETag of their body.
+	rec = ts.expect(http.StatusOK, nil, "GET", "/buckets", "")
+	listTag := rec.Header().Get("ETag")
+	if !strings.HasPrefix(listTag, `W/"`) {
+		t.Fatalf("list ETag %s, want a weak one", listTag)
+	}
+	ts.expect(http.StatusNotModified, nil, "GET", "/buckets", "", "If-None-Match", listTag)
+	ts.expect(http.StatusCreated, nil, "POST", "/buckets", `{"name":"New","categoryID":1}`)
+	ts.expect(http.StatusOK, nil, "GET", "/buckets", "", "If-None-Match", listTag)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+// defaultCurrency is assumed for buckets created without a currency.
+const defaultCurrency = "USD"
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// ExchangeRate says how many units of To one unit of From buys, starting
+// on the Effective date and until the next rate for the same pair.
+type ExchangeRate struct {
+	ID        int       `db:"id,omitempty" json:"id"`
+	From      string    `db:"fromCurrency" json:"from" validate:"required,currency"`
+	To        string    `db:"toCurrency" json:"to" validate:"required,currency"`
+	Rate      Rate      `db:"rate" json:"rate" validate:"positive"`
+	Effective time.Time `db:"effective" json:"effective" validate:"required"`
+	Version   int       `db:"version,omitempty" json:"version"` // bumped by every update, sent as the ETag
+}
+
+// BucketDailyTotal is the net of one bucket's items on one day.
+type BucketDailyTotal struct {
+	BucketID int    `db:"bucketID"`
+	Day      string `db:"day"` // 2006-01-02
+	Total    Money  `db:"total"`
+}
+
+// DailyTotalFilter narrows down GetBucketDailyTotals. Zero fields don't
+// filter.
+type DailyTotalFilter struct {
+	BucketIDs []int     // of any of these buckets
+	From      time.Time // the first day; the days before it come as one opening total per bucket
+	To        time.Time // the last day, inclusive
+}
+
+// opening is the day the opening totals are dated, the one before From.
+func (f DailyTotalFilter) opening() string {
+	return f.From.UTC().AddDate(0, 0, -1).Format("2006-01-02")
+}
+
+// Rate is an exchange rate kept exactly to 8 decimal places, matching its
+// decimal(18,8) column.
+type Rate int64
+
+const rateScale = 100000000
+
+// ParseRate reads a decimal rate such as "1.0825".
+func ParseRate(s string) (Rate, error) {
+	rate, err := parseDecimal(s, 8)
+	return Rate(rate), err
+}
+
+// Inverse returns the rate for the opposite direction.
+func (rt Rate) Inverse() Rate {
+	if rt == 0 {
+		return 0
+	}
+	return Rate((rateScale*rateScale + int64(rt)/2) / int64(rt))
+}
+
+func (rt Rate) String() string {
+	return fmt.Sprintf("%d.%08d", int64(rt)/rateScale, int64(rt)%rateScale)
+}
+
+func (rt Rate) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + rt.String() + `"`), nil
+}
+
+func (rt *Rate) UnmarshalJSON(data []byte) error {
+	str := strings.Trim(string(data), `"`)
+	rate, err := ParseRate(str)
+	*rt = rate
+	return err
+}
+
+// Scan reads the decimal column as text, or as a float on SQLite.
+func (rt *Rate) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case float64:
+		*rt = Rate(math.Round(v * rateScale))
+	case int64:
+		*rt = Rate(v * rateScale)
+	case []byte:
+		rate, err := ParseRate(string(v))
+		*rt = rate
+		return err
+	case string:
+		rate, err := ParseRate(v)
+		*rt = rate
+		return err
+	default:
+		return fmt.Errorf("cannot scan %T into Rate", src)
+	}
+	return nil
+}
+
+func (rt Rate) Value() (driver.Value, error) {
+	return rt.String(), nil
+}
+
+// rateTable looks up the rate effective on a given day.
+type rateTable map[string][]*ExchangeRate
+
+func newRateTable(rates []*ExchangeRate) rateTable {
+	rt := rateTable{}
+	for _, rate := range rates {
+		pair := rate.From + rate.To
+		rt[pair] = append(rt[pair], rate)
+	}
+	for _, pairRates := range rt {
+		sort.Slice(pairRates, func(i, j int) bool { return pairRates[i].Effective.Before(pairRates[j].Effective) })
+	}
+	return rt
+}
+
+// rateOn returns the latest from->to rate effective on day, falling back to
+// the inverse of a to->from rate.
+func (rt rateTable) rateOn(from, to string, day time.Time) (Rate, error) {
+	if from == to {
+		return rateScale, nil
+	}
+	if rate, ok := rt.latest(from+to, day); ok {
+		return rate, nil
+	}
+	if rate, ok := rt.latest(to+from, day); ok {
+		return rate.Inverse(), nil
+	}
+	return 0, fmt.Errorf("no %s to %s exchange rate effective on %s", from, to, day.Format("2006-01-02"))
+}
+
+func (rt rateTable) latest(pair string, day time.Time) (Rate, bool) {
+	var rate Rate
+	found := false
+	for _, er := range rt[pair] {
+		if er.Effective.After(day) {
+			break
+		}
+		rate, found = er.Rate, true
+	}
+	return rate, found
+}
+
+// convertSummaries restates every bucket total in currency, converting each
+// day's activity at the rate effective that day. Only the daily totals of
+// buckets held in another currency are loaded.
+func convertSummaries(store Store, bucketSummaries []BucketSummary, currency string) ([]BucketSummary, error) {
+	bucketCurrency := map[int]string{}
+	var bucketIDs []int
+	for _, bs := range bucketSummaries {
+		if bs.Currency != currency {
+			bucketCurrency[bs.BucketID] = bs.Currency
+			bucketIDs = append(bucketIDs, bs.BucketID)
+		}
+	}
+	if len(bucketIDs) == 0 {
+		return bucketSummaries, nil
+	}
+	dailyTotals, err := store.GetBucketDailyTotals(DailyTotalFilter{BucketIDs: bucketIDs})
+	if err != nil {
+		return nil, err
+	}
+	if dailyTotals, err = convertDailyTotals(store, dailyTotals, bucketCurrency, currency); err != nil {
+		return nil, err
+	}
+
+	converted := map[int]Money{}
+	for _, dt := range dailyTotals {
+		converted[dt.BucketID] += dt.Total
+	}
+	for i := range bucketSummaries {
+		if _, ok := bucketCurrency[bucketSummaries[i].BucketID]; ok {
+			bucketSummaries[i].Total = converted[bucketSummaries[i].BucketID]
+			bucketSummaries[i].Currency = currency
+		}
+	}
+	return bucketSummaries, nil
+}
+
+// convertDailyTotals restates the daily totals of the buckets in
+// bucketCurrency, which maps them to their currencies, in currency at the
+// rate effective each day. The totals of other buckets are left out.
+func convertDailyTotals(store Store, dailyTotals []BucketDailyTotal, bucketCurrency map[int]string, currency string) ([]BucketDailyTotal, error) {
+	rates, err := store.GetExchangeRates()
+	if err != nil {
+		return nil, err
+	}
+	table := newRateTable(rates)
+
+	var converted []BucketDailyTotal
+	for _, dt := range dailyTotals {
+		from, ok := bucketCurrency[dt.BucketID]
+		if !ok {
+			continue
+		}
+		day, err := time.Parse("2006-01-02", dt.Day)
+		if err != nil {
+			return nil, err
+		}
+		rate, err := table.rateOn(from, currency, day)
+		if err != nil {
+			return nil, err
+		}
+		dt.Total = dt.Total.Convert(rate)
+		converted = append(converted, dt)
+	}
+	return converted, nil
+}
+
+// listExchangeRates lists out all the ExchangeRates
+func listExchangeRates(w http.ResponseWriter, r *http.Request) {
+	page, err := pageFromRequest(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	exchangeRates, err := getStore(r).GetExchangeRates()
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+
+	start, end, info := page.paginate(exchangeRates, func(i int) Cursor {
+		return Cursor{Key: exchangeRates[i].From + exchangeRates[i].To + timeKey(exchangeRates[i].Effective), ID: exchangeRates[i].ID}
+	}, false)
+	setPageHeaders(w, r, page, info)
+	if err := render.RenderList(w, r, newExchangeRateListResponse(exchangeRates[start:end])); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// ExchangeRateCtx middleware is used to load an ExchangeRate object from
+// the URL parameters passed through as the request. In case
+// the ExchangeRate could not be found, we stop here and return a 404.
+func ExchangeRateCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exchangeRateID, ok := urlParamID(r, "exchangeRateID")
+		if !ok {
+			render.Render(w, r, ErrInvalidID("exchangeRateID"))
+			return
+		}
+		exchangeRate, err := getStore(r).GetExchangeRate(exchangeRateID)
+		if err != nil {
+			render.Render(w, r, ErrStore(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "exchangeRate", exchangeRate)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// createExchangeRate persists the posted ExchangeRate and returns it
+// back to the client as an acknowledgement.
+func createExchangeRate(w http.ResponseWriter, r *http.Request) {
+	data := &ExchangeRateRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	if err := getStore(r).NewExchangeRate(data.ExchangeRate); err != nil {
+		render.Render(w, r, ErrUpdate(err))
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, newExchangeRateResponse(data.ExchangeRate))
+}
+
+// getExchangeRate returns the specific ExchangeRate loaded by ExchangeRateCtx.
+func getExchangeRate(w http.ResponseWriter, r *http.Request) {
+	exchangeRate := r.Context().Value("exchangeRate").(*ExchangeRate)
+
+	setETag(w, exchangeRate.Version)
+	if err := render.Render(w, r, newExchangeRateResponse(exchangeRate)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// updateExchangeRate updates an existing ExchangeRate in our persistent store.
+func updateExchangeRate(w http.ResponseWriter, r *http.Request) {
+	exchangeRate := r.Context().Value("exchangeRate").(*ExchangeRate)
+	if !checkIfMatch(w, r, exchangeRate.Version) {
+		return
+	}
+	exchangeRateID, version := exchangeRate.ID, exchangeRate.Version
+
+	data := &ExchangeRateRequest{ExchangeRate: exchangeRate}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	exchangeRate = data.ExchangeRate
+	exchangeRate.Version = version
+	exchangeRate.ID = 0 // the URL names the rate, not the body
+	if err := getStore(r).UpdateExchangeRate(exchangeRateID, exchangeRate); err != nil {
+		render.Render(w, r, ErrUpdate(err))
+		return
+	}
+
+	setETag(w, exchangeRate.Version)
+	render.Render(w, r, newExchangeRateResponse(exchangeRate))
+}
+
+func deleteExchangeRate(w http.ResponseWriter, r *http.Request) {
+	exchangeRate := r.Context().Value("exchangeRate").(*ExchangeRate)
+	if !checkIfMatch(w, r, exchangeRate.Version) {
+		return
+	}
+
+	if err := getStore(r).RemoveExchangeRate(exchangeRate.ID); err != nil {
+		render.Render(w, r, ErrUpdate(err))
+		return
+	}
+
+	render.Render(w, r, newExchangeRateResponse(exchangeRate))
+}
+
+// ExchangeRateRequest is the request payload for ExchangeRate data model.
+type ExchangeRateRequest struct {
+	*ExchangeRate
+}
+
+func (er *ExchangeRate) checkFields(e *ValidationError) {
+	if er.From != "" && er.From == er.To {
+		e.add("to", codeInvalid, "from and to must differ")
+	}
+}
+
+func (a *ExchangeRateRequest) Bind(r *http.Request) error {
+	if a.ExchangeRate == nil {
+		return errors.New("missing required ExchangeRate fields")
+	}
+	a.From = strings.ToUpper(a.From)
+	a.To = strings.ToUpper(a.To)
+	if err := validate(getStore(r), a.ExchangeRate); err != nil {
+		return err
+	}
+	// Rates apply to whole days.
+	a.Effective = dayOf(a.Effective)
+	return nil
+}
+
+// ExchangeRateResponse is the response payload for the ExchangeRate data model.
+type ExchangeRateResponse struct {
+	*ExchangeRate
+}
+
+func newExchangeRateResponse(exchangeRate *ExchangeRate) *ExchangeRateResponse {
+	return &ExchangeRateResponse{ExchangeRate: exchangeRate}
+}
+
+func (rd *ExchangeRateResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+func newExchangeRateListResponse(exchangeRates []*ExchangeRate) []render.Renderer {
+	list := []render.Renderer{}
+	for _, exchangeRate := range exchangeRates {
+		list = append(list, newExchangeRateResponse(exchangeRate))
+	}
+	return list
+}
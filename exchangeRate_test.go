@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func day(s string) time.Time {
+	d, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func TestRateOn(t *testing.T) {
+	rates := newRateTable([]*ExchangeRate{
+		{From: "USD", To: "EUR", Rate: 90000000, Effective: day("2026-03-01")},
+		{From: "USD", To: "EUR", Rate: 80000000, Effective: day("2026-01-01")},
+		{From: "GBP", To: "USD", Rate: 125000000, Effective: day("2026-01-01")},
+	})
+	tests := []struct {
+		from, to string
+		day      string
+		want     Rate
+		missing  bool
+	}{
+		{"USD", "USD", "2020-01-01", rateScale, false},
+		{"USD", "EUR", "2026-01-01", 80000000, false},
+		{"USD", "EUR", "2026-02-28", 80000000, false},
+		{"USD", "EUR", "2026-03-01", 90000000, false},
+		{"EUR", "USD", "2026-02-01", 125000000, false},
+		{"USD", "GBP", "2026-06-01", 80000000, false},
+		{"USD", "EUR", "2025-12-31", 0, true},
+		{"EUR", "GBP", "2026-06-01", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := rates.rateOn(tt.from, tt.to, day(tt.day))
+		if missing := err != nil; missing != tt.missing {
+			t.Errorf("rateOn(%s, %s, %s) = %v, want missing %v", tt.from, tt.to, tt.day, err, tt.missing)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("rateOn(%s, %s, %s) = %s, want %s", tt.from, tt.to, tt.day, got, tt.want)
+		}
+	}
+}
+
+// newExchangeRateStore returns the seeded memory store with bucket 3 held in
+// EUR, which took in 100.00 on 2026-01-10 and paid out 20.00 on 2026-02-10,
+// a EUR to USD rate of 1.1 from 2026-01-01 and a USD to EUR rate of 0.8 from
+// 2026-02-01.
+func newExchangeRateStore(t *testing.T) *memoryStore {
+	t.Helper()
+	store := newSeededStore(t)
+	if err := store.NewBucket(&Bucket{Name: "Euro cash", CategoryID: 2, Currency: "EUR"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, bucketItem := range []*BucketItem{
+		{BucketID: 3, Name: "Cash", Transaction: day("2026-01-10"), Deposit: 10000},
+		{BucketID: 3, Name: "Lunch", Transaction: day("2026-02-10"), Withdraw: 2000},
+	} {
+		if err := store.NewBucketItem(bucketItem); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, exchangeRate := range []*ExchangeRate{
+		{From: "EUR", To: "USD", Rate: 110000000, Effective: day("2026-01-01")},
+		{From: "USD", To: "EUR", Rate: 80000000, Effective: day("2026-02-01")},
+	} {
+		if err := store.NewExchangeRate(exchangeRate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestConvertSummaries(t *testing.T) {
+	store := newExchangeRateStore(t)
+	tests := []struct {
+		currency string
+		want     map[int]Money // bucket id to its converted total
+		missing  bool
+	}{
+		// 100.00 less 20.00 at 1.1.
+		{"USD", map[int]Money{1: 155, 2: 0, 3: 8800}, false},
+		// Bucket 1's 1.55 of today at 0.8.
+		{"EUR", map[int]Money{1: 124, 2: 0, 3: 8000}, false},
+		{"GBP", nil, true},
+	}
+	for _, tt := range tests {
+		bucketSummaries, err := store.SummarizeBuckets()
+		if err != nil {
+			t.Fatal(err)
+		}
+		converted, err := convertSummaries(store, bucketSummaries, tt.currency)
+		if missing := err != nil; missing != tt.missing {
+			t.Errorf("%s: convertSummaries = %v, want missing %v", tt.currency, err, tt.missing)
+			continue
+		}
+		if tt.missing {
+			continue
+		}
+		if len(converted) != len(tt.want) {
+			t.Errorf("%s: %d summaries, want %d", tt.currency, len(converted), len(tt.want))
+		}
+		for _, bs := range converted {
+			if bs.Currency != tt.currency || bs.Total != tt.want[bs.BucketID] {
+				t.Errorf("%s: bucket %d totals %s %s, want %s %s", tt.currency, bs.BucketID, bs.Total, bs.Currency, tt.want[bs.BucketID], tt.currency)
+			}
+		}
+	}
+}
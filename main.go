@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
@@ -10,9 +17,105 @@ import (
 
 const serverIP string = ""
 
-// go run main.go bucket.go bucketItem.go category.go errors.go template.go templateItem.go db.go utils.go
+// go run main.go bucket.go bucketItem.go category.go errors.go exchangeRate.go template.go templateItem.go schedule.go transfer.go trash.go audit.go etag.go patch.go validate.go pagination.go tags.go balances.go db.go db_memory.go db_remove.go db_mssql.go db_postgres.go db_sqlite.go migrate.go money.go store.go utils.go
 func main() {
+	driver := flag.String("driver", readEnvOrDefault("DB_DRIVER", "mssql"), "database backend: mssql, postgres, sqlite or memory")
+	autoMigrate := flag.Bool("migrate", readEnvOrDefault("DB_MIGRATE", "false") == "true", "apply pending schema migrations on startup")
+	flag.Parse()
+
+	store, err := newStore(*driver)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	// gobudget migrate up|down|status
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrateCommand(store, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if migrator, ok := store.(Migrator); ok && *autoMigrate {
+		if err := migrator.MigrateUp(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *driver == "memory" {
+		// Nothing to connect to, so start the demo off with the sample data.
+		if err := store.Seed(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	scheduleInterval, err := time.ParseDuration(readEnvOrDefault("SCHEDULE_INTERVAL", "1h"))
+	if err != nil {
+		log.Fatalf("SCHEDULE_INTERVAL: %v", err)
+	}
+	scheduleCatchUp, err := time.ParseDuration(readEnvOrDefault("SCHEDULE_CATCHUP", "720h"))
+	if err != nil {
+		log.Fatalf("SCHEDULE_CATCHUP: %v", err)
+	}
+	// The background jobs run until the server has shut down.
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	schedulerDone := make(chan struct{})
+	go func() {
+		runScheduler(jobsCtx, store, scheduleInterval, scheduleCatchUp)
+		close(schedulerDone)
+	}()
+
+	trashRetention, err := time.ParseDuration(readEnvOrDefault("TRASH_RETENTION", "720h"))
+	if err != nil {
+		log.Fatalf("TRASH_RETENTION: %v", err)
+	}
+	trashPurgeInterval, err := time.ParseDuration(readEnvOrDefault("TRASH_PURGE_INTERVAL", "1h"))
+	if err != nil {
+		log.Fatalf("TRASH_PURGE_INTERVAL: %v", err)
+	}
+	purgerDone := make(chan struct{})
+	go func() {
+		runTrashPurger(jobsCtx, store, trashPurgeInterval, trashRetention)
+		close(purgerDone)
+	}()
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf("%s:%s", serverIP, readEnvOrDefault("HTTP_PLATFORM_PORT", "3000")),
+		Handler: newRouter(store),
+	}
+
+	// On Ctrl-C or SIGTERM stop accepting requests and let the ones in
+	// flight finish before the store is closed.
+	idle := make(chan struct{})
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+		close(idle)
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-idle
+	stopJobs()
+	<-schedulerDone
+	<-purgerDone
+}
+
+// newRouter builds the api routes on top of the given Store.
+func newRouter(store Store) chi.Router {
+	render.Respond = respond // errors as problem+json to clients asking for it
+
 	r := chi.NewRouter()
+	r.Use(StoreCtx(store)) // Load the Store on the request context
+	r.Use(ConditionalGet)  // ETag every GET, 304 when If-None-Match matches
 
 	r.Route("/bucketItems", func(r chi.Router) {
 		r.Get("/", listBucketItems)
@@ -22,8 +125,10 @@ func main() {
 			r.Use(BucketItemCtx)            // Load the *BucketItem on the request context
 			r.Get("/", getBucketItem)       // GET /bucketItems/123
 			r.Put("/", updateBucketItem)    // PUT /bucketItems/123
+			r.Patch("/", updateBucketItem)  // PATCH /bucketItems/123
 			r.Delete("/", deleteBucketItem) // DELETE /bucketItems/123
 		})
+		r.Get("/{bucketItemID}/history", listBucketItemHistory) // GET /bucketItems/123/history
 
 		// GET /bucketItems/whats-up
 		r.With(BucketItemCtx).Get("/{articleSlug:[a-z-]+}", getBucketItem)
@@ -33,12 +138,17 @@ func main() {
 		r.Get("/", listBuckets)
 		r.Post("/", createBucket)
 		r.Get("/summary", summarizeBuckets)
+		r.Get("/balances", summarizeBalances) // GET /buckets/balances
 
 		r.Route("/{bucketID}", func(r chi.Router) {
-			r.Use(BucketCtx)            // Load the *Bucket on the request context
-			r.Get("/", getBucket)       // GET /buckets/123
-			r.Put("/", updateBucket)    // PUT /buckets/123
-			r.Delete("/", deleteBucket) // DELETE /buckets/123
+			r.Use(BucketCtx)                           // Load the *Bucket on the request context
+			r.Get("/", getBucket)                      // GET /buckets/123
+			r.Put("/", updateBucket)                   // PUT /buckets/123
+			r.Patch("/", updateBucket)                 // PATCH /buckets/123
+			r.Delete("/", deleteBucket)                // DELETE /buckets/123
+			r.Post("/archive", archiveBucket(true))    // POST /buckets/123/archive
+			r.Post("/unarchive", archiveBucket(false)) // POST /buckets/123/unarchive
+			r.Get("/balances", getBucketBalances)      // GET /buckets/123/balances
 		})
 	})
 
@@ -47,10 +157,13 @@ func main() {
 		r.Post("/", createCategory) // POST /categories
 
 		r.Route("/{categoryID}", func(r chi.Router) {
-			r.Use(CategoryCtx)            // Load the *Bucket on the request context
-			r.Get("/", getCategory)       // GET /categories/123
-			r.Put("/", updateCategory)    // PUT /categories/123
-			r.Delete("/", deleteCategory) // DELETE /categories/123
+			r.Use(CategoryCtx)                           // Load the *Bucket on the request context
+			r.Get("/", getCategory)                      // GET /categories/123
+			r.Put("/", updateCategory)                   // PUT /categories/123
+			r.Patch("/", updateCategory)                 // PATCH /categories/123
+			r.Delete("/", deleteCategory)                // DELETE /categories/123
+			r.Post("/archive", archiveCategory(true))    // POST /categories/123/archive
+			r.Post("/unarchive", archiveCategory(false)) // POST /categories/123/unarchive
 		})
 	})
 
@@ -59,10 +172,18 @@ func main() {
 		r.Post("/", createTemplate) // POST /templates
 
 		r.Route("/{templateID}", func(r chi.Router) {
-			r.Use(TemplateCtx)            // Load the *Template on the request context
-			r.Get("/", getTemplate)       // GET /templates/123
-			r.Put("/", updateTemplate)    // PUT /templates/123
-			r.Delete("/", deleteTemplate) // DELETE /templates/123
+			r.Use(TemplateCtx)              // Load the *Template on the request context
+			r.Get("/", getTemplate)         // GET /templates/123
+			r.Put("/", updateTemplate)      // PUT /templates/123
+			r.Patch("/", updateTemplate)    // PATCH /templates/123
+			r.Delete("/", deleteTemplate)   // DELETE /templates/123
+			r.Post("/apply", applyTemplate) // POST /templates/123/apply
+
+			r.Route("/items", func(r chi.Router) {
+				r.Get("/", listTemplateItemsByTemplate)   // GET /templates/123/items
+				r.Post("/", createTemplateItemInTemplate) // POST /templates/123/items
+				r.Put("/order", reorderTemplateItems)     // PUT /templates/123/items/order
+			})
 		})
 	})
 
@@ -75,6 +196,7 @@ func main() {
 			r.Use(TemplateItemCtx)            // Load the *TemplateItem on the request context
 			r.Get("/", getTemplateItem)       // GET /templateItems/123
 			r.Put("/", updateTemplateItem)    // PUT /templateItems/123
+			r.Patch("/", updateTemplateItem)  // PATCH /templateItems/123
 			r.Delete("/", deleteTemplateItem) // DELETE /templateItems/123
 		})
 
@@ -82,26 +204,61 @@ func main() {
 		r.With(TemplateItemCtx).Get("/{articleSlug:[a-z-]+}", getTemplateItem)
 	})
 
-	r.Route("/db", func(r chi.Router) {
-		r.Get("/create", func(w http.ResponseWriter, r *http.Request) {
-			if err := dbCreateTables(); err != nil {
-				render.Render(w, r, ErrInvalidRequest(err))
-				return
-			}
-			render.Status(r, http.StatusCreated)
+	r.Route("/exchangeRates", func(r chi.Router) {
+		r.Get("/", listExchangeRates)
+		r.Post("/", createExchangeRate) // POST /exchangeRates
+
+		r.Route("/{exchangeRateID}", func(r chi.Router) {
+			r.Use(ExchangeRateCtx)            // Load the *ExchangeRate on the request context
+			r.Get("/", getExchangeRate)       // GET /exchangeRates/123
+			r.Put("/", updateExchangeRate)    // PUT /exchangeRates/123
+			r.Delete("/", deleteExchangeRate) // DELETE /exchangeRates/123
+		})
+	})
+
+	r.Route("/schedules", func(r chi.Router) {
+		r.Get("/", listSchedules)
+		r.Post("/", createSchedule)                 // POST /schedules
+		r.Get("/upcoming", listUpcomingOccurrences) // GET /schedules/upcoming?days=30
+
+		r.Route("/{scheduleID}", func(r chi.Router) {
+			r.Use(ScheduleCtx)                          // Load the *Schedule on the request context
+			r.Get("/", getSchedule)                     // GET /schedules/123
+			r.Put("/", updateSchedule)                  // PUT /schedules/123
+			r.Delete("/", deleteSchedule)               // DELETE /schedules/123
+			r.Get("/upcoming", listUpcomingOccurrences) // GET /schedules/123/upcoming
+		})
+	})
+
+	r.Route("/transfers", func(r chi.Router) {
+		r.Get("/", listTransfers)
+		r.Post("/", createTransfer) // POST /transfers
+
+		r.Route("/{transferID}", func(r chi.Router) {
+			r.Use(TransferCtx)            // Load the *Transfer on the request context
+			r.Get("/", getTransfer)       // GET /transfers/123
+			r.Put("/", updateTransfer)    // PUT /transfers/123
+			r.Delete("/", deleteTransfer) // DELETE /transfers/123
 		})
-		r.Get("/drop", func(w http.ResponseWriter, r *http.Request) {
-			if err := dbDropTables(); err != nil {
+	})
+
+	r.Get("/audit", listAudit) // GET /audit?resource=bucketItem&actor=...&from=...&to=...
+
+	r.Route("/trash", func(r chi.Router) {
+		r.Get("/", listTrash)                                            // GET /trash?type=bucketItem
+		r.Post("/bucketItems/{bucketItemID}/restore", restoreBucketItem) // POST /trash/bucketItems/123/restore
+		r.Post("/transfers/{transferID}/restore", restoreTransfer)       // POST /trash/transfers/123/restore
+	})
+
+	r.Route("/db", func(r chi.Router) {
+		r.Get("/init", func(w http.ResponseWriter, r *http.Request) {
+			if err := getStore(r).Seed(); err != nil {
 				render.Render(w, r, ErrInvalidRequest(err))
 				return
 			}
-			render.Status(r, http.StatusGone)
-		})
-		r.Get("/init", func(w http.ResponseWriter, r *http.Request) {
-			dbInit()
 			render.Status(r, http.StatusCreated)
 		})
 	})
 
-	http.ListenAndServe(fmt.Sprintf("%s:%s", serverIP, readEnvOrDefault("HTTP_PLATFORM_PORT", "3000")), r)
+	return r
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+// migration is one numbered, reversible change to the database schema.
+// Versions start at 1 and must be applied in order.
+type migration struct {
+	version int
+	name    string
+	up      []string
+	down    []string
+}
+
+// schemaVersion is a row of the schema_version table, one per applied
+// migration.
+type schemaVersion struct {
+	Version int       `db:"version" json:"version"`
+	Name    string    `db:"name" json:"name"`
+	Applied time.Time `db:"applied" json:"applied"`
+}
+
+// MigrationStatus reports whether a known migration has been applied.
+type MigrationStatus struct {
+	Version int        `json:"version"`
+	Name    string     `json:"name"`
+	Applied *time.Time `json:"applied,omitempty"`
+}
+
+// Migrator is implemented by the stores that keep a versioned schema.
+type Migrator interface {
+	MigrateUp() error
+	MigrateDown() error
+	MigrationStatus() ([]MigrationStatus, error)
+}
+
+// appliedVersions makes sure the schema_version table exists and returns
+// its rows ordered by version.
+func (s *sqlStore) appliedVersions() ([]schemaVersion, error) {
+	if _, err := s.sess.Exec(s.dialect.schemaVersionTable); err != nil {
+		return nil, err
+	}
+
+	var versions []schemaVersion
+	err := s.sess.SelectFrom("schema_version").OrderBy("version").All(&versions)
+	return versions, err
+}
+
+// MigrateUp applies every pending migration, each in its own transaction.
+func (s *sqlStore) MigrateUp() error {
+	versions, err := s.appliedVersions()
+	if err != nil {
+		return err
+	}
+	current := 0
+	if len(versions) > 0 {
+		current = versions[len(versions)-1].Version
+	}
+
+	for _, m := range s.dialect.migrations {
+		if m.version <= current {
+			continue
+		}
+		err = s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+			for _, stmt := range m.up {
+				if _, err := tx.Exec(stmt); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Collection("schema_version").Insert(schemaVersion{
+				Version: m.version,
+				Name:    m.name,
+				Applied: time.Now(),
+			})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d %s: %v", m.version, m.name, err)
+		}
+	}
+
+	return nil
+}
+
+// MigrateDown reverts the most recently applied migration.
+func (s *sqlStore) MigrateDown() error {
+	versions, err := s.appliedVersions()
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return &dbError{"no migrations to revert"}
+	}
+	current := versions[len(versions)-1].Version
+
+	for _, m := range s.dialect.migrations {
+		if m.version != current {
+			continue
+		}
+		err = s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+			for _, stmt := range m.down {
+				if _, err := tx.Exec(stmt); err != nil {
+					return err
+				}
+			}
+			_, err := tx.DeleteFrom("schema_version").Where("version = ?", m.version).Exec()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d %s: %v", m.version, m.name, err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown migration %d", current)
+}
+
+// MigrationStatus lists every known migration and when it was applied.
+func (s *sqlStore) MigrationStatus() ([]MigrationStatus, error) {
+	versions, err := s.appliedVersions()
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]time.Time{}
+	for _, v := range versions {
+		applied[v.Version] = v.Applied
+	}
+
+	var status []MigrationStatus
+	for _, m := range s.dialect.migrations {
+		ms := MigrationStatus{Version: m.version, Name: m.name}
+		if at, ok := applied[m.version]; ok {
+			ms.Applied = &at
+		}
+		status = append(status, ms)
+	}
+	return status, nil
+}
+
+// runMigrateCommand implements `gobudget migrate up|down|status`.
+func runMigrateCommand(store Store, args []string) error {
+	migrator, ok := store.(Migrator)
+	if !ok {
+		return &dbError{"this driver has no schema to migrate"}
+	}
+	if len(args) != 1 {
+		return &dbError{"usage: gobudget migrate up|down|status"}
+	}
+
+	switch args[0] {
+	case "up":
+		return migrator.MigrateUp()
+	case "down":
+		return migrator.MigrateDown()
+	case "status":
+		status, err := migrator.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, ms := range status {
+			applied := "pending"
+			if ms.Applied != nil {
+				applied = ms.Applied.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-30s %s\n", ms.Version, ms.Name, applied)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown migrate command %q", args[0])
+}
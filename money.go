@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Money is an exact amount of currency kept in whole cents, matching the
+// decimal(10,2) columns it is stored in.
+//
+// Rounding: whenever an amount carries more precision than a cent (a text
+// value such as "2.345" or a float coming back from SQLite) it is rounded
+// to the nearest cent, with halves rounded away from zero, so "2.345"
+// becomes 2.35 and "-2.345" becomes -2.35.
+type Money int64
+
+// moneyJSONFormat selects how Money is written to JSON: "string" writes
+// "12.34", "cents" writes 1234. Set with the MONEY_FORMAT environment
+// setting.
+var moneyJSONFormat = readEnvOrDefault("MONEY_FORMAT", "string")
+
+// ParseMoney reads a decimal amount such as "12.34", "-0.5" or "7".
+func ParseMoney(s string) (Money, error) {
+	cents, err := parseDecimal(s, 2)
+	return Money(cents), err
+}
+
+// parseDecimal reads a decimal number as an integer count of 10^-places
+// units, rounding any extra digits half away from zero.
+func parseDecimal(s string, places int) (int64, error) {
+	str := strings.TrimSpace(s)
+	negative := false
+	switch {
+	case strings.HasPrefix(str, "-"):
+		negative = true
+		str = str[1:]
+	case strings.HasPrefix(str, "+"):
+		str = str[1:]
+	}
+
+	whole, frac := str, ""
+	if i := strings.IndexByte(str, '.'); i >= 0 {
+		whole, frac = str[:i], str[i+1:]
+	}
+	if whole == "" && frac == "" || strings.Trim(whole+frac, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	if whole == "" {
+		whole = "0"
+	}
+
+	// Keep the wanted decimals and round on the next one.
+	roundUp := len(frac) > places && frac[places] >= '5'
+	frac = (frac + strings.Repeat("0", places))[:places]
+
+	scale := int64(math.Pow10(places))
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || units > math.MaxInt64/scale-1 {
+		return 0, fmt.Errorf("amount %q out of range", s)
+	}
+	value := units * scale
+	if places > 0 {
+		fraction, _ := strconv.ParseInt(frac, 10, 64)
+		value += fraction
+	}
+	if roundUp {
+		value++
+	}
+	if negative {
+		value = -value
+	}
+	return value, nil
+}
+
+// moneyFromFloat converts a float amount, rounding to the nearest cent.
+func moneyFromFloat(f float64) Money {
+	return Money(math.Round(f * 100))
+}
+
+// String formats m as a plain decimal such as "-12.34".
+func (m Money) String() string {
+	sign := ""
+	cents := int64(m)
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// Cents returns the amount in whole cents.
+func (m Money) Cents() int64 {
+	return int64(m)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	if moneyJSONFormat == "cents" {
+		return []byte(strconv.FormatInt(int64(m), 10)), nil
+	}
+	return []byte(`"` + m.String() + `"`), nil
+}
+
+// UnmarshalJSON accepts a decimal string ("12.34") in either format. A bare
+// number is read as integer cents in the "cents" format and as a decimal
+// amount otherwise, which keeps older clients posting 12.34 working. The
+// number's text is parsed directly so no float rounding creeps in.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	str := string(data)
+	if str == "null" {
+		return nil
+	}
+	if strings.HasPrefix(str, `"`) {
+		unquoted, err := strconv.Unquote(str)
+		if err != nil {
+			return err
+		}
+		money, err := ParseMoney(unquoted)
+		*m = money
+		return err
+	}
+	if moneyJSONFormat == "cents" {
+		cents, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid amount in cents %s", str)
+		}
+		*m = Money(cents)
+		return nil
+	}
+	if strings.ContainsAny(str, "eE") {
+		return fmt.Errorf("invalid amount %s", str)
+	}
+	money, err := ParseMoney(str)
+	*m = money
+	return err
+}
+
+// Scan reads decimal columns, which the drivers hand back as text, floats
+// or integers depending on the backend.
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = 0
+	case int64:
+		*m = Money(v * 100)
+	case float64:
+		*m = moneyFromFloat(v)
+	case []byte:
+		money, err := ParseMoney(string(v))
+		if err != nil {
+			return err
+		}
+		*m = money
+	case string:
+		money, err := ParseMoney(v)
+		if err != nil {
+			return err
+		}
+		*m = money
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+	return nil
+}
+
+// Value stores m as decimal text so no backend goes through a float.
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// float is m as a decimal number, to compare with columns that some
+// backends keep as floats.
+func (m Money) float() float64 {
+	return float64(m) / 100
+}
+
+// Convert returns m in another currency at the given rate, rounded to the
+// nearest cent with halves away from zero.
+func (m Money) Convert(rate Rate) Money {
+	product := new(big.Int).Mul(big.NewInt(int64(m)), big.NewInt(int64(rate)))
+	quotient, remainder := new(big.Int).QuoRem(product, big.NewInt(rateScale), new(big.Int))
+	if new(big.Int).Abs(remainder).Cmp(big.NewInt(rateScale/2)) >= 0 {
+		quotient.Add(quotient, big.NewInt(int64(product.Sign())))
+	}
+	return Money(quotient.Int64())
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+	}{
+		{"12.34", 1234},
+		{"-0.5", -50},
+		{"7", 700},
+		{"+7.", 700},
+		{".05", 5},
+		{" 3.10 ", 310},
+		{"2.345", 235},
+		{"-2.345", -235},
+		{"2.3449", 234},
+		{"-2.3449", -234},
+		{"0.005", 1},
+		{"-0.005", -1},
+		{"0.004", 0},
+		{"1.23456789", 123},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in)
+		if err != nil {
+			t.Errorf("ParseMoney(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseMoney(%q) = %d cents, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseMoneyInvalid(t *testing.T) {
+	for _, in := range []string{"", ".", "-", "abc", "1,5", "1.2.3", "--1", "1e3", "12.3x", "99999999999999999999"} {
+		if got, err := ParseMoney(in); err == nil {
+			t.Errorf("ParseMoney(%q) = %v, want an error", in, got)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Rate
+	}{
+		{"1.0825", 108250000},
+		{"0.12345678", 12345678},
+		{"0.123456785", 12345679},
+		{"0.123456784", 12345678},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if err != nil {
+			t.Errorf("ParseRate(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+// withMoneyFormat runs f with MONEY_FORMAT set to format.
+func withMoneyFormat(format string, f func()) {
+	saved := moneyJSONFormat
+	moneyJSONFormat = format
+	defer func() { moneyJSONFormat = saved }()
+	f()
+}
+
+func TestMoneyJSON(t *testing.T) {
+	tests := []struct {
+		format string
+		money  Money
+		json   string
+	}{
+		{"string", 1234, `"12.34"`},
+		{"string", -5, `"-0.05"`},
+		{"string", 0, `"0.00"`},
+		{"cents", 1234, `1234`},
+		{"cents", -5, `-5`},
+	}
+	for _, tt := range tests {
+		withMoneyFormat(tt.format, func() {
+			data, err := json.Marshal(tt.money)
+			if err != nil || string(data) != tt.json {
+				t.Errorf("%s: Marshal(%d) = %s, %v, want %s", tt.format, tt.money, data, err, tt.json)
+			}
+			var back Money
+			if err := json.Unmarshal(data, &back); err != nil || back != tt.money {
+				t.Errorf("%s: Unmarshal(%s) = %d, %v, want %d", tt.format, data, back, err, tt.money)
+			}
+		})
+	}
+}
+
+func TestMoneyUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		format string
+		json   string
+		want   Money
+	}{
+		{"string", `"12.345"`, 1235},
+		{"string", `12.34`, 1234},
+		{"string", `7`, 700},
+		{"cents", `"12.34"`, 1234},
+		{"cents", `1234`, 1234},
+	}
+	for _, tt := range tests {
+		withMoneyFormat(tt.format, func() {
+			var got Money
+			if err := json.Unmarshal([]byte(tt.json), &got); err != nil || got != tt.want {
+				t.Errorf("%s: Unmarshal(%s) = %d, %v, want %d", tt.format, tt.json, got, err, tt.want)
+			}
+		})
+	}
+
+	for _, tt := range []struct{ format, json string }{
+		{"string", `1e3`},
+		{"string", `"abc"`},
+		{"cents", `12.34`},
+	} {
+		withMoneyFormat(tt.format, func() {
+			var got Money
+			if err := json.Unmarshal([]byte(tt.json), &got); err == nil {
+				t.Errorf("%s: Unmarshal(%s) = %d, want an error", tt.format, tt.json, got)
+			}
+		})
+	}
+}
+
+func TestMoneyScan(t *testing.T) {
+	tests := []struct {
+		src  interface{}
+		want Money
+	}{
+		{nil, 0},
+		{int64(7), 700},
+		{int64(-3), -300},
+		{float64(12.34), 1234},
+		{float64(0.125), 13},
+		{float64(-0.125), -13},
+		{[]byte("12.34"), 1234},
+		{[]byte("2.345"), 235},
+		{"-2.345", -235},
+		{"0.10", 10},
+	}
+	for _, tt := range tests {
+		got := Money(99)
+		if err := got.Scan(tt.src); err != nil {
+			t.Errorf("Scan(%#v): %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Scan(%#v) = %d cents, want %d", tt.src, got, tt.want)
+		}
+	}
+
+	var m Money
+	for _, src := range []interface{}{"abc", []byte("1..2"), true} {
+		if err := m.Scan(src); err == nil {
+			t.Errorf("Scan(%#v) = %d, want an error", src, m)
+		}
+	}
+}
+
+func TestMoneyConvert(t *testing.T) {
+	tests := []struct {
+		money Money
+		rate  Rate
+		want  Money
+	}{
+		{1000, 108250000, 1083},   // 10.825 rounds up
+		{-1000, 108250000, -1083}, // and away from zero when negative
+		{50, 101000000, 51},       // 0.505
+		{-50, 101000000, -51},
+		{100, 12345678, 12}, // 0.12345678
+		{1234, rateScale, 1234},
+		{0, 108250000, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.money.Convert(tt.rate); got != tt.want {
+			t.Errorf("%v.Convert(%v) = %v, want %v", tt.money, tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestRateInverse(t *testing.T) {
+	tests := []struct {
+		rate Rate
+		want Rate
+	}{
+		{rateScale, rateScale},
+		{200000000, 50000000}, // 2 -> 0.5
+		{108250000, 92378753}, // 1/1.0825 = 0.923787528...
+		{300000000, 33333333}, // 1/3 = 0.333333333...
+		{150000000, 66666667}, // 1/1.5 = 0.666666666...
+		{0, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.rate.Inverse(); got != tt.want {
+			t.Errorf("%v.Inverse() = %v, want %v", tt.rate, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every list is paged the same way: ?limit= records at a time, and ?cursor=
+// to go on after the last record of the previous page. The X-Total-Count
+// header holds the length of the whole list and the Link header the first
+// and the next page.
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// cursorTimeFormat writes times into cursor keys. It is fixed width, so the
+// keys sort like the times they stand for.
+const cursorTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+var errInvalidCursor = errors.New("invalid cursor, start over without one")
+
+// Cursor is the place of a record in a list: the key the list is sorted on,
+// then its id. A page goes on after the record its cursor points to rather
+// than after a number of records, so records added or removed in the
+// meantime don't shift the pages.
+type Cursor struct {
+	Key string `json:"k,omitempty"`
+	ID  int    `json:"i"`
+}
+
+// less reports whether c sorts before o.
+func (c Cursor) less(o Cursor) bool {
+	if c.Key != o.Key {
+		return c.Key < o.Key
+	}
+	return c.ID < o.ID
+}
+
+// String encodes c for the ?cursor= parameter. Clients are not meant to
+// look into it.
+func (c Cursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseCursor(s string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var c Cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errInvalidCursor
+	}
+	return &c, nil
+}
+
+// Page selects one page of a list: at most Limit records, the ones after
+// the record After points to, or the first ones when After is nil.
+type Page struct {
+	Limit int
+	After *Cursor
+}
+
+// PageInfo tells what is around a page of a list.
+type PageInfo struct {
+	Total int     // records in the whole list
+	Next  *Cursor // where the next page starts, nil on the last page
+}
+
+// pageFromRequest reads the Page asked for with ?limit= and ?cursor=.
+func pageFromRequest(r *http.Request) (Page, error) {
+	qs := r.URL.Query()
+	page := Page{Limit: defaultPageLimit}
+	if limit := qs.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return page, fmt.Errorf("limit must be a number from 1 to %d", maxPageLimit)
+		}
+		page.Limit = n
+	}
+	if cursor := qs.Get("cursor"); cursor != "" {
+		after, err := parseCursor(cursor)
+		if err != nil {
+			return page, err
+		}
+		page.After = after
+	}
+	return page, nil
+}
+
+// follows reports whether the record at c comes after the page's cursor in
+// a list sorted ascending, or descending when desc.
+func (p Page) follows(c Cursor, desc bool) bool {
+	if p.After == nil {
+		return true
+	}
+	if desc {
+		return c.less(*p.After)
+	}
+	return p.After.less(c)
+}
+
+// paginate sorts list, a slice, by the cursors key gives for its elements,
+// ascending or descending when desc, and returns the bounds of this page in
+// it. A list too small to matter is paged this way after loading it whole.
+func (p Page) paginate(list interface{}, key func(i int) Cursor, desc bool) (start int, end int, info PageInfo) {
+	sort.SliceStable(list, func(i, j int) bool {
+		if desc {
+			return key(j).less(key(i))
+		}
+		return key(i).less(key(j))
+	})
+
+	n := reflect.ValueOf(list).Len()
+	start = sort.Search(n, func(i int) bool { return p.follows(key(i), desc) })
+	end = start + p.Limit
+	if end > n {
+		end = n
+	}
+	info.Total = n
+	if end < n {
+		next := key(end - 1)
+		info.Next = &next
+	}
+	return start, end, info
+}
+
+// setPageHeaders sends the total of the list a page came from and links to
+// its first and next page.
+func setPageHeaders(w http.ResponseWriter, r *http.Request, page Page, info PageInfo) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(info.Total))
+	links := []string{pageLink(r, page.Limit, nil, "first")}
+	if info.Next != nil {
+		links = append(links, pageLink(r, page.Limit, info.Next, "next"))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+// pageLink is a Link header entry for the request's list starting after
+// cursor.
+func pageLink(r *http.Request, limit int, cursor *Cursor, rel string) string {
+	qs := r.URL.Query()
+	qs.Set("limit", strconv.Itoa(limit))
+	qs.Del("cursor")
+	if cursor != nil {
+		qs.Set("cursor", cursor.String())
+	}
+	return fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.Path, qs.Encode(), rel)
+}
+
+// timeKey is the cursor key of a list sorted on t.
+func timeKey(t time.Time) string {
+	return t.UTC().Format(cursorTimeFormat)
+}
+
+// amountKey is the cursor key of a list sorted on amount m. Flipping the
+// sign bit makes the keys of negative amounts sort before the others.
+func amountKey(m Money) string {
+	return fmt.Sprintf("%020d", uint64(m)^(1<<63))
+}
+
+// parseAmountKey reads an amountKey back.
+func parseAmountKey(key string) (Money, error) {
+	n, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return Money(int64(n ^ (1 << 63))), nil
+}
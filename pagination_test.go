@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+var nextLink = regexp.MustCompile(`<([^>]*)>; rel="next"`)
+
+func TestCursorPages(t *testing.T) {
+	ts := newTestServer(t)
+	for _, day := range []string{"01", "02", "02", "03", "04"} {
+		ts.expect(http.StatusCreated, nil, "POST", "/bucketItems", `{"bucketID":2,"name":"x","d":"1.00","transaction":"2026-01-`+day+`T00:00:00Z"}`)
+	}
+
+	seen := map[int]bool{}
+	var order []int
+	path := "/bucketItems?bid=2&limit=2"
+	for pages := 0; path != ""; pages++ {
+		if pages == 5 {
+			t.Fatal("more pages than bucket items")
+		}
+		var bucketItems []*BucketItem
+		rec := ts.expect(http.StatusOK, &bucketItems, "GET", path, "")
+		if total := rec.Header().Get("X-Total-Count"); pages == 0 && total != "5" {
+			t.Errorf("X-Total-Count %s, want 5", total)
+		}
+		for _, bucketItem := range bucketItems {
+			if seen[bucketItem.ID] {
+				t.Errorf("bucket item %d on two pages", bucketItem.ID)
+			}
+			seen[bucketItem.ID] = true
+			order = append(order, bucketItem.ID)
+		}
+
+		path = ""
+		if m := nextLink.FindStringSubmatch(rec.Header().Get("Link")); m != nil {
+			path = m[1]
+		}
+		if pages == 0 {
+			// Adding an item ahead of the cursor doesn't shift the pages.
+			ts.expect(http.StatusCreated, nil, "POST", "/bucketItems", `{"bucketID":2,"name":"new","d":"1.00","transaction":"2026-02-01T00:00:00Z"}`)
+		}
+	}
+	// Newest first, the items of one day by id, descending too.
+	want := []int{6, 5, 4, 3, 2}
+	if len(order) != len(want) {
+		t.Fatalf("listed %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("listed %v, want %v", order, want)
+		}
+	}
+
+	ts.expect(http.StatusBadRequest, nil, "GET", "/bucketItems?cursor=nonsense", "")
+	ts.expect(http.StatusBadRequest, nil, "GET", "/transfers?limit=0", "")
+}
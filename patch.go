@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/render"
+)
+
+// Patch formats PATCH accepts, told apart by the Content-Type. A plain
+// application/json body is taken as a merge patch.
+const (
+	mergePatchType = "application/merge-patch+json" // RFC 7396
+	jsonPatchType  = "application/json-patch+json"  // RFC 6902
+)
+
+// bindUpdate binds the body of a PUT onto record through v, the request
+// payload wrapping it. A PATCH body is applied to record as a patch
+// instead, see bindPatch.
+func bindUpdate(r *http.Request, record interface{}, v render.Binder) error {
+	if r.Method == http.MethodPatch {
+		return bindPatch(r, record, v)
+	}
+	return render.Bind(r, v)
+}
+
+// bindPatch applies the patch in the body to the JSON of record and decodes
+// the result back into it, so fields the patch leaves alone keep their
+// value and fields it removes are zeroed. v then checks the patched record
+// like it would a PUT.
+func bindPatch(r *http.Request, record interface{}, v render.Binder) error {
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil && r.Header.Get("Content-Type") != "" {
+		return &mediaTypeError{fmt.Sprintf("invalid Content-Type: %v", err)}
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	current, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(current, &doc); err != nil {
+		return err
+	}
+	switch contentType {
+	case jsonPatchType:
+		var operations []patchOperation
+		if err := json.Unmarshal(body, &operations); err != nil {
+			return fmt.Errorf("invalid JSON Patch: %v", err)
+		}
+		if doc, err = applyJSONPatch(doc, operations); err != nil {
+			return err
+		}
+	case mergePatchType, "application/json", "":
+		var patch interface{}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			return fmt.Errorf("invalid merge patch: %v", err)
+		}
+		doc = mergePatch(doc, patch)
+	default:
+		return &mediaTypeError{fmt.Sprintf("Content-Type must be %s or %s", mergePatchType, jsonPatchType)}
+	}
+
+	patched, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	target := reflect.ValueOf(record).Elem()
+	target.Set(reflect.Zero(target.Type()))
+	if err := json.Unmarshal(patched, record); err != nil {
+		return fmt.Errorf("patched document is invalid: %v", err)
+	}
+	return v.Bind(r)
+}
+
+// mergePatch applies the JSON Merge Patch patch to target: members of an
+// object patch are merged in one by one, a null member removes one, and
+// any other patch replaces target as a whole.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		targetObject[name] = mergePatch(targetObject[name], value)
+	}
+	return targetObject
+}
+
+// patchOperation is one step of a JSON Patch. Value is nil when the
+// operation leaves it out, and "null" when it is given as null.
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies the operations to doc in order. When one of them
+// fails, the patch as a whole does.
+func applyJSONPatch(doc interface{}, operations []patchOperation) (interface{}, error) {
+	for i, operation := range operations {
+		var err error
+		if doc, err = operation.apply(doc); err != nil {
+			return nil, fmt.Errorf("patch operation %d (%s %s): %v", i, operation.Op, operation.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func (o patchOperation) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(o.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch o.Op {
+	case "add", "replace", "test":
+		if o.Value == nil {
+			return nil, errors.New("value is required")
+		}
+		var value interface{}
+		if err := json.Unmarshal(o.Value, &value); err != nil {
+			return nil, err
+		}
+		switch o.Op {
+		case "add":
+			return pointerAdd(doc, path, value)
+		case "replace":
+			return pointerReplace(doc, path, value)
+		}
+		current, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	case "remove":
+		return pointerRemove(doc, path)
+	case "move", "copy":
+		from, err := parsePointer(o.From)
+		if err != nil {
+			return nil, fmt.Errorf("from: %v", err)
+		}
+		value, err := pointerGet(doc, from)
+		if err != nil {
+			return nil, fmt.Errorf("from: %v", err)
+		}
+		if o.Op == "copy" {
+			// The copy must not share its objects and arrays with the original.
+			data, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			value = nil
+			if err := json.Unmarshal(data, &value); err != nil {
+				return nil, err
+			}
+			return pointerAdd(doc, path, value)
+		}
+		if o.From == o.Path {
+			return doc, nil
+		}
+		if strings.HasPrefix(o.Path, o.From+"/") {
+			return nil, errors.New("cannot move a value into itself")
+		}
+		if doc, err = pointerRemove(doc, from); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "":
+		return nil, errors.New("op is required")
+	}
+	return nil, fmt.Errorf("unknown op %q", o.Op)
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its unescaped
+// reference tokens. The empty pointer points to the whole document.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("path %q must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// arrayIndex reads token as an index into an array, below limit.
+func arrayIndex(token string, limit int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') || token[0] == '+' {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i >= limit {
+		return 0, fmt.Errorf("array index %d is out of range", i)
+	}
+	return i, nil
+}
+
+// pointerGet returns the value path points to in doc.
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q does not exist", token)
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node))
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("cannot look up %q in a %T", token, doc)
+		}
+	}
+	return doc, nil
+}
+
+// pointerChange calls change with the object or array holding the value
+// path points to and the last token of path, and returns doc with whatever
+// change returns in place of that object or array.
+func pointerChange(doc interface{}, path []string, change func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return change(doc, path[0])
+	}
+	child, err := pointerGet(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = pointerChange(child, path[1:], change); err != nil {
+		return nil, err
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[path[0]] = child
+	case []interface{}:
+		i, _ := strconv.Atoi(path[0])
+		node[i] = child
+	}
+	return doc, nil
+}
+
+// pointerAdd adds value at path: a new or replaced object member, or an
+// array element inserted before the index ("-" appends).
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return pointerChange(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			i := len(node)
+			if token != "-" {
+				var err error
+				if i, err = arrayIndex(token, len(node)+1); err != nil {
+					return nil, err
+				}
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("cannot add %q to a %T", token, parent)
+	})
+}
+
+// pointerRemove removes the value at path, which must exist.
+func pointerRemove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("cannot remove the whole document")
+	}
+	return pointerChange(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := node[token]; !ok {
+				return nil, fmt.Errorf("member %q does not exist", token)
+			}
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(node))
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:i], node[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove %q from a %T", token, parent)
+	})
+}
+
+// pointerReplace replaces the value at path, which must exist.
+func pointerReplace(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if _, err := pointerGet(doc, path); err != nil {
+		return nil, err
+	}
+	if len(path) == 0 {
+		return value, nil
+	}
+	return pointerChange(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+		case []interface{}:
+			i, _ := strconv.Atoi(token)
+			node[i] = value
+		}
+		return parent, nil
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPatch(t *testing.T) {
+	ts := newTestServer(t)
+
+	var bucket Bucket
+	ts.expect(http.StatusOK, &bucket, "PATCH", "/buckets/1", `{"desc":"car"}`, "Content-Type", mergePatchType)
+	if bucket.Name != "Gas" || bucket.Description != "car" || !bucket.IsLiquid {
+		t.Errorf("merge patch: %+v, want only desc changed", bucket)
+	}
+	ts.expect(http.StatusOK, &bucket, "PATCH", "/buckets/1", `{"desc":null}`, "Content-Type", mergePatchType)
+	if bucket.Description != "" {
+		t.Errorf("merge patch with null: desc %q, want it removed", bucket.Description)
+	}
+
+	ts.expect(http.StatusOK, &bucket, "PATCH", "/buckets/1", `[
+		{"op":"test","path":"/name","value":"Gas"},
+		{"op":"replace","path":"/name","value":"Fuel"},
+		{"op":"replace","path":"/liq","value":false}
+	]`, "Content-Type", jsonPatchType)
+	if bucket.Name != "Fuel" || bucket.IsLiquid || bucket.Version != 4 {
+		t.Errorf("JSON Patch: %+v", bucket)
+	}
+
+	// A failing operation fails the patch as a whole.
+	ts.expect(http.StatusBadRequest, nil, "PATCH", "/buckets/1", `[
+		{"op":"replace","path":"/name","value":"Petrol"},
+		{"op":"test","path":"/name","value":"Gas"}
+	]`, "Content-Type", jsonPatchType)
+	ts.expect(http.StatusOK, &bucket, "GET", "/buckets/1", "")
+	if bucket.Name != "Fuel" {
+		t.Errorf("name %q after a failed patch, want Fuel", bucket.Name)
+	}
+
+	var e errorResponse
+	ts.expect(http.StatusBadRequest, &e, "PATCH", "/buckets/1", `{"name":null}`, "Content-Type", mergePatchType)
+	if len(e.Fields) == 0 || e.Fields[0].Field != "name" {
+		t.Errorf("removing the name: %+v, want a field error for name", e)
+	}
+	ts.expect(http.StatusUnsupportedMediaType, nil, "PATCH", "/buckets/1", `name=x`, "Content-Type", "application/x-www-form-urlencoded")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRemoveBucket(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         int
+		opts       RemoveOptions
+		transfer   bool // between buckets 1 and 2 first
+		dependents Dependents
+		invalid    bool
+		wantItems  map[int]int // bucket item id to the bucket it ends up in, 0 once removed
+	}{
+		{name: "dependents", id: 1, dependents: Dependents{"bucketItems": 1, "templateItems": 1}},
+		{name: "transfer dependents", id: 2, transfer: true, dependents: Dependents{"bucketItems": 1, "transfers": 1}},
+		{name: "no dependents", id: 2, wantItems: map[int]int{1: 1}},
+		{name: "cascade", id: 1, opts: RemoveOptions{Cascade: true}, wantItems: map[int]int{1: 0}},
+		{name: "cascade transfer", id: 2, opts: RemoveOptions{Cascade: true}, transfer: true, wantItems: map[int]int{1: 1, 2: 0, 3: 0}},
+		{name: "reassign", id: 1, opts: RemoveOptions{ReassignTo: 2}, wantItems: map[int]int{1: 2}},
+		{name: "reassign to itself", id: 1, opts: RemoveOptions{ReassignTo: 1}, invalid: true},
+		{name: "reassign to a missing bucket", id: 1, opts: RemoveOptions{ReassignTo: 99}, invalid: true},
+		{name: "reassign without dependents", id: 2, opts: RemoveOptions{ReassignTo: 99}, invalid: true},
+		{name: "reassign across a transfer", id: 1, opts: RemoveOptions{ReassignTo: 2}, transfer: true, invalid: true},
+	}
+	for _, tt := range tests {
+		store := newSeededStore(t)
+		if tt.transfer {
+			transfer := &Transfer{FromBucketID: 1, ToBucketID: 2, Name: "savings", Transaction: time.Now(), Amount: 500, ToAmount: 500}
+			if err := store.NewTransfer(transfer); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err := store.RemoveBucket(tt.id, tt.opts)
+		if tt.dependents != nil {
+			if e, ok := err.(*DependentsError); !ok || !reflect.DeepEqual(e.Dependents, tt.dependents) {
+				t.Errorf("%s: RemoveBucket = %v, want dependents %v", tt.name, err, tt.dependents)
+			}
+			continue
+		}
+		if tt.invalid {
+			if _, ok := err.(*dbError); !ok {
+				t.Errorf("%s: RemoveBucket = %v, want it refused", tt.name, err)
+			}
+			if _, err := store.GetBucket(tt.id); err != nil {
+				t.Errorf("%s: refused removal removed the bucket", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: RemoveBucket: %v", tt.name, err)
+			continue
+		}
+		if _, err := store.GetBucket(tt.id); err != errNoRecord {
+			t.Errorf("%s: bucket %d is still there", tt.name, tt.id)
+		}
+		for id, bucketID := range tt.wantItems {
+			bucketItem, err := store.GetBucketItem(id)
+			switch {
+			case bucketID == 0 && err != errNoRecord:
+				t.Errorf("%s: bucket item %d is still there", tt.name, id)
+			case bucketID != 0 && (err != nil || bucketItem.BucketID != bucketID):
+				t.Errorf("%s: bucket item %d = %+v, %v, want it in bucket %d", tt.name, id, bucketItem, err, bucketID)
+			}
+		}
+	}
+}
+
+func TestRemoveCategory(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        RemoveOptions
+		dependents  Dependents
+		wantBuckets map[int]int // bucket id to the category it ends up in, 0 once removed
+	}{
+		{name: "dependents", dependents: Dependents{"buckets": 2}},
+		{name: "cascade", opts: RemoveOptions{Cascade: true}, wantBuckets: map[int]int{1: 0, 2: 0}},
+		{name: "reassign", opts: RemoveOptions{ReassignTo: 2}, wantBuckets: map[int]int{1: 2, 2: 2}},
+	}
+	for _, tt := range tests {
+		store := newSeededStore(t)
+		_, err := store.RemoveCategory(1, tt.opts)
+		if tt.dependents != nil {
+			if e, ok := err.(*DependentsError); !ok || !reflect.DeepEqual(e.Dependents, tt.dependents) {
+				t.Errorf("%s: RemoveCategory = %v, want dependents %v", tt.name, err, tt.dependents)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: RemoveCategory: %v", tt.name, err)
+			continue
+		}
+		for id, categoryID := range tt.wantBuckets {
+			bucket, err := store.GetBucket(id)
+			switch {
+			case categoryID == 0 && err != errNoRecord:
+				t.Errorf("%s: bucket %d is still there", tt.name, id)
+			case categoryID != 0 && (err != nil || bucket.CategoryID != categoryID):
+				t.Errorf("%s: bucket %d = %+v, %v, want it in category %d", tt.name, id, bucket, err, categoryID)
+			}
+		}
+		if tt.opts.Cascade {
+			if _, err := store.GetBucketItem(1); err != errNoRecord {
+				t.Errorf("%s: bucket item 1 outlived its bucket", tt.name)
+			}
+		}
+	}
+}
+
+func TestRemoveTemplate(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         RemoveOptions
+		dependents   Dependents
+		wantTemplate int // template item 1 ends up in, 0 once removed
+		wantPosition int
+	}{
+		{name: "dependents", dependents: Dependents{"templateItems": 1}},
+		{name: "cascade", opts: RemoveOptions{Cascade: true}},
+		{name: "reassign", opts: RemoveOptions{ReassignTo: 2}, wantTemplate: 2, wantPosition: 2},
+	}
+	for _, tt := range tests {
+		store := newSeededStore(t)
+		if err := store.NewTemplate(&Template{Name: "Rent"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.NewTemplateItem(&TemplateItem{Name: "Rent", BucketID: 2, TemplateID: 2, Withdraw: 1000}); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := store.RemoveTemplate(1, tt.opts)
+		if tt.dependents != nil {
+			if e, ok := err.(*DependentsError); !ok || !reflect.DeepEqual(e.Dependents, tt.dependents) {
+				t.Errorf("%s: RemoveTemplate = %v, want dependents %v", tt.name, err, tt.dependents)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: RemoveTemplate: %v", tt.name, err)
+			continue
+		}
+		templateItem, err := store.GetTemplateItem(1)
+		switch {
+		case tt.wantTemplate == 0 && err != errNoRecord:
+			t.Errorf("%s: template item 1 is still there", tt.name)
+		case tt.wantTemplate != 0 && (err != nil || templateItem.TemplateID != tt.wantTemplate || templateItem.Position != tt.wantPosition):
+			t.Errorf("%s: template item 1 = %+v, %v, want it at %d in template %d", tt.name, templateItem, err, tt.wantPosition, tt.wantTemplate)
+		}
+	}
+}
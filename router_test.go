@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newSeededStore returns a memory store holding the sample data:
+// categories 1 and 2, buckets 1 (liquid) and 2 in category 1, bucket item 1
+// in bucket 1, and template 1 with template item 1 in bucket 1.
+func newSeededStore(t *testing.T) *memoryStore {
+	t.Helper()
+	store := newMemoryStore()
+	if err := store.Seed(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// testServer runs requests through the router of a newSeededStore.
+type testServer struct {
+	t      *testing.T
+	router http.Handler
+}
+
+func newTestServer(t *testing.T) *testServer {
+	return &testServer{t: t, router: newRouter(newSeededStore(t))}
+}
+
+// do sends a request with body as JSON, or as the Content-Type given in
+// headers, which are name, value pairs.
+func (ts *testServer) do(method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	ts.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// expect sends a request and fails the test unless it is answered with
+// status. The body is decoded into v, unless v is nil.
+func (ts *testServer) expect(status int, v interface{}, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	rec := ts.do(method, path, body, headers...)
+	if rec.Code != status {
+		ts.t.Fatalf("%s %s = %d, want %d: %s", method, path, rec.Code, status, rec.Body)
+	}
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			ts.t.Fatalf("%s %s: decoding %s: %v", method, path, rec.Body, err)
+		}
+	}
+	return rec
+}
+
+// errorResponse is the body of an error answer.
+type errorResponse struct {
+	Code   int64        `json:"code"`
+	Fields []FieldError `json:"fields"`
+	Items  []ItemError  `json:"items"`
+}
+
+func TestBucketCRUD(t *testing.T) {
+	ts := newTestServer(t)
+
+	var bucket Bucket
+	ts.expect(http.StatusCreated, &bucket, "POST", "/buckets", `{"name":"Groceries","categoryID":2,"liq":true}`)
+	if bucket.Id == 0 || bucket.Name != "Groceries" || bucket.Currency != defaultCurrency || bucket.Version != 1 {
+		t.Fatalf("created %+v", bucket)
+	}
+
+	var got Bucket
+	ts.expect(http.StatusOK, &got, "GET", "/buckets/3", "")
+	if got != bucket {
+		t.Errorf("GET = %+v, want %+v", got, bucket)
+	}
+
+	ts.expect(http.StatusOK, &got, "PUT", "/buckets/3", `{"id":99,"name":"Food","categoryID":2,"liq":true}`)
+	if got.Id != 3 || got.Name != "Food" || got.Version != 2 {
+		t.Errorf("PUT = %+v, want bucket 3 renamed at version 2", got)
+	}
+
+	ts.expect(http.StatusOK, nil, "DELETE", "/buckets/3", "")
+	var e errorResponse
+	ts.expect(http.StatusNotFound, &e, "GET", "/buckets/3", "")
+	if e.Code != AppCodeNotFound {
+		t.Errorf("GET deleted bucket: code %d, want %d", e.Code, AppCodeNotFound)
+	}
+}
+
+func TestInvalidRequests(t *testing.T) {
+	ts := newTestServer(t)
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		code               int64
+		field              string
+	}{
+		{"POST", "/buckets", `{"categoryID":1}`, 400, AppCodeValidation, "name"},
+		{"POST", "/buckets", `{"name":"x","categoryID":99}`, 400, AppCodeValidation, "categoryID"},
+		{"POST", "/buckets", `{"name":`, 400, AppCodeInvalidRequest, ""},
+		{"GET", "/buckets/abc", "", 400, AppCodeInvalidID, ""},
+		{"GET", "/buckets/99", "", 404, AppCodeNotFound, ""},
+		{"PUT", "/buckets/99", `{"name":"x","categoryID":1}`, 404, AppCodeNotFound, ""},
+		{"DELETE", "/bucketItems/99", "", 404, AppCodeNotFound, ""},
+		{"POST", "/bucketItems", `{"bucketID":1,"name":"x","d":"abc","transaction":"2026-01-01T00:00:00Z"}`, 400, AppCodeInvalidRequest, ""},
+		{"POST", "/bucketItems", `{"bucketID":99,"name":"x","d":"1.00","transaction":"2026-01-01T00:00:00Z"}`, 400, AppCodeValidation, "bucketID"},
+		{"DELETE", "/buckets/1", "", 409, AppCodeDependents, ""},
+	}
+	for _, tt := range tests {
+		var e errorResponse
+		ts.expect(tt.status, &e, tt.method, tt.path, tt.body)
+		if e.Code != tt.code {
+			t.Errorf("%s %s %s: code %d, want %d", tt.method, tt.path, tt.body, e.Code, tt.code)
+		}
+		if tt.field != "" && (len(e.Fields) == 0 || e.Fields[0].Field != tt.field) {
+			t.Errorf("%s %s %s: fields %+v, want one for %s", tt.method, tt.path, tt.body, e.Fields, tt.field)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+// The recurrence rules a Schedule can follow.
+const (
+	ruleWeekly          = "weekly"          // every 7 days from start
+	ruleBiweekly        = "biweekly"        // every 14 days from start
+	ruleSemimonthly     = "semimonthly"     // the 1st and the 15th
+	ruleMonthly         = "monthly"         // day N, or the last day of shorter months
+	ruleLastBusinessDay = "lastBusinessDay" // the last Monday to Friday of the month
+)
+
+// Schedule applies its Template on every occurrence of Rule, starting on
+// the Start date.
+type Schedule struct {
+	ID         int       `db:"id,omitempty" json:"id"`
+	TemplateID int       `db:"templateID" json:"tid" validate:"required,ref=template"`
+	Rule       string    `db:"rule" json:"rule" validate:"required,oneof=weekly biweekly semimonthly monthly lastBusinessDay"`
+	Day        int       `db:"day" json:"day,omitempty"` // day of the month for the monthly rule
+	Start      time.Time `db:"start" json:"start" validate:"required"`
+	Version    int       `db:"version,omitempty" json:"version"` // bumped by every update, sent as the ETag
+}
+
+// ScheduleOccurrence records that a Schedule was posted for one date, so
+// nothing is posted twice, or that the date was skipped for being older
+// than the catch-up window.
+type ScheduleOccurrence struct {
+	ID         int       `db:"id,omitempty" json:"id"`
+	ScheduleID int       `db:"scheduleID" json:"scheduleID"`
+	Occurrence time.Time `db:"occurrence" json:"occurrence"`
+	Posted     time.Time `db:"posted" json:"posted"`
+	Skipped    bool      `db:"skipped" json:"skipped"` // recorded without posting any bucket items
+}
+
+// occurrences returns the dates the schedule falls on between from and to,
+// both inclusive.
+func (sc *Schedule) occurrences(from, to time.Time) []time.Time {
+	start := dayOf(sc.Start)
+	from, to = dayOf(from), dayOf(to)
+	if from.Before(start) {
+		from = start
+	}
+
+	var dates []time.Time
+	switch sc.Rule {
+	case ruleWeekly, ruleBiweekly:
+		step := 7
+		if sc.Rule == ruleBiweekly {
+			step = 14
+		}
+		// Jump straight to the first occurrence on or after from.
+		elapsed := int(from.Sub(start).Hours() / 24)
+		skipped := (elapsed + step - 1) / step
+		for date := start.AddDate(0, 0, skipped*step); !date.After(to); date = date.AddDate(0, 0, step) {
+			dates = append(dates, date)
+		}
+	default:
+		for month := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC); !month.After(to); month = month.AddDate(0, 1, 0) {
+			for _, date := range sc.datesIn(month) {
+				if !date.Before(from) && !date.After(to) {
+					dates = append(dates, date)
+				}
+			}
+		}
+	}
+	return dates
+}
+
+// datesIn returns the dates a month based rule falls on in the month
+// starting on first.
+func (sc *Schedule) datesIn(first time.Time) []time.Time {
+	last := first.AddDate(0, 1, -1)
+	switch sc.Rule {
+	case ruleSemimonthly:
+		return []time.Time{first, first.AddDate(0, 0, 14)}
+	case ruleMonthly:
+		if sc.Day > last.Day() {
+			return []time.Time{last}
+		}
+		return []time.Time{first.AddDate(0, 0, sc.Day-1)}
+	case ruleLastBusinessDay:
+		for last.Weekday() == time.Saturday || last.Weekday() == time.Sunday {
+			last = last.AddDate(0, 0, -1)
+		}
+		return []time.Time{last}
+	}
+	return nil
+}
+
+func (sc *Schedule) checkFields(e *ValidationError) {
+	if sc.Rule == ruleMonthly && (sc.Day < 1 || sc.Day > 31) {
+		e.add("day", codeInvalid, "day must be between 1 and 31 for the monthly rule")
+	}
+}
+
+// runScheduler posts the due occurrences of every Schedule right away and
+// then every interval, until ctx is done. Occurrences more than catchUp in
+// the past are skipped rather than posted.
+func runScheduler(ctx context.Context, store Store, interval time.Duration, catchUp time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		postDueOccurrences(store, time.Now(), catchUp)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// postDueOccurrences posts every occurrence up to now that hasn't been
+// posted yet, which also catches up on the runs missed while the server
+// was down, as long as they are no more than catchUp in the past.
+func postDueOccurrences(store Store, now time.Time, catchUp time.Duration) {
+	schedules, err := store.GetSchedules()
+	if err != nil {
+		log.Printf("scheduler: %v", err)
+		return
+	}
+
+	for _, schedule := range schedules {
+		if err := postSchedule(store, schedule, now, catchUp); err != nil {
+			log.Printf("scheduler: schedule %d: %v", schedule.ID, err)
+		}
+	}
+}
+
+// postSchedule posts the occurrences of one Schedule up to now, each
+// together with its record in one transaction. The occurrences before
+// now - catchUp are recorded as skipped instead, and logged, so a schedule
+// started far back or a server down for long doesn't post them all at once.
+func postSchedule(store Store, schedule *Schedule, now time.Time, catchUp time.Duration) error {
+	postedOccurrences, err := store.GetScheduleOccurrences(schedule.ID)
+	if err != nil {
+		return err
+	}
+	posted := map[time.Time]bool{}
+	for _, occurrence := range postedOccurrences {
+		posted[dayOf(occurrence.Occurrence)] = true
+	}
+
+	templateItems, err := store.GetTemplateItemsByTemplate(schedule.TemplateID)
+	if err != nil {
+		return err
+	}
+
+	cutoff := dayOf(now.Add(-catchUp))
+	var skipped []time.Time
+	for _, date := range schedule.occurrences(schedule.Start, now) {
+		if posted[date] {
+			continue
+		}
+		if date.Before(cutoff) {
+			occurrence := &ScheduleOccurrence{ScheduleID: schedule.ID, Occurrence: date, Posted: now, Skipped: true}
+			if err := store.PostScheduleOccurrence(occurrence, nil); err != nil {
+				return err
+			}
+			skipped = append(skipped, date)
+			continue
+		}
+		apply := &TemplateApplyRequest{Transaction: date}
+		bucketItems, err := apply.bucketItems(templateItems)
+		if err != nil {
+			return err
+		}
+		if itemErrors := validateBucketItems(store, bucketItems); len(itemErrors) > 0 {
+			return fmt.Errorf("template %d has invalid items", schedule.TemplateID)
+		}
+
+		occurrence := &ScheduleOccurrence{ScheduleID: schedule.ID, Occurrence: date, Posted: now}
+		if err := store.PostScheduleOccurrence(occurrence, bucketItems); err != nil {
+			return err
+		}
+		for _, bucketItem := range bucketItems {
+			recordAuditBy(store, schedulerActor, auditBucketItem, bucketItem.ID, auditCreate, nil, snapshot(bucketItem))
+		}
+	}
+	if len(skipped) > 0 {
+		log.Printf("scheduler: schedule %d: skipped %d occurrence(s) from %s to %s, older than SCHEDULE_CATCHUP",
+			schedule.ID, len(skipped), skipped[0].Format("2006-01-02"), skipped[len(skipped)-1].Format("2006-01-02"))
+	}
+	return nil
+}
+
+// listSchedules lists out all the Schedules
+func listSchedules(w http.ResponseWriter, r *http.Request) {
+	page, err := pageFromRequest(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	schedules, err := getStore(r).GetSchedules()
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+
+	start, end, info := page.paginate(schedules, func(i int) Cursor { return Cursor{ID: schedules[i].ID} }, false)
+	setPageHeaders(w, r, page, info)
+	if err := render.RenderList(w, r, newScheduleListResponse(schedules[start:end])); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// ScheduleCtx middleware is used to load a Schedule object from
+// the URL parameters passed through as the request. In case
+// the Schedule could not be found, we stop here and return a 404.
+func ScheduleCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheduleID, ok := urlParamID(r, "scheduleID")
+		if !ok {
+			render.Render(w, r, ErrInvalidID("scheduleID"))
+			return
+		}
+		schedule, err := getStore(r).GetSchedule(scheduleID)
+		if err != nil {
+			render.Render(w, r, ErrStore(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "schedule", schedule)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// createSchedule persists the posted Schedule and returns it
+// back to the client as an acknowledgement.
+func createSchedule(w http.ResponseWriter, r *http.Request) {
+	data := &ScheduleRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	schedule := data.Schedule
+	if err := getStore(r).NewSchedule(schedule); err != nil {
+		render.Render(w, r, ErrUpdate(err))
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, newScheduleResponse(schedule))
+}
+
+// getSchedule returns the specific Schedule loaded by ScheduleCtx.
+func getSchedule(w http.ResponseWriter, r *http.Request) {
+	schedule := r.Context().Value("schedule").(*Schedule)
+
+	setETag(w, schedule.Version)
+	if err := render.Render(w, r, newScheduleResponse(schedule)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// updateSchedule updates an existing Schedule in our persistent store.
+// Occurrences already posted stay posted.
+func updateSchedule(w http.ResponseWriter, r *http.Request) {
+	schedule := r.Context().Value("schedule").(*Schedule)
+	if !checkIfMatch(w, r, schedule.Version) {
+		return
+	}
+	scheduleID, version := schedule.ID, schedule.Version
+
+	data := &ScheduleRequest{Schedule: schedule}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	schedule = data.Schedule
+	schedule.Version = version
+	schedule.ID = 0 // the URL names the schedule, not the body
+	if err := getStore(r).UpdateSchedule(scheduleID, schedule); err != nil {
+		render.Render(w, r, ErrUpdate(err))
+		return
+	}
+
+	setETag(w, schedule.Version)
+	render.Render(w, r, newScheduleResponse(schedule))
+}
+
+// deleteSchedule removes the Schedule and its record of posted
+// occurrences. The bucket items it posted are kept.
+func deleteSchedule(w http.ResponseWriter, r *http.Request) {
+	schedule := r.Context().Value("schedule").(*Schedule)
+	if !checkIfMatch(w, r, schedule.Version) {
+		return
+	}
+
+	if err := getStore(r).RemoveSchedule(schedule.ID); err != nil {
+		render.Render(w, r, ErrUpdate(err))
+		return
+	}
+
+	render.Render(w, r, newScheduleResponse(schedule))
+}
+
+// listUpcomingOccurrences lists the occurrences of every Schedule in the
+// next ?days= days (30 by default), or of one Schedule when mounted below
+// ScheduleCtx.
+func listUpcomingOccurrences(w http.ResponseWriter, r *http.Request) {
+	page, err := pageFromRequest(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days <= 0 {
+		days = 30
+	}
+
+	var schedules []*Schedule
+	if schedule, ok := r.Context().Value("schedule").(*Schedule); ok {
+		schedules = []*Schedule{schedule}
+	} else if schedules, err = getStore(r).GetSchedules(); err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+
+	today := dayOf(time.Now())
+	var upcoming []*UpcomingOccurrenceResponse
+	for _, schedule := range schedules {
+		postedOccurrences, err := getStore(r).GetScheduleOccurrences(schedule.ID)
+		if err != nil {
+			render.Render(w, r, ErrStore(err))
+			return
+		}
+		posted := map[time.Time]bool{}
+		for _, occurrence := range postedOccurrences {
+			posted[dayOf(occurrence.Occurrence)] = !occurrence.Skipped
+		}
+
+		for _, date := range schedule.occurrences(today, today.AddDate(0, 0, days)) {
+			upcoming = append(upcoming, &UpcomingOccurrenceResponse{
+				ScheduleID: schedule.ID,
+				TemplateID: schedule.TemplateID,
+				Date:       date,
+				Posted:     posted[date],
+			})
+		}
+	}
+	start, end, info := page.paginate(upcoming, func(i int) Cursor { return Cursor{Key: timeKey(upcoming[i].Date), ID: upcoming[i].ScheduleID} }, false)
+	setPageHeaders(w, r, page, info)
+
+	list := []render.Renderer{}
+	for _, occurrence := range upcoming[start:end] {
+		list = append(list, occurrence)
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// ScheduleRequest is the request payload for Schedule data model.
+type ScheduleRequest struct {
+	*Schedule
+}
+
+func (a *ScheduleRequest) Bind(r *http.Request) error {
+	if a.Schedule == nil {
+		return errors.New("missing required Schedule fields")
+	}
+	if err := validate(getStore(r), a.Schedule); err != nil {
+		return err
+	}
+	if a.Rule != ruleMonthly {
+		a.Day = 0
+	}
+	a.Start = dayOf(a.Start)
+	return nil
+}
+
+// ScheduleResponse is the response payload for the Schedule data model.
+type ScheduleResponse struct {
+	*Schedule
+}
+
+func newScheduleResponse(schedule *Schedule) *ScheduleResponse {
+	return &ScheduleResponse{Schedule: schedule}
+}
+
+func (rd *ScheduleResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+func newScheduleListResponse(schedules []*Schedule) []render.Renderer {
+	list := []render.Renderer{}
+	for _, schedule := range schedules {
+		list = append(list, newScheduleResponse(schedule))
+	}
+	return list
+}
+
+// UpcomingOccurrenceResponse is one date a Schedule will post its Template.
+type UpcomingOccurrenceResponse struct {
+	ScheduleID int       `json:"scheduleID"`
+	TemplateID int       `json:"tid"`
+	Date       time.Time `json:"date"`
+	Posted     bool      `json:"posted"`
+}
+
+func (rd *UpcomingOccurrenceResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScheduleOccurrences(t *testing.T) {
+	tests := []struct {
+		schedule Schedule
+		from, to string
+		want     []string
+	}{
+		{Schedule{Rule: ruleWeekly, Start: day("2026-03-02")}, "2026-03-01", "2026-03-23", []string{"2026-03-02", "2026-03-09", "2026-03-16", "2026-03-23"}},
+		{Schedule{Rule: ruleWeekly, Start: day("2026-03-02")}, "2026-03-10", "2026-03-22", []string{"2026-03-16"}},
+		{Schedule{Rule: ruleBiweekly, Start: day("2026-03-02")}, "2026-03-03", "2026-04-13", []string{"2026-03-16", "2026-03-30", "2026-04-13"}},
+		{Schedule{Rule: ruleSemimonthly, Start: day("2026-01-10")}, "2026-01-01", "2026-02-28", []string{"2026-01-15", "2026-02-01", "2026-02-15"}},
+		{Schedule{Rule: ruleMonthly, Day: 31, Start: day("2026-01-01")}, "2026-01-01", "2026-04-30", []string{"2026-01-31", "2026-02-28", "2026-03-31", "2026-04-30"}},
+		{Schedule{Rule: ruleMonthly, Day: 15, Start: day("2026-01-20")}, "2026-01-01", "2026-03-14", []string{"2026-02-15"}},
+		{Schedule{Rule: ruleLastBusinessDay, Start: day("2026-01-01")}, "2026-05-01", "2026-08-31", []string{"2026-05-29", "2026-06-30", "2026-07-31", "2026-08-31"}},
+		{Schedule{Rule: ruleWeekly, Start: day("2026-03-02")}, "2026-03-03", "2026-03-08", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, date := range tt.schedule.occurrences(day(tt.from), day(tt.to)) {
+			got = append(got, date.Format("2006-01-02"))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s from %s: occurrences(%s, %s) = %v, want %v", tt.schedule.Rule, tt.schedule.Start.Format("2006-01-02"), tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestPostSchedule(t *testing.T) {
+	tests := []struct {
+		name    string
+		catchUp time.Duration
+		skipped int
+		posted  int
+	}{
+		{"all caught up", 60 * 24 * time.Hour, 0, 5},
+		{"older ones skipped", 10 * 24 * time.Hour, 3, 2},
+		{"all skipped", 0, 4, 1},
+	}
+	for _, tt := range tests {
+		store := newSeededStore(t)
+		schedule := &Schedule{TemplateID: 1, Rule: ruleWeekly, Start: day("2026-03-02")}
+		if err := store.NewSchedule(schedule); err != nil {
+			t.Fatal(err)
+		}
+		now := day("2026-03-30").Add(12 * time.Hour)
+
+		// Posting again finds nothing left to do.
+		for i := 0; i < 2; i++ {
+			if err := postSchedule(store, schedule, now, tt.catchUp); err != nil {
+				t.Fatalf("%s: postSchedule: %v", tt.name, err)
+			}
+		}
+		occurrences, err := store.GetScheduleOccurrences(schedule.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		skipped, posted := 0, 0
+		for _, occurrence := range occurrences {
+			if occurrence.Skipped {
+				skipped++
+			} else {
+				posted++
+			}
+		}
+		if skipped != tt.skipped || posted != tt.posted {
+			t.Errorf("%s: %d skipped and %d posted, want %d and %d", tt.name, skipped, posted, tt.skipped, tt.posted)
+		}
+		if len(store.bucketItems) != 1+tt.posted {
+			t.Errorf("%s: %d bucket items stored, want %d", tt.name, len(store.bucketItems), 1+tt.posted)
+		}
+	}
+}
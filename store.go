@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Store is the persistence layer behind the http handlers. Every backend
+// (SQL Server, SQLite, PostgreSQL, memory) implements it so the handlers never need to know
+// which database they are talking to.
+type Store interface {
+	Seed() error
+	Close() error
+
+	SummarizeBuckets() ([]BucketSummary, error)
+	GetBucketDailyTotals(filter DailyTotalFilter) ([]BucketDailyTotal, error)
+
+	NewBucketItem(bucketItem *BucketItem) error
+	NewBucketItems(bucketItems []*BucketItem) error
+	GetBucketItems(filter BucketItemFilter, page Page) ([]*BucketItem, PageInfo, error) // sorted as filter asks, with their Balance
+	GetBucketItem(id int) (*BucketItem, error)
+	UpdateBucketItem(id int, bucketItem *BucketItem) error
+	RemoveBucketItem(id int) error // moves it to the trash
+	GetDeletedBucketItems() ([]*BucketItem, error)
+	RestoreBucketItem(id int) error
+
+	NewBucket(bucket *Bucket) error
+	GetBuckets() ([]*Bucket, error)
+	GetBucket(id int) (*Bucket, error)
+	UpdateBucket(id int, bucket *Bucket) error
+	RemoveBucket(id int, opts RemoveOptions) ([]Change, error)
+	SetBucketArchived(id int, archived bool) error
+
+	NewCategory(category *Category) error
+	GetCategories() ([]*Category, error)
+	GetCategory(id int) (*Category, error)
+	UpdateCategory(id int, category *Category) error
+	RemoveCategory(id int, opts RemoveOptions) ([]Change, error)
+	SetCategoryArchived(id int, archived bool) error
+
+	NewTemplate(template *Template) error
+	GetTemplates() ([]*Template, error)
+	GetTemplate(id int) (*Template, error)
+	UpdateTemplate(id int, template *Template) error
+	RemoveTemplate(id int, opts RemoveOptions) ([]Change, error)
+
+	NewTemplateItem(templateItem *TemplateItem) error
+	GetTemplateItems(page Page) ([]*TemplateItem, PageInfo, error) // by id
+	GetTemplateItemsByTemplate(templateID int) ([]*TemplateItem, error)
+	SearchTemplateItems(templateID int, bucketID int, inName string) ([]*TemplateItem, error)
+	ReorderTemplateItems(templateID int, ids []int) error
+	GetTemplateItem(id int) (*TemplateItem, error)
+	UpdateTemplateItem(id int, templateItem *TemplateItem) error
+	RemoveTemplateItem(id int) error
+
+	NewTransfer(transfer *Transfer) error
+	GetTransfers(page Page) ([]*Transfer, PageInfo, error) // newest first, unless in the trash
+	GetTransfersByID(ids []int) ([]*Transfer, error)
+	GetTransfer(id int) (*Transfer, error)
+	UpdateTransfer(id int, transfer *Transfer) error
+	GetTransferBucketItems(id int) ([]*BucketItem, error) // both bucket items, unless in the trash
+	RemoveTransfer(id int) error                          // moves it to the trash, both bucket items included
+	GetDeletedTransfers() ([]*Transfer, error)
+	RestoreTransfer(id int) error
+
+	PurgeTrash(deletedBefore time.Time) error
+
+	NewAuditEntry(entry *AuditEntry) error
+	GetAuditEntries(filter AuditFilter, page Page) ([]*AuditEntry, PageInfo, error) // newest first
+
+	NewSchedule(schedule *Schedule) error
+	GetSchedules() ([]*Schedule, error)
+	GetSchedule(id int) (*Schedule, error)
+	UpdateSchedule(id int, schedule *Schedule) error
+	RemoveSchedule(id int) error
+	GetScheduleOccurrences(scheduleID int) ([]*ScheduleOccurrence, error)
+	PostScheduleOccurrence(occurrence *ScheduleOccurrence, bucketItems []*BucketItem) error
+
+	NewExchangeRate(exchangeRate *ExchangeRate) error
+	GetExchangeRates() ([]*ExchangeRate, error)
+	GetExchangeRate(id int) (*ExchangeRate, error)
+	UpdateExchangeRate(id int, exchangeRate *ExchangeRate) error
+	RemoveExchangeRate(id int) error
+}
+
+// ErrVersionConflict refuses an update made to a record that has changed
+// since it was read. Every Update method only writes while the stored
+// record is still at the Version of the one passed in, and moves it on to
+// the next version.
+var ErrVersionConflict = errors.New("the record was changed by someone else, reload it and try again")
+
+// RemoveOptions says what happens to the records depending on a bucket,
+// category or template being removed. With neither option set the removal
+// is refused while there are dependents.
+type RemoveOptions struct {
+	Cascade    bool // remove the dependents along with it
+	ReassignTo int  // move the dependents to this bucket, category or template first
+}
+
+// removeOptions reads ?cascade=true or ?reassignTo={id} off the request.
+func removeOptions(r *http.Request) (RemoveOptions, error) {
+	var opts RemoveOptions
+	qs := r.URL.Query()
+	opts.Cascade = qs.Get("cascade") == "true"
+	if reassignTo := qs.Get("reassignTo"); reassignTo != "" {
+		id, err := strconv.Atoi(reassignTo)
+		if err != nil || id <= 0 {
+			return opts, fmt.Errorf("invalid reassignTo %q", reassignTo)
+		}
+		opts.ReassignTo = id
+	}
+	if opts.Cascade && opts.ReassignTo != 0 {
+		return opts, errors.New("use either cascade or reassignTo, not both")
+	}
+	return opts, nil
+}
+
+// Dependents counts the records depending on another, by kind.
+type Dependents map[string]int
+
+// DependentsError refuses to remove a record that others still depend on.
+type DependentsError struct {
+	Resource   string
+	ID         int
+	Dependents Dependents
+}
+
+func (e *DependentsError) Error() string {
+	var kinds []string
+	for kind := range e.Dependents {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for i, kind := range kinds {
+		kinds[i] = fmt.Sprintf("%d %s", e.Dependents[kind], kind)
+	}
+	return fmt.Sprintf("%s %d still has %s; delete with ?cascade=true or ?reassignTo={id}",
+		e.Resource, e.ID, strings.Join(kinds, ", "))
+}
+
+// Change is a record a removal deleted or moved along with the one it was
+// asked to remove, as it was Before and is After; After is nil once deleted.
+type Change struct {
+	Resource string // one of the audit resources
+	ID       int
+	Before   interface{}
+	After    interface{}
+}
+
+// newStore returns the Store for the named driver ("mssql", "sqlite",
+// "postgres" or "memory").
+func newStore(driver string) (Store, error) {
+	switch driver {
+	case "mssql":
+		return newMssqlStore()
+	case "sqlite":
+		return newSqliteStore()
+	case "postgres":
+		return newPostgresStore()
+	case "memory":
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown DB_DRIVER %q", driver)
+}
+
+// StoreCtx middleware places the Store on the request context so the
+// handlers further down the chain can reach it through getStore.
+func StoreCtx(store Store) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), "store", store)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// getStore returns the Store loaded by the StoreCtx middleware.
+func getStore(r *http.Request) Store {
+	return r.Context().Value("store").(Store)
+}
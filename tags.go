@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Limits on the tags of one bucket item.
+const (
+	maxTags      = 10
+	maxTagLength = 30
+)
+
+// Tags label a bucket item, such as "groceries" or "vacation-2020". They
+// are kept in lower case, sorted and without duplicates, and stored in one
+// column as ",groceries,vacation-2020," so that a LIKE '%,groceries,%'
+// finds the items carrying a tag.
+type Tags []string
+
+// normalizeTags trims and lower-cases tags, and drops blank and duplicate
+// ones.
+func normalizeTags(tags []string) Tags {
+	seen := map[string]bool{}
+	var normalized Tags
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// check reports tags that can't be stored to e, as problems with field.
+func (t Tags) check(field string, e *ValidationError) {
+	if len(t) > maxTags {
+		e.add(field, codeTooLong, "%s must be at most %d tags", field, maxTags)
+	}
+	for _, tag := range t {
+		if strings.Contains(tag, ",") {
+			e.add(field, codeInvalid, "%s must not contain commas", field)
+		} else if len([]rune(tag)) > maxTagLength {
+			e.add(field, codeTooLong, "%s must be at most %d characters each", field, maxTagLength)
+		}
+	}
+}
+
+// UnmarshalJSON reads a list of tags and normalizes it.
+func (t *Tags) UnmarshalJSON(data []byte) error {
+	var tags []string
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return err
+	}
+	*t = normalizeTags(tags)
+	return nil
+}
+
+// Scan reads the ",a,b," column text back into tags.
+func (t *Tags) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into Tags", src)
+	}
+	*t = nil
+	for _, tag := range strings.Split(s, ",") {
+		if tag != "" {
+			*t = append(*t, tag)
+		}
+	}
+	return nil
+}
+
+// Value stores t as ",a,b,", or NULL without tags.
+func (t Tags) Value() (driver.Value, error) {
+	if len(t) == 0 {
+		return nil, nil
+	}
+	return "," + strings.Join(t, ",") + ",", nil
+}
+
+// has reports whether t holds tag.
+func (t Tags) has(tag string) bool {
+	return containsString(t, tag)
+}
@@ -2,28 +2,38 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
-	"strconv"
 	"strings"
+	"time"
 
-	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 )
 
 type Template struct {
-	Name string `db:"name" json:"name"`
-	Id   int    `db:"id,omitempty" json:"id"`
+	Name    string `db:"name" json:"name" validate:"required,maxlen=100"`
+	Id      int    `db:"id,omitempty" json:"id"`
+	Version int    `db:"version,omitempty" json:"version"` // bumped by every update, sent as the ETag
 }
 
 // listTemplates lists out all the Templates
 func listTemplates(w http.ResponseWriter, r *http.Request) {
-	templates, err := dbGetTemplates()
+	page, err := pageFromRequest(r)
 	if err != nil {
-		render.Render(w, r, ErrRender(err))
+		render.Render(w, r, ErrInvalidRequest(err))
 		return
 	}
 
-	if err = render.RenderList(w, r, newTemplateListResponse(templates)); err != nil {
+	templates, err := getStore(r).GetTemplates()
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+
+	start, end, info := page.paginate(templates, func(i int) Cursor { return Cursor{ID: templates[i].Id} }, false)
+	setPageHeaders(w, r, page, info)
+	if err = render.RenderList(w, r, newTemplateListResponse(templates[start:end])); err != nil {
 		render.Render(w, r, ErrRender(err))
 		return
 	}
@@ -34,18 +44,14 @@ func listTemplates(w http.ResponseWriter, r *http.Request) {
 // the Template could not be found, we stop here and return a 404.
 func TemplateCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var template *Template
-		var err error
-
-		if templateStr := chi.URLParam(r, "templateID"); templateStr != "" {
-			templateID, _ := strconv.Atoi(templateStr)
-			template, err = dbGetTemplate(templateID)
-		} else {
-			render.Render(w, r, ErrNotFound)
+		templateID, ok := urlParamID(r, "templateID")
+		if !ok {
+			render.Render(w, r, ErrInvalidID("templateID"))
 			return
 		}
+		template, err := getStore(r).GetTemplate(templateID)
 		if err != nil {
-			render.Render(w, r, ErrNotFound)
+			render.Render(w, r, ErrStore(err))
 			return
 		}
 
@@ -64,10 +70,11 @@ func createTemplate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	template := data.Template
-	if err := dbNewTemplate(template); err != nil {
-		render.Render(w, r, ErrInvalidRequest(err))
+	if err := getStore(r).NewTemplate(template); err != nil {
+		render.Render(w, r, ErrUpdate(err))
 		return
 	}
+	recordAudit(r, auditTemplate, template.Id, auditCreate, nil, snapshot(template))
 
 	render.Status(r, http.StatusCreated)
 	render.Render(w, r, newTemplateResponse(template))
@@ -82,8 +89,28 @@ func getTemplate(w http.ResponseWriter, r *http.Request) {
 	// context because this handler is a child of the TemplateCtx
 	// middleware. The worst case, the recoverer middleware will save us.
 	template := r.Context().Value("template").(*Template)
+	response := newTemplateResponse(template)
 
-	if err := render.Render(w, r, newTemplateResponse(template)); err != nil {
+	// GET /templates/123?expand=items includes the items and their net.
+	if r.URL.Query().Get("expand") == "items" {
+		templateItems, err := getStore(r).GetTemplateItemsByTemplate(template.Id)
+		if err != nil {
+			render.Render(w, r, ErrStore(err))
+			return
+		}
+		var net Money
+		for _, templateItem := range templateItems {
+			net += templateItem.Deposit - templateItem.Withdraw
+		}
+		response.Items = templateItems
+		response.Net = &net
+	} else {
+		// The items change without the template's version moving on, so
+		// the expanded response is left to ConditionalGet to tag.
+		setETag(w, template.Version)
+	}
+
+	if err := render.Render(w, r, response); err != nil {
 		render.Render(w, r, ErrRender(err))
 		return
 	}
@@ -92,18 +119,31 @@ func getTemplate(w http.ResponseWriter, r *http.Request) {
 // updateTemplate updates an existing Template in our persistent store.
 func updateTemplate(w http.ResponseWriter, r *http.Request) {
 	template := r.Context().Value("template").(*Template)
+	if !checkIfMatch(w, r, template.Version) {
+		return
+	}
+	templateID, version := template.Id, template.Version
+	before := snapshot(template)
 
 	data := &TemplateRequest{Template: template}
-	if err := render.Bind(r, data); err != nil {
+	if err := bindUpdate(r, template, data); err != nil {
 		render.Render(w, r, ErrInvalidRequest(err))
 		return
 	}
 	template = data.Template
-	dbUpdateTemplate(template.Id, template)
+	template.Version = version
+	if err := getStore(r).UpdateTemplate(templateID, template); err != nil {
+		render.Render(w, r, ErrUpdate(err))
+		return
+	}
+	recordAudit(r, auditTemplate, templateID, auditUpdate, before, snapshot(template))
 
+	setETag(w, template.Version)
 	render.Render(w, r, newTemplateResponse(template))
 }
 
+// deleteTemplate removes the Template, refusing with a 409 while anything depends
+// on it unless ?cascade=true or ?reassignTo={id} says what to do with that.
 func deleteTemplate(w http.ResponseWriter, r *http.Request) {
 	var err error
 
@@ -111,16 +151,136 @@ func deleteTemplate(w http.ResponseWriter, r *http.Request) {
 	// context because this handler is a child of the TemplateCtx
 	// middleware. The worst case, the recoverer middleware will save us.
 	template := r.Context().Value("template").(*Template)
+	if !checkIfMatch(w, r, template.Version) {
+		return
+	}
 
-	err = dbRemoveTemplate(template.Id)
+	opts, err := removeOptions(r)
 	if err != nil {
 		render.Render(w, r, ErrInvalidRequest(err))
 		return
 	}
+	changes, err := getStore(r).RemoveTemplate(template.Id, opts)
+	if err != nil {
+		render.Render(w, r, ErrRemove(err))
+		return
+	}
+	recordChanges(r, changes)
+	recordAudit(r, auditTemplate, template.Id, auditDelete, snapshot(template), nil)
 
 	render.Render(w, r, newTemplateResponse(template))
 }
 
+// applyTemplate posts every TemplateItem of the Template as a BucketItem
+// dated on the requested transaction, all or nothing. With ?dryRun=true the
+// items are only built and returned, nothing is stored.
+func applyTemplate(w http.ResponseWriter, r *http.Request) {
+	template := r.Context().Value("template").(*Template)
+
+	data := &TemplateApplyRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	templateItems, err := getStore(r).GetTemplateItemsByTemplate(template.Id)
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+	bucketItems, err := data.bucketItems(templateItems)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if itemErrors := validateBucketItems(getStore(r), bucketItems); len(itemErrors) > 0 {
+		render.Render(w, r, ErrInvalidBatch(itemErrors))
+		return
+	}
+
+	if r.URL.Query().Get("dryRun") == "true" {
+		render.Render(w, r, &BucketItemsResponse{Count: len(bucketItems), Items: bucketItems, DryRun: true})
+		return
+	}
+	if err := getStore(r).NewBucketItems(bucketItems); err != nil {
+		render.Render(w, r, ErrUpdate(err))
+		return
+	}
+	for _, bucketItem := range bucketItems {
+		recordAudit(r, auditBucketItem, bucketItem.ID, auditCreate, nil, snapshot(bucketItem))
+	}
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, &BucketItemsResponse{Count: len(bucketItems), Items: bucketItems})
+}
+
+// TemplateApplyRequest is the request payload for applying a Template.
+// Scale multiplies every amount, e.g. "0.5" for half a paycheck; Overrides
+// replace or skip single template items.
+type TemplateApplyRequest struct {
+	Transaction time.Time              `json:"transaction" validate:"required"`
+	Scale       *Rate                  `json:"scale" validate:"positive"`
+	Overrides   []TemplateItemOverride `json:"overrides" validate:"dive"`
+}
+
+// TemplateItemOverride changes how one TemplateItem is posted.
+type TemplateItemOverride struct {
+	TemplateItemID int    `json:"id" validate:"required"`
+	Deposit        *Money `json:"d" validate:"min=0"`
+	Withdraw       *Money `json:"w" validate:"min=0"`
+	Skip           bool   `json:"skip"`
+}
+
+func (a *TemplateApplyRequest) Bind(r *http.Request) error {
+	return validate(getStore(r), a)
+}
+
+// bucketItems builds the BucketItems posting templateItems, scaled first
+// and then overridden.
+func (a *TemplateApplyRequest) bucketItems(templateItems []*TemplateItem) ([]*BucketItem, error) {
+	known := map[int]bool{}
+	for _, templateItem := range templateItems {
+		known[templateItem.ID] = true
+	}
+	overrides := map[int]TemplateItemOverride{}
+	for _, override := range a.Overrides {
+		if !known[override.TemplateItemID] {
+			return nil, fmt.Errorf("template item %d is not part of this template", override.TemplateItemID)
+		}
+		overrides[override.TemplateItemID] = override
+	}
+
+	var bucketItems []*BucketItem
+	for _, templateItem := range templateItems {
+		bucketItem := &BucketItem{
+			BucketID:    templateItem.BucketID,
+			Name:        templateItem.Name,
+			Transaction: a.Transaction,
+			Deposit:     templateItem.Deposit,
+			Withdraw:    templateItem.Withdraw,
+		}
+		if a.Scale != nil {
+			bucketItem.Deposit = bucketItem.Deposit.Convert(*a.Scale)
+			bucketItem.Withdraw = bucketItem.Withdraw.Convert(*a.Scale)
+		}
+		if override, ok := overrides[templateItem.ID]; ok {
+			if override.Skip {
+				continue
+			}
+			if override.Deposit != nil {
+				bucketItem.Deposit = *override.Deposit
+			}
+			if override.Withdraw != nil {
+				bucketItem.Withdraw = *override.Withdraw
+			}
+		}
+		bucketItems = append(bucketItems, bucketItem)
+	}
+	if len(bucketItems) == 0 {
+		return nil, errors.New("template has no items to apply")
+	}
+	return bucketItems, nil
+}
+
 // TemplateRequest is the request payload for Template data model.
 //
 // NOTE: It's good practice to have well defined request and response payloads
@@ -137,9 +297,12 @@ type TemplateRequest struct {
 
 func (a *TemplateRequest) Bind(r *http.Request) error {
 	// just a post-process after a decode..
-	a.ProtectedID = ""                                 // unset the protected ID
+	a.ProtectedID = "" // unset the protected ID
+	if a.Template == nil {
+		return errors.New("missing required Template fields")
+	}
 	a.Template.Name = strings.ToLower(a.Template.Name) // as an example, we down-case
-	return nil
+	return validate(getStore(r), a.Template)
 }
 
 // TemplateResponse is the response payload for the Template data model.
@@ -153,6 +316,9 @@ type TemplateResponse struct {
 	// We add an additional field to the response here.. such as this
 	// elapsed computed property
 	Elapsed int64 `json:"elapsed"`
+
+	Items []*TemplateItem `json:"items,omitempty"` // with ?expand=items
+	Net   *Money          `json:"net,omitempty"`   // deposits less withdraws of Items
 }
 
 func newTemplateResponse(template *Template) *TemplateResponse {
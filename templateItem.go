@@ -2,22 +2,37 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 
-	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 )
 
+// templateItemCursor is the place of templateItem in the list of template
+// items, by id.
+func templateItemCursor(templateItem *TemplateItem) Cursor {
+	return Cursor{ID: templateItem.ID}
+}
+
 // listTemplateItems lists out all the TemplateItems
 func listTemplateItems(w http.ResponseWriter, r *http.Request) {
-	templateItems, err := dbGetTemplateItems()
+	page, err := pageFromRequest(r)
 	if err != nil {
-		render.Render(w, r, ErrRender(err))
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	templateItems, info, err := getStore(r).GetTemplateItems(page)
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
 		return
 	}
 
+	setPageHeaders(w, r, page, info)
 	if err := render.RenderList(w, r, newTemplateItemListResponse(templateItems)); err != nil {
 		render.Render(w, r, ErrRender(err))
 		return
@@ -29,19 +44,14 @@ func listTemplateItems(w http.ResponseWriter, r *http.Request) {
 // the TemplateItem could not be found, we stop here and return a 404.
 func TemplateItemCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var templateItem *TemplateItem
-		var err error
-		var templateItemID int
-
-		if templateItemStr := chi.URLParam(r, "templateItemID"); templateItemStr != "" {
-			templateItemID, err = strconv.Atoi(templateItemStr)
-			templateItem, err = dbGetTemplateItem(templateItemID)
-		} else {
-			render.Render(w, r, ErrNotFound)
+		templateItemID, ok := urlParamID(r, "templateItemID")
+		if !ok {
+			render.Render(w, r, ErrInvalidID("templateItemID"))
 			return
 		}
+		templateItem, err := getStore(r).GetTemplateItem(templateItemID)
 		if err != nil {
-			render.Render(w, r, ErrNotFound)
+			render.Render(w, r, ErrStore(err))
 			return
 		}
 
@@ -50,9 +60,142 @@ func TemplateItemCtx(next http.Handler) http.Handler {
 	})
 }
 
+// searchTemplateItems lists the TemplateItems matching the template (tid),
+// bucket (bid) and part of the name (namePart) given.
 func searchTemplateItems(w http.ResponseWriter, r *http.Request) {
-	templateItems, _ := dbGetTemplateItems()
-	render.RenderList(w, r, newTemplateItemListResponse(templateItems))
+	page, err := pageFromRequest(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	qs := r.URL.Query()
+	templateID, err := queryID(qs, "tid")
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	bucketID, err := queryID(qs, "bid")
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	inName := qs.Get("namePart")
+
+	templateItems, err := getStore(r).SearchTemplateItems(templateID, bucketID, inName)
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+
+	start, end, info := page.paginate(templateItems, func(i int) Cursor {
+		return Cursor{Key: fmt.Sprintf("%010d.%010d", templateItems[i].TemplateID, templateItems[i].Position), ID: templateItems[i].ID}
+	}, false)
+	setPageHeaders(w, r, page, info)
+	if err := render.RenderList(w, r, newTemplateItemListResponse(templateItems[start:end])); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// queryID reads the id in the query parameter name, or 0 without one.
+func queryID(qs url.Values, name string) (int, error) {
+	value := qs.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("%s must be an id such as 1", name)
+	}
+	return id, nil
+}
+
+// listTemplateItemsByTemplate lists the items of the Template loaded by
+// TemplateCtx, in order.
+func listTemplateItemsByTemplate(w http.ResponseWriter, r *http.Request) {
+	page, err := pageFromRequest(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	template := r.Context().Value("template").(*Template)
+
+	templateItems, err := getStore(r).GetTemplateItemsByTemplate(template.Id)
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+
+	start, end, info := page.paginate(templateItems, func(i int) Cursor {
+		return Cursor{Key: fmt.Sprintf("%010d", templateItems[i].Position), ID: templateItems[i].ID}
+	}, false)
+	setPageHeaders(w, r, page, info)
+	if err := render.RenderList(w, r, newTemplateItemListResponse(templateItems[start:end])); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// createTemplateItemInTemplate adds the posted TemplateItem to the Template
+// loaded by TemplateCtx, after its other items; TemplateItemRequest.Bind
+// takes the template off the context.
+func createTemplateItemInTemplate(w http.ResponseWriter, r *http.Request) {
+	data := &TemplateItemRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	templateItem := data.TemplateItem
+	if err := getStore(r).NewTemplateItem(templateItem); err != nil {
+		render.Render(w, r, ErrUpdate(err))
+		return
+	}
+	recordAudit(r, auditTemplateItem, templateItem.ID, auditCreate, nil, snapshot(templateItem))
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, newTemplateItemResponse(templateItem))
+}
+
+// reorderTemplateItems puts the items of the Template loaded by TemplateCtx
+// in the posted order. Every item of the template must be listed once.
+func reorderTemplateItems(w http.ResponseWriter, r *http.Request) {
+	template := r.Context().Value("template").(*Template)
+
+	data := &TemplateItemOrderRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	templateItems, err := getStore(r).GetTemplateItemsByTemplate(template.Id)
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+	if err := data.matches(templateItems); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if err := getStore(r).ReorderTemplateItems(template.Id, data.IDs); err != nil {
+		render.Render(w, r, ErrUpdate(err))
+		return
+	}
+	positions := map[int]int{}
+	for i, id := range data.IDs {
+		positions[id] = i + 1
+	}
+	for _, templateItem := range templateItems {
+		if position := positions[templateItem.ID]; position != templateItem.Position {
+			before := snapshot(templateItem)
+			templateItem.Position = position
+			recordAudit(r, auditTemplateItem, templateItem.ID, auditUpdate, before, snapshot(templateItem))
+		}
+	}
+
+	listTemplateItemsByTemplate(w, r)
 }
 
 // createTemplateItem persists the posted TemplateItem and returns it
@@ -65,7 +208,11 @@ func createTemplateItem(w http.ResponseWriter, r *http.Request) {
 	}
 
 	templateItem := data.TemplateItem
-	dbNewTemplateItem(templateItem)
+	if err := getStore(r).NewTemplateItem(templateItem); err != nil {
+		render.Render(w, r, ErrUpdate(err))
+		return
+	}
+	recordAudit(r, auditTemplateItem, templateItem.ID, auditCreate, nil, snapshot(templateItem))
 
 	render.Status(r, http.StatusCreated)
 	render.Render(w, r, newTemplateItemResponse(templateItem))
@@ -81,6 +228,7 @@ func getTemplateItem(w http.ResponseWriter, r *http.Request) {
 	// middleware. The worst case, the recoverer middleware will save us.
 	templateItem := r.Context().Value("templateItem").(*TemplateItem)
 
+	setETag(w, templateItem.Version)
 	if err := render.Render(w, r, newTemplateItemResponse(templateItem)); err != nil {
 		render.Render(w, r, ErrRender(err))
 		return
@@ -90,15 +238,26 @@ func getTemplateItem(w http.ResponseWriter, r *http.Request) {
 // updateTemplateItem updates an existing TemplateItem in our persistent store.
 func updateTemplateItem(w http.ResponseWriter, r *http.Request) {
 	templateItem := r.Context().Value("templateItem").(*TemplateItem)
+	if !checkIfMatch(w, r, templateItem.Version) {
+		return
+	}
+	templateItemID, version := templateItem.ID, templateItem.Version
+	before := snapshot(templateItem)
 
 	data := &TemplateItemRequest{TemplateItem: templateItem}
-	if err := render.Bind(r, data); err != nil {
+	if err := bindUpdate(r, templateItem, data); err != nil {
 		render.Render(w, r, ErrInvalidRequest(err))
 		return
 	}
 	templateItem = data.TemplateItem
-	dbUpdateTemplateItem(templateItem.ID, templateItem)
+	templateItem.Version = version
+	if err := getStore(r).UpdateTemplateItem(templateItemID, templateItem); err != nil {
+		render.Render(w, r, ErrUpdate(err))
+		return
+	}
+	recordAudit(r, auditTemplateItem, templateItemID, auditUpdate, before, snapshot(templateItem))
 
+	setETag(w, templateItem.Version)
 	render.Render(w, r, newTemplateItemResponse(templateItem))
 }
 
@@ -109,23 +268,29 @@ func deleteTemplateItem(w http.ResponseWriter, r *http.Request) {
 	// context because this handler is a child of the TemplateItemCtx
 	// middleware. The worst case, the recoverer middleware will save us.
 	templateItem := r.Context().Value("templateItem").(*TemplateItem)
+	if !checkIfMatch(w, r, templateItem.Version) {
+		return
+	}
 
-	err = dbRemoveTemplateItem(templateItem.ID)
+	err = getStore(r).RemoveTemplateItem(templateItem.ID)
 	if err != nil {
-		render.Render(w, r, ErrInvalidRequest(err))
+		render.Render(w, r, ErrUpdate(err))
 		return
 	}
+	recordAudit(r, auditTemplateItem, templateItem.ID, auditDelete, snapshot(templateItem), nil)
 
 	render.Render(w, r, newTemplateItemResponse(templateItem))
 }
 
 type TemplateItem struct {
-	ID         int     `db:"id,omitempty" json:"id"`
-	TemplateID int     `db:"templateID" json:"tid"`
-	BucketID   int     `db:"bucketID" json:"bid"`
-	Name       string  `db:"name" json:"name"`
-	Deposit    float32 `db:"deposit" json:"d"`
-	Withdraw   float32 `db:"withdraw" json:"w"`
+	ID         int    `db:"id,omitempty" json:"id"`
+	TemplateID int    `db:"templateID" json:"tid" validate:"required,ref=template"`
+	BucketID   int    `db:"bucketID" json:"bid" validate:"required,ref=bucket"`
+	Name       string `db:"name" json:"name" validate:"required,maxlen=100"`
+	Deposit    Money  `db:"deposit" json:"d" validate:"min=0"`
+	Withdraw   Money  `db:"withdraw" json:"w" validate:"min=0"`
+	Position   int    `db:"position" json:"pos"`              // order within the template, from 1
+	Version    int    `db:"version,omitempty" json:"version"` // bumped by every update, sent as the ETag
 }
 
 // TemplateItemRequest is the request payload for TemplateItem data model.
@@ -144,8 +309,45 @@ type TemplateItemRequest struct {
 
 func (a *TemplateItemRequest) Bind(r *http.Request) error {
 	// just a post-process after a decode..
-	a.ProtectedID = ""                                         // unset the protected ID
+	a.ProtectedID = "" // unset the protected ID
+	if a.TemplateItem == nil {
+		return errors.New("missing required TemplateItem fields")
+	}
 	a.TemplateItem.Name = strings.ToLower(a.TemplateItem.Name) // as an example, we down-case
+	// Items posted to /templates/123/items belong to that template.
+	if template, ok := r.Context().Value("template").(*Template); ok {
+		a.TemplateItem.TemplateID = template.Id
+	}
+	return validate(getStore(r), a.TemplateItem)
+}
+
+// TemplateItemOrderRequest lists the IDs of a template's items in their new
+// order.
+type TemplateItemOrderRequest struct {
+	IDs []int `json:"ids" validate:"required"`
+}
+
+func (a *TemplateItemOrderRequest) Bind(r *http.Request) error {
+	return validate(getStore(r), a)
+}
+
+// matches checks IDs lists every one of templateItems exactly once.
+func (a *TemplateItemOrderRequest) matches(templateItems []*TemplateItem) error {
+	listed := map[int]bool{}
+	for _, id := range a.IDs {
+		if listed[id] {
+			return fmt.Errorf("template item %d is listed twice", id)
+		}
+		listed[id] = true
+	}
+	for _, templateItem := range templateItems {
+		if !listed[templateItem.ID] {
+			return fmt.Errorf("template item %d is missing", templateItem.ID)
+		}
+	}
+	if len(a.IDs) != len(templateItems) {
+		return errors.New("ids lists items that are not part of this template")
+	}
 	return nil
 }
 
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// newTemplateItemStore returns the seeded memory store with template items
+// 1 "Deposit" (bucket 1), 2 "Rent" and 3 "Car insurance" (bucket 2) in
+// template 1, and 4 "Rent share" (bucket 2) in template 2.
+func newTemplateItemStore(t *testing.T) *memoryStore {
+	t.Helper()
+	store := newSeededStore(t)
+	if err := store.NewTemplate(&Template{Name: "Shared"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, templateItem := range []*TemplateItem{
+		{Name: "Rent", BucketID: 2, TemplateID: 1, Withdraw: 90000},
+		{Name: "Car insurance", BucketID: 2, TemplateID: 1, Withdraw: 12000},
+		{Name: "Rent share", BucketID: 2, TemplateID: 2, Deposit: 45000},
+	} {
+		if err := store.NewTemplateItem(templateItem); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func templateItemIDs(templateItems []*TemplateItem) []int {
+	var ids []int
+	for _, templateItem := range templateItems {
+		ids = append(ids, templateItem.ID)
+	}
+	return ids
+}
+
+func TestSearchTemplateItems(t *testing.T) {
+	store := newTemplateItemStore(t)
+	tests := []struct {
+		templateID, bucketID int
+		inName               string
+		want                 []int
+	}{
+		{0, 0, "", []int{1, 2, 3, 4}},
+		{1, 0, "", []int{1, 2, 3}},
+		{2, 0, "", []int{4}},
+		{0, 2, "", []int{2, 3, 4}},
+		{1, 2, "", []int{2, 3}},
+		{0, 0, "rent", []int{2, 4}},
+		{0, 0, "RENT S", []int{4}},
+		{1, 1, "rent", nil},
+		{3, 0, "", nil},
+	}
+	for _, tt := range tests {
+		templateItems, err := store.SearchTemplateItems(tt.templateID, tt.bucketID, tt.inName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := templateItemIDs(templateItems); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SearchTemplateItems(%d, %d, %q) = %v, want %v", tt.templateID, tt.bucketID, tt.inName, got, tt.want)
+		}
+	}
+}
+
+func TestSearchTemplateItemsInvalid(t *testing.T) {
+	ts := newTestServer(t)
+	for _, query := range []string{"tid=abc", "bid=1.5", "tid=-1", "bid=0"} {
+		ts.expect(http.StatusBadRequest, nil, "GET", "/templateItems/search?"+query, "")
+	}
+	ts.expect(http.StatusOK, nil, "GET", "/templateItems/search?tid=1&bid=1&namePart=dep", "")
+}
+
+func TestTemplateItemOrderMatches(t *testing.T) {
+	templateItems := []*TemplateItem{{ID: 1}, {ID: 2}, {ID: 3}}
+	tests := []struct {
+		ids   []int
+		valid bool
+	}{
+		{[]int{3, 1, 2}, true},
+		{[]int{1, 2, 3}, true},
+		{[]int{1, 2}, false},
+		{[]int{1, 2, 2}, false},
+		{[]int{1, 2, 3, 4}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		err := (&TemplateItemOrderRequest{IDs: tt.ids}).matches(templateItems)
+		if valid := err == nil; valid != tt.valid {
+			t.Errorf("matches(%v) = %v, want valid %v", tt.ids, err, tt.valid)
+		}
+	}
+}
+
+func TestReorderTemplateItems(t *testing.T) {
+	tests := []struct {
+		ids     []int
+		want    []int // template 1 in order afterwards
+		invalid bool
+	}{
+		{ids: []int{3, 1, 2}, want: []int{3, 1, 2}},
+		{ids: []int{1, 2, 3}, want: []int{1, 2, 3}},
+		{ids: []int{2, 4, 3}, want: []int{1, 2, 3}, invalid: true},
+		{ids: []int{2, 99, 3}, want: []int{1, 2, 3}, invalid: true},
+	}
+	for _, tt := range tests {
+		store := newTemplateItemStore(t)
+		err := store.ReorderTemplateItems(1, tt.ids)
+		if invalid := err != nil; invalid != tt.invalid {
+			t.Errorf("ReorderTemplateItems(1, %v) = %v, want invalid %v", tt.ids, err, tt.invalid)
+		}
+		templateItems, err := store.GetTemplateItemsByTemplate(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := templateItemIDs(templateItems); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("after ReorderTemplateItems(1, %v) template 1 is %v, want %v", tt.ids, got, tt.want)
+		}
+		for i, templateItem := range templateItems {
+			if templateItem.Position != i+1 {
+				t.Errorf("after ReorderTemplateItems(1, %v) item %d is at %d, want %d", tt.ids, templateItem.ID, templateItem.Position, i+1)
+			}
+		}
+	}
+}
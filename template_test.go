@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTemplateApplyBucketItems(t *testing.T) {
+	transaction := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	templateItems := []*TemplateItem{
+		{ID: 1, Name: "Paycheck", BucketID: 1, Deposit: 200000},
+		{ID: 2, Name: "Rent", BucketID: 2, Withdraw: 90001},
+		{ID: 3, Name: "Fuel", BucketID: 1, Withdraw: 4000},
+	}
+	half := Rate(rateScale / 2)
+	money := func(m Money) *Money { return &m }
+	type amounts struct{ d, w Money }
+	tests := []struct {
+		name    string
+		request TemplateApplyRequest
+		want    map[string]amounts // by bucket item name
+		invalid bool
+	}{
+		{"as is", TemplateApplyRequest{}, map[string]amounts{"Paycheck": {200000, 0}, "Rent": {0, 90001}, "Fuel": {0, 4000}}, false},
+		{"scaled", TemplateApplyRequest{Scale: &half}, map[string]amounts{"Paycheck": {100000, 0}, "Rent": {0, 45001}, "Fuel": {0, 2000}}, false},
+		{"overridden", TemplateApplyRequest{Overrides: []TemplateItemOverride{{TemplateItemID: 3, Withdraw: money(5500)}}},
+			map[string]amounts{"Paycheck": {200000, 0}, "Rent": {0, 90001}, "Fuel": {0, 5500}}, false},
+		{"overridden after scaling", TemplateApplyRequest{Scale: &half, Overrides: []TemplateItemOverride{{TemplateItemID: 1, Deposit: money(150000)}}},
+			map[string]amounts{"Paycheck": {150000, 0}, "Rent": {0, 45001}, "Fuel": {0, 2000}}, false},
+		{"skipped", TemplateApplyRequest{Overrides: []TemplateItemOverride{{TemplateItemID: 2, Skip: true}}},
+			map[string]amounts{"Paycheck": {200000, 0}, "Fuel": {0, 4000}}, false},
+		{"all skipped", TemplateApplyRequest{Overrides: []TemplateItemOverride{{TemplateItemID: 1, Skip: true}, {TemplateItemID: 2, Skip: true}, {TemplateItemID: 3, Skip: true}}}, nil, true},
+		{"unknown override", TemplateApplyRequest{Overrides: []TemplateItemOverride{{TemplateItemID: 4, Skip: true}}}, nil, true},
+	}
+	for _, tt := range tests {
+		tt.request.Transaction = transaction
+		bucketItems, err := tt.request.bucketItems(templateItems)
+		if invalid := err != nil; invalid != tt.invalid {
+			t.Errorf("%s: bucketItems = %v, want invalid %v", tt.name, err, tt.invalid)
+			continue
+		}
+		got := map[string]amounts{}
+		for _, bucketItem := range bucketItems {
+			if !bucketItem.Transaction.Equal(transaction) {
+				t.Errorf("%s: %s dated %v, want %v", tt.name, bucketItem.Name, bucketItem.Transaction, transaction)
+			}
+			got[bucketItem.Name] = amounts{bucketItem.Deposit, bucketItem.Withdraw}
+		}
+		if !tt.invalid && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: posted %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApplyTemplate(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		stored int // bucket items afterwards
+	}{
+		{"dry run", "?dryRun=true", http.StatusOK, 1},
+		{"applied", "", http.StatusCreated, 2},
+	}
+	for _, tt := range tests {
+		store := newSeededStore(t)
+		ts := &testServer{t: t, router: newRouter(store)}
+		var response BucketItemsResponse
+		ts.expect(tt.status, &response, "POST", "/templates/1/apply"+tt.query, `{"transaction":"2026-03-01T00:00:00Z","scale":"2"}`)
+		if response.Count != 1 || len(response.Items) != 1 || response.Items[0].Deposit != 598 || response.DryRun != (tt.query != "") {
+			t.Errorf("%s: answered %+v", tt.name, response)
+		}
+		if len(store.bucketItems) != tt.stored {
+			t.Errorf("%s: %d bucket items stored, want %d", tt.name, len(store.bucketItems), tt.stored)
+		}
+	}
+}
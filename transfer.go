@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+// Transfer moves money from one bucket to another. It is stored with two
+// linked BucketItems: a withdraw of Amount from FromBucketID and a deposit
+// of ToAmount into ToBucketID. ToAmount only differs from Amount when the
+// buckets hold different currencies.
+type Transfer struct {
+	ID           int        `db:"id,omitempty" json:"id"`
+	FromBucketID int        `db:"fromBucketID" json:"from" validate:"required,ref=bucket"`
+	ToBucketID   int        `db:"toBucketID" json:"to" validate:"required,ref=bucket"`
+	Name         string     `db:"name" json:"name" validate:"required,maxlen=100"`
+	Transaction  time.Time  `db:"transaction" json:"transaction" validate:"required"`
+	Amount       Money      `db:"amount" json:"amount" validate:"positive"`
+	ToAmount     Money      `db:"toAmount" json:"toAmount" validate:"min=0"`
+	DeletedAt    *time.Time `db:"deletedAt,omitempty" json:"deletedAt,omitempty"` // set while the transfer is in the trash
+	Version      int        `db:"version,omitempty" json:"version"`               // bumped by every update, sent as the ETag
+}
+
+// withdrawLeg is the BucketItem taking the money out of FromBucketID.
+func (t *Transfer) withdrawLeg() *BucketItem {
+	transferID := t.ID
+	return &BucketItem{
+		BucketID:    t.FromBucketID,
+		Name:        t.Name,
+		Transaction: t.Transaction,
+		Withdraw:    t.Amount,
+		TransferID:  &transferID,
+		Version:     1,
+	}
+}
+
+// depositLeg is the BucketItem putting the money into ToBucketID.
+func (t *Transfer) depositLeg() *BucketItem {
+	transferID := t.ID
+	return &BucketItem{
+		BucketID:    t.ToBucketID,
+		Name:        t.Name,
+		Transaction: t.Transaction,
+		Deposit:     t.ToAmount,
+		TransferID:  &transferID,
+		Version:     1,
+	}
+}
+
+// counterpartOf returns the bucket on the other side of the transfer from
+// the given bucket item.
+func (t *Transfer) counterpartOf(bucketItem *BucketItem) int {
+	if bucketItem.Withdraw > 0 {
+		return t.ToBucketID
+	}
+	return t.FromBucketID
+}
+
+// prepareTransfer checks both buckets exist and settles ToAmount: it follows
+// Amount between buckets of the same currency and must be given otherwise.
+func prepareTransfer(store Store, transfer *Transfer) error {
+	from, err := store.GetBucket(transfer.FromBucketID)
+	if err != nil {
+		return fieldError("from", codeNotFound, "bucket %d does not exist", transfer.FromBucketID)
+	}
+	to, err := store.GetBucket(transfer.ToBucketID)
+	if err != nil {
+		return fieldError("to", codeNotFound, "bucket %d does not exist", transfer.ToBucketID)
+	}
+
+	if from.Currency == to.Currency {
+		if transfer.ToAmount != 0 && transfer.ToAmount != transfer.Amount {
+			return fieldError("toAmount", codeInvalid, "toAmount must equal amount between buckets of the same currency")
+		}
+		transfer.ToAmount = transfer.Amount
+	} else if transfer.ToAmount <= 0 {
+		return fieldError("toAmount", codeRequired, "toAmount in %s is required to transfer from %s", to.Currency, from.Currency)
+	}
+	return nil
+}
+
+// bucketItemCounterparts maps each transfer leg among bucketItems to the
+// bucket on the other side of its transfer.
+func bucketItemCounterparts(store Store, bucketItems []*BucketItem) (map[int]int, error) {
+	var transferIDs []int
+	for _, bucketItem := range bucketItems {
+		if bucketItem.TransferID != nil {
+			transferIDs = append(transferIDs, *bucketItem.TransferID)
+		}
+	}
+	counterparts := map[int]int{}
+	if len(transferIDs) == 0 {
+		return counterparts, nil
+	}
+
+	transfers, err := store.GetTransfersByID(transferIDs)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[int]*Transfer{}
+	for _, transfer := range transfers {
+		byID[transfer.ID] = transfer
+	}
+	for _, bucketItem := range bucketItems {
+		if bucketItem.TransferID == nil {
+			continue
+		}
+		if transfer, ok := byID[*bucketItem.TransferID]; ok {
+			counterparts[bucketItem.ID] = transfer.counterpartOf(bucketItem)
+		}
+	}
+	return counterparts, nil
+}
+
+// updateTransferLeg applies an edit of one transfer leg to its transfer so
+// the other leg follows along. original is the leg as it was stored; a
+// withdraw leg can't take a deposit, nor a deposit leg a withdraw.
+func updateTransferLeg(store Store, original *BucketItem, edited *BucketItem) error {
+	if original.Withdraw > 0 && edited.Deposit != 0 {
+		return fieldError("d", codeInvalid, "d must be 0 on the withdraw side of a transfer, edit w instead")
+	}
+	if original.Withdraw == 0 && edited.Withdraw != 0 {
+		return fieldError("w", codeInvalid, "w must be 0 on the deposit side of a transfer, edit d instead")
+	}
+	transfer, err := store.GetTransfer(*original.TransferID)
+	if err != nil {
+		return err
+	}
+
+	if original.Withdraw > 0 {
+		transfer.FromBucketID = edited.BucketID
+	} else {
+		transfer.ToBucketID = edited.BucketID
+	}
+	// Between buckets of one currency the edited amount carries over to the
+	// other leg; otherwise the other leg keeps its own.
+	sameCurrency := false
+	if from, err := store.GetBucket(transfer.FromBucketID); err == nil {
+		if to, err := store.GetBucket(transfer.ToBucketID); err == nil {
+			sameCurrency = from.Currency == to.Currency
+		}
+	}
+	if original.Withdraw > 0 {
+		transfer.Amount = edited.Withdraw
+		if sameCurrency {
+			transfer.ToAmount = edited.Withdraw
+		}
+	} else {
+		transfer.ToAmount = edited.Deposit
+		if sameCurrency {
+			transfer.Amount = edited.Deposit
+		}
+	}
+	transfer.Name = edited.Name
+	transfer.Transaction = edited.Transaction
+
+	if err := validate(store, transfer); err != nil {
+		return err
+	}
+	if err := prepareTransfer(store, transfer); err != nil {
+		return err
+	}
+	transferID := transfer.ID
+	transfer.ID = 0
+	return store.UpdateTransfer(transferID, transfer)
+}
+
+func (t *Transfer) checkFields(e *ValidationError) {
+	if t.FromBucketID != 0 && t.FromBucketID == t.ToBucketID {
+		e.add("to", codeInvalid, "from and to must be different buckets")
+	}
+}
+
+// transferCursor is the place of transfer in the list of transfers, newest
+// first.
+func transferCursor(transfer *Transfer) Cursor {
+	return Cursor{Key: timeKey(transfer.Transaction), ID: transfer.ID}
+}
+
+// listTransfers lists out all the Transfers
+func listTransfers(w http.ResponseWriter, r *http.Request) {
+	page, err := pageFromRequest(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	transfers, info, err := getStore(r).GetTransfers(page)
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+
+	setPageHeaders(w, r, page, info)
+	if err := render.RenderList(w, r, newTransferListResponse(transfers)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// TransferCtx middleware is used to load a Transfer object from
+// the URL parameters passed through as the request. In case
+// the Transfer could not be found, we stop here and return a 404.
+func TransferCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		transferID, ok := urlParamID(r, "transferID")
+		if !ok {
+			render.Render(w, r, ErrInvalidID("transferID"))
+			return
+		}
+		transfer, err := getStore(r).GetTransfer(transferID)
+		if err != nil {
+			render.Render(w, r, ErrStore(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "transfer", transfer)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// createTransfer posts both sides of the Transfer in one go and returns it
+// back to the client as an acknowledgement.
+func createTransfer(w http.ResponseWriter, r *http.Request) {
+	data := &TransferRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	transfer := data.Transfer
+	transfer.DeletedAt = nil
+	for field, bucketID := range map[string]int{"from": transfer.FromBucketID, "to": transfer.ToBucketID} {
+		if err := bucketAcceptsItems(getStore(r), field, bucketID); err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+	}
+	if err := prepareTransfer(getStore(r), transfer); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if err := getStore(r).NewTransfer(transfer); err != nil {
+		render.Render(w, r, ErrUpdate(err))
+		return
+	}
+	recordLegsAudit(r, auditCreate, nil, legSnapshots(getStore(r), transfer.ID))
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, newTransferResponse(transfer))
+}
+
+// getTransfer returns the specific Transfer loaded by TransferCtx.
+func getTransfer(w http.ResponseWriter, r *http.Request) {
+	transfer := r.Context().Value("transfer").(*Transfer)
+
+	setETag(w, transfer.Version)
+	if err := render.Render(w, r, newTransferResponse(transfer)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// updateTransfer updates the Transfer and both of its bucket items.
+func updateTransfer(w http.ResponseWriter, r *http.Request) {
+	transfer := r.Context().Value("transfer").(*Transfer)
+	if !checkIfMatch(w, r, transfer.Version) {
+		return
+	}
+	transferID, version := transfer.ID, transfer.Version
+	original := map[string]int{"from": transfer.FromBucketID, "to": transfer.ToBucketID}
+
+	data := &TransferRequest{Transfer: transfer}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	transfer = data.Transfer
+	transfer.Version = version
+	transfer.DeletedAt = nil
+	for field, bucketID := range map[string]int{"from": transfer.FromBucketID, "to": transfer.ToBucketID} {
+		if bucketID == original[field] {
+			continue
+		}
+		if err := bucketAcceptsItems(getStore(r), field, bucketID); err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+	}
+	if err := prepareTransfer(getStore(r), transfer); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	transfer.ID = 0 // the URL names the transfer, not the body
+	before := legSnapshots(getStore(r), transferID)
+	if err := getStore(r).UpdateTransfer(transferID, transfer); err != nil {
+		render.Render(w, r, ErrUpdate(err))
+		return
+	}
+	recordLegsAudit(r, auditUpdate, before, legSnapshots(getStore(r), transferID))
+
+	setETag(w, transfer.Version)
+	render.Render(w, r, newTransferResponse(transfer))
+}
+
+// deleteTransfer removes the Transfer together with both of its bucket items.
+func deleteTransfer(w http.ResponseWriter, r *http.Request) {
+	transfer := r.Context().Value("transfer").(*Transfer)
+	if !checkIfMatch(w, r, transfer.Version) {
+		return
+	}
+
+	before := legSnapshots(getStore(r), transfer.ID)
+	if err := getStore(r).RemoveTransfer(transfer.ID); err != nil {
+		render.Render(w, r, ErrUpdate(err))
+		return
+	}
+	recordLegsAudit(r, auditDelete, before, nil)
+
+	render.Render(w, r, newTransferResponse(transfer))
+}
+
+// TransferRequest is the request payload for Transfer data model.
+type TransferRequest struct {
+	*Transfer
+}
+
+func (a *TransferRequest) Bind(r *http.Request) error {
+	if a.Transfer == nil {
+		return errors.New("missing required Transfer fields")
+	}
+	return validate(getStore(r), a.Transfer)
+}
+
+// TransferResponse is the response payload for the Transfer data model.
+type TransferResponse struct {
+	*Transfer
+}
+
+func newTransferResponse(transfer *Transfer) *TransferResponse {
+	return &TransferResponse{Transfer: transfer}
+}
+
+func (rd *TransferResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+func newTransferListResponse(transfers []*Transfer) []render.Renderer {
+	list := []render.Renderer{}
+	for _, transfer := range transfers {
+		list = append(list, newTransferResponse(transfer))
+	}
+	return list
+}
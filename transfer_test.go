@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// summaryTotals returns the total of every bucket in /buckets/summary.
+func (ts *testServer) summaryTotals() map[int]Money {
+	ts.t.Helper()
+	var summaries []BucketSummary
+	ts.expect(http.StatusOK, &summaries, "GET", "/buckets/summary", "")
+	totals := map[int]Money{}
+	for _, bs := range summaries {
+		totals[bs.BucketID] = bs.Total
+	}
+	return totals
+}
+
+// transferLegs returns the bucket items of transfer id.
+func (ts *testServer) transferLegs(id int) []*BucketItem {
+	ts.t.Helper()
+	var bucketItems []*BucketItem
+	ts.expect(http.StatusOK, &bucketItems, "GET", "/bucketItems?limit=500", "")
+	var legs []*BucketItem
+	for _, bucketItem := range bucketItems {
+		if bucketItem.TransferID != nil && *bucketItem.TransferID == id {
+			legs = append(legs, bucketItem)
+		}
+	}
+	return legs
+}
+
+func TestTransferIsBalanced(t *testing.T) {
+	ts := newTestServer(t)
+	before := ts.summaryTotals()
+
+	var transfer Transfer
+	ts.expect(http.StatusCreated, &transfer, "POST", "/transfers", `{"from":1,"to":2,"name":"savings","amount":"12.50","transaction":"2026-01-01T00:00:00Z"}`)
+	if transfer.ToAmount != 1250 {
+		t.Errorf("toAmount %v, want the amount between buckets of one currency", transfer.ToAmount)
+	}
+
+	legs := ts.transferLegs(transfer.ID)
+	if len(legs) != 2 {
+		t.Fatalf("transfer %d has %d bucket items, want 2", transfer.ID, len(legs))
+	}
+	var net Money
+	for _, leg := range legs {
+		net += leg.Deposit - leg.Withdraw
+		switch leg.BucketID {
+		case 1:
+			if leg.Withdraw != 1250 || leg.Deposit != 0 {
+				t.Errorf("from leg %+v, want w 12.50", leg)
+			}
+		case 2:
+			if leg.Deposit != 1250 || leg.Withdraw != 0 {
+				t.Errorf("to leg %+v, want d 12.50", leg)
+			}
+		default:
+			t.Errorf("leg in bucket %d", leg.BucketID)
+		}
+	}
+	if net != 0 {
+		t.Errorf("legs add up to %v, want 0", net)
+	}
+	after := ts.summaryTotals()
+	if after[1] != before[1]-1250 || after[2] != before[2]+1250 {
+		t.Errorf("totals went from %v to %v", before, after)
+	}
+
+	// Editing one leg moves the other along.
+	var withdraw, deposit *BucketItem
+	for _, leg := range legs {
+		if leg.Withdraw > 0 {
+			withdraw = leg
+		} else {
+			deposit = leg
+		}
+	}
+	ts.expect(http.StatusOK, nil, "PATCH", "/bucketItems/"+strconv.Itoa(withdraw.ID), `{"w":"20.00"}`, "Content-Type", mergePatchType)
+	for _, leg := range ts.transferLegs(transfer.ID) {
+		if leg.ID == deposit.ID && leg.Deposit != 2000 {
+			t.Errorf("other leg %+v, want d 20.00", leg)
+		}
+	}
+	var e errorResponse
+	ts.expect(http.StatusBadRequest, &e, "PATCH", "/bucketItems/"+strconv.Itoa(withdraw.ID), `{"d":"1.00"}`, "Content-Type", mergePatchType)
+	if len(e.Fields) == 0 || e.Fields[0].Field != "d" {
+		t.Errorf("deposit on the withdraw leg: %+v, want a field error for d", e)
+	}
+
+	ts.expect(http.StatusOK, nil, "DELETE", "/transfers/"+strconv.Itoa(transfer.ID), "")
+	if legs := ts.transferLegs(transfer.ID); len(legs) != 0 {
+		t.Errorf("deleted transfer still has bucket items %+v", legs)
+	}
+	if totals := ts.summaryTotals(); totals[1] != before[1] || totals[2] != before[2] {
+		t.Errorf("totals after deleting the transfer %v, want %v", totals, before)
+	}
+}
+
+func TestCrossCurrencyTransferLegs(t *testing.T) {
+	ts := newTestServer(t)
+	var euros Bucket
+	ts.expect(http.StatusCreated, &euros, "POST", "/buckets", `{"name":"Euros","categoryID":2,"cur":"EUR"}`)
+	var transfer Transfer
+	ts.expect(http.StatusCreated, &transfer, "POST", "/transfers", fmt.Sprintf(`{"from":1,"to":%d,"name":"exchange","amount":"10.00","toAmount":"9.00","transaction":"2026-01-01T00:00:00Z"}`, euros.Id))
+
+	// Renaming either leg keeps both amounts.
+	for _, leg := range ts.transferLegs(transfer.ID) {
+		leg.Name = "renamed " + strconv.Itoa(leg.ID)
+		body, _ := json.Marshal(leg)
+		ts.expect(http.StatusOK, nil, "PUT", "/bucketItems/"+strconv.Itoa(leg.ID), string(body))
+
+		var got Transfer
+		ts.expect(http.StatusOK, &got, "GET", "/transfers/"+strconv.Itoa(transfer.ID), "")
+		if got.Name != leg.Name || got.Amount != 1000 || got.ToAmount != 900 {
+			t.Errorf("after renaming leg %d: %+v, want amount 10.00 and toAmount 9.00", leg.ID, got)
+		}
+	}
+	for _, leg := range ts.transferLegs(transfer.ID) {
+		if leg.BucketID == 1 && leg.Withdraw != 1000 || leg.BucketID == euros.Id && leg.Deposit != 900 {
+			t.Errorf("leg %+v after renaming", leg)
+		}
+	}
+}
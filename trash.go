@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+// Trash entry types, as listed by GET /trash and filtered with ?type=.
+const (
+	trashBucketItem = "bucketItem"
+	trashTransfer   = "transfer"
+)
+
+// TrashEntry is one deleted record waiting in the trash to be restored or
+// purged. Exactly one of BucketItem and Transfer is set, as told by Type.
+type TrashEntry struct {
+	Type       string      `json:"type"`
+	ID         int         `json:"id"`
+	DeletedAt  time.Time   `json:"deletedAt"`
+	BucketItem *BucketItem `json:"bucketItem,omitempty"`
+	Transfer   *Transfer   `json:"transfer,omitempty"` // its bucket items are restored with it
+}
+
+// listTrash lists everything in the trash, most recently deleted first.
+// ?type=bucketItem or ?type=transfer narrows it down to one kind.
+func listTrash(w http.ResponseWriter, r *http.Request) {
+	page, err := pageFromRequest(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	kind := r.URL.Query().Get("type")
+	if kind != "" && kind != trashBucketItem && kind != trashTransfer {
+		render.Render(w, r, ErrInvalidRequest(errors.New("type must be bucketItem or transfer")))
+		return
+	}
+
+	var entries []*TrashEntry
+	if kind == "" || kind == trashBucketItem {
+		bucketItems, err := getStore(r).GetDeletedBucketItems()
+		if err != nil {
+			render.Render(w, r, ErrStore(err))
+			return
+		}
+		for _, bucketItem := range bucketItems {
+			entries = append(entries, &TrashEntry{Type: trashBucketItem, ID: bucketItem.ID, DeletedAt: *bucketItem.DeletedAt, BucketItem: bucketItem})
+		}
+	}
+	if kind == "" || kind == trashTransfer {
+		transfers, err := getStore(r).GetDeletedTransfers()
+		if err != nil {
+			render.Render(w, r, ErrStore(err))
+			return
+		}
+		for _, transfer := range transfers {
+			entries = append(entries, &TrashEntry{Type: trashTransfer, ID: transfer.ID, DeletedAt: *transfer.DeletedAt, Transfer: transfer})
+		}
+	}
+	start, end, info := page.paginate(entries, func(i int) Cursor {
+		return Cursor{Key: timeKey(entries[i].DeletedAt) + entries[i].Type, ID: entries[i].ID}
+	}, true)
+	setPageHeaders(w, r, page, info)
+	if err := render.RenderList(w, r, newTrashListResponse(entries[start:end])); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// restoreBucketItem takes a BucketItem back out of the trash. The legs of
+// a transfer are restored through restoreTransfer instead.
+func restoreBucketItem(w http.ResponseWriter, r *http.Request) {
+	bucketItemID, ok := urlParamID(r, "bucketItemID")
+	if !ok {
+		render.Render(w, r, ErrInvalidID("bucketItemID"))
+		return
+	}
+	if err := getStore(r).RestoreBucketItem(bucketItemID); err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+
+	bucketItem, err := getStore(r).GetBucketItem(bucketItemID)
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+	recordAudit(r, auditBucketItem, bucketItem.ID, auditRestore, nil, snapshot(bucketItem))
+	render.Render(w, r, newBucketItemResponse(bucketItem, 0))
+}
+
+// restoreTransfer takes a Transfer, both of its bucket items included, back
+// out of the trash.
+func restoreTransfer(w http.ResponseWriter, r *http.Request) {
+	transferID, ok := urlParamID(r, "transferID")
+	if !ok {
+		render.Render(w, r, ErrInvalidID("transferID"))
+		return
+	}
+	if err := getStore(r).RestoreTransfer(transferID); err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+	recordLegsAudit(r, auditRestore, nil, legSnapshots(getStore(r), transferID))
+
+	transfer, err := getStore(r).GetTransfer(transferID)
+	if err != nil {
+		render.Render(w, r, ErrStore(err))
+		return
+	}
+	render.Render(w, r, newTransferResponse(transfer))
+}
+
+// runTrashPurger empties whatever has been in the trash longer than
+// retention, right away and then every interval until ctx is cancelled.
+func runTrashPurger(ctx context.Context, store Store, interval time.Duration, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := store.PurgeTrash(time.Now().UTC().Add(-retention)); err != nil {
+			log.Printf("trash: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (rd *TrashEntry) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+func newTrashListResponse(entries []*TrashEntry) []render.Renderer {
+	list := []render.Renderer{}
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	return list
+}
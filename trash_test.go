@@ -0,0 +1,154 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// trashedIDs returns the ids of the bucket items and the transfers in the
+// trash.
+func trashedIDs(t *testing.T, store Store) (bucketItemIDs []int, transferIDs []int) {
+	t.Helper()
+	bucketItems, err := store.GetDeletedBucketItems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bucketItem := range bucketItems {
+		bucketItemIDs = append(bucketItemIDs, bucketItem.ID)
+	}
+	transfers, err := store.GetDeletedTransfers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, transfer := range transfers {
+		transferIDs = append(transferIDs, transfer.ID)
+	}
+	return bucketItemIDs, transferIDs
+}
+
+func TestTrashAndRestore(t *testing.T) {
+	store := newSeededStore(t)
+	transfer := &Transfer{FromBucketID: 1, ToBucketID: 2, Name: "savings", Transaction: time.Now(), Amount: 500, ToAmount: 500}
+	if err := store.NewTransfer(transfer); err != nil {
+		t.Fatal(err)
+	}
+	legs, err := store.GetTransferBucketItems(transfer.ID)
+	if err != nil || len(legs) != 2 {
+		t.Fatalf("transfer legs %v, %v", legs, err)
+	}
+
+	if err := store.RemoveBucketItem(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveTransfer(transfer.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetBucketItem(1); err != errNoRecord {
+		t.Errorf("GetBucketItem of a trashed item = %v, want errNoRecord", err)
+	}
+	if _, err := store.GetBucketItem(legs[0].ID); err != errNoRecord {
+		t.Errorf("GetBucketItem of a trashed transfer's leg = %v, want errNoRecord", err)
+	}
+	bucketItemIDs, transferIDs := trashedIDs(t, store)
+	if !reflect.DeepEqual(bucketItemIDs, []int{1}) || !reflect.DeepEqual(transferIDs, []int{transfer.ID}) {
+		t.Errorf("trash holds bucket items %v and transfers %v, want [1] and [%d]", bucketItemIDs, transferIDs, transfer.ID)
+	}
+
+	tests := []struct {
+		name    string
+		restore func() error
+		want    error
+	}{
+		{"a transfer's leg", func() error { return store.RestoreBucketItem(legs[0].ID) }, errNoRecord},
+		{"bucket item", func() error { return store.RestoreBucketItem(1) }, nil},
+		{"bucket item again", func() error { return store.RestoreBucketItem(1) }, errNoRecord},
+		{"transfer", func() error { return store.RestoreTransfer(transfer.ID) }, nil},
+		{"transfer again", func() error { return store.RestoreTransfer(transfer.ID) }, errNoRecord},
+		{"missing bucket item", func() error { return store.RestoreBucketItem(99) }, errNoRecord},
+	}
+	for _, tt := range tests {
+		if err := tt.restore(); err != tt.want {
+			t.Errorf("restoring %s = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	if _, err := store.GetBucketItem(1); err != nil {
+		t.Errorf("restored bucket item: %v", err)
+	}
+	if legs, err := store.GetTransferBucketItems(transfer.ID); err != nil || len(legs) != 2 {
+		t.Errorf("restored transfer has legs %v, %v, want both", legs, err)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	tests := []struct {
+		name   string
+		before time.Duration // purge what was deleted before now plus this
+		purged bool
+	}{
+		{"within retention", -time.Hour, false},
+		{"past retention", time.Hour, true},
+	}
+	for _, tt := range tests {
+		store := newSeededStore(t)
+		transfer := &Transfer{FromBucketID: 1, ToBucketID: 2, Name: "savings", Transaction: time.Now(), Amount: 500, ToAmount: 500}
+		if err := store.NewTransfer(transfer); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.RemoveBucketItem(1); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.RemoveTransfer(transfer.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.PurgeTrash(time.Now().Add(tt.before)); err != nil {
+			t.Fatal(err)
+		}
+		bucketItemIDs, transferIDs := trashedIDs(t, store)
+		if purged := len(bucketItemIDs) == 0 && len(transferIDs) == 0; purged != tt.purged {
+			t.Errorf("%s: trash holds bucket items %v and transfers %v, purged %v, want %v", tt.name, bucketItemIDs, transferIDs, purged, tt.purged)
+		}
+		if tt.purged && len(store.bucketItems) != 0 {
+			t.Errorf("%s: purged bucket items are left over: %v", tt.name, store.bucketItems)
+		}
+	}
+}
+
+func TestRemoveBucketWithTrash(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       RemoveOptions
+		dependents Dependents
+		trashedIn  int // the bucket trashed bucket item 1 ends up in, 0 once removed
+	}{
+		{name: "plain", dependents: Dependents{"templateItems": 1, "trashedBucketItems": 1}},
+		{name: "cascade", opts: RemoveOptions{Cascade: true}},
+		{name: "reassign", opts: RemoveOptions{ReassignTo: 2}, trashedIn: 2},
+	}
+	for _, tt := range tests {
+		store := newSeededStore(t)
+		if err := store.RemoveBucketItem(1); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := store.RemoveBucket(1, tt.opts)
+		if tt.dependents != nil {
+			if e, ok := err.(*DependentsError); !ok || !reflect.DeepEqual(e.Dependents, tt.dependents) {
+				t.Errorf("%s: RemoveBucket = %v, want dependents %v", tt.name, err, tt.dependents)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: RemoveBucket: %v", tt.name, err)
+			continue
+		}
+		bucketItem, ok := store.bucketItems[1]
+		switch {
+		case tt.trashedIn == 0 && ok:
+			t.Errorf("%s: trashed bucket item 1 outlived its bucket", tt.name)
+		case tt.trashedIn != 0 && (!ok || bucketItem.BucketID != tt.trashedIn || bucketItem.DeletedAt == nil):
+			t.Errorf("%s: bucket item 1 = %+v, want it in the trash of bucket %d", tt.name, bucketItem, tt.trashedIn)
+		}
+	}
+}
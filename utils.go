@@ -1,6 +1,15 @@
 package main
 
-import "os"
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
 
 func readEnvOrDefault(key string, defaultVal string) string {
 	value := os.Getenv(key)
@@ -9,3 +18,67 @@ func readEnvOrDefault(key string, defaultVal string) string {
 	}
 	return value
 }
+
+// dayOf truncates t to midnight UTC of its calendar day.
+func dayOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// urlParamID reads the {name} URL parameter as a record id. ok is false
+// when it is not a positive whole number.
+func urlParamID(r *http.Request, name string) (id int, ok bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, name))
+	return id, err == nil && id > 0
+}
+
+// parseTimeParam reads an RFC 3339 timestamp or a 2006-01-02 date; a date
+// as the end of a range includes that whole day.
+func parseTimeParam(value string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	day, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return day, fmt.Errorf("invalid time %q, use 2006-01-02 or RFC 3339", value)
+	}
+	if end {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day, nil
+}
+
+// splitList reads the values of a list parameter, given comma separated,
+// repeated or both.
+func splitList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// parseIDList reads the ids of the list parameter name, see splitList.
+func parseIDList(values []string, name string) ([]int, error) {
+	var ids []int
+	for _, item := range splitList(values) {
+		id, err := strconv.Atoi(item)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("%s must list ids such as 1,2,3", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func containsInt(values []int, n int) bool {
+	for _, value := range values {
+		if value == n {
+			return true
+		}
+	}
+	return false
+}
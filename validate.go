@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Codes telling what is wrong with a field, for clients to act on without
+// parsing the message.
+const (
+	codeRequired = "required"  // missing, blank or empty
+	codeTooLong  = "too_long"  // longer than maxlen
+	codeTooSmall = "too_small" // below min, or not positive
+	codeInvalid  = "invalid"   // not an allowed value or format
+	codeNotFound = "not_found" // refers to a record that does not exist
+	codeArchived = "archived"  // refers to an archived bucket
+)
+
+// FieldError is one problem with one field of a request body.
+type FieldError struct {
+	Field   string `json:"field"` // as named in the JSON
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every problem found with a request body.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.messages(), "; ")
+}
+
+func (e *ValidationError) messages() []string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = field.Message
+	}
+	return messages
+}
+
+// add records a problem with field.
+func (e *ValidationError) add(field string, code string, format string, args ...interface{}) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// has reports whether a problem with field was recorded.
+func (e *ValidationError) has(field string) bool {
+	for _, fieldError := range e.Fields {
+		if fieldError.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldError is a ValidationError holding a single problem.
+func fieldError(field string, code string, format string, args ...interface{}) *ValidationError {
+	e := &ValidationError{}
+	e.add(field, code, format, args...)
+	return e
+}
+
+// fieldChecker is implemented by records with rules their validate tags
+// can't express, such as ones comparing two fields.
+type fieldChecker interface {
+	checkFields(e *ValidationError)
+}
+
+// references look up the records a ref= rule can point to.
+var references = map[string]func(store Store, id int) error{
+	"bucket": func(store Store, id int) error {
+		_, err := store.GetBucket(id)
+		return err
+	},
+	"category": func(store Store, id int) error {
+		_, err := store.GetCategory(id)
+		return err
+	},
+	"template": func(store Store, id int) error {
+		_, err := store.GetTemplate(id)
+		return err
+	},
+}
+
+// validate checks the struct v points to against the validate tags of its
+// fields, then its checkFields if it has one. The rules, comma separated:
+//
+//	required      not zero, blank or empty
+//	maxlen=N      at most N characters
+//	min=N         a number of at least N (Money in cents)
+//	positive      a number above 0
+//	oneof=a b c   one of the listed values
+//	currency      an ISO 4217 currency code
+//	ref=bucket    the id of an existing bucket (or category, template)
+//	dive          the rules of a slice's elements too
+//
+// Only required and the numeric rules look at a zero value, and a nil
+// pointer is only missing. It returns a *ValidationError listing every
+// problem, or nil.
+func validate(store Store, v interface{}) error {
+	e := &ValidationError{}
+	validateStruct(store, reflect.ValueOf(v).Elem(), "", e)
+	if checker, ok := v.(fieldChecker); ok {
+		checker.checkFields(e)
+	}
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+func validateStruct(store Store, value reflect.Value, prefix string, e *ValidationError) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		rules := field.Tag.Get("validate")
+		if rules == "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		validateField(store, value.Field(i), prefix+name, strings.Split(rules, ","), e)
+	}
+}
+
+func validateField(store Store, value reflect.Value, name string, rules []string, e *ValidationError) {
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			for _, rule := range rules {
+				if rule == "required" {
+					e.add(name, codeRequired, "%s is required", name)
+				}
+			}
+			return
+		}
+		value = value.Elem()
+	}
+	blank := isBlank(value)
+
+	for _, rule := range rules {
+		arg := ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			rule, arg = rule[:i], rule[i+1:]
+		}
+
+		switch rule {
+		case "required":
+			if blank {
+				e.add(name, codeRequired, "%s is required", name)
+				return
+			}
+		case "maxlen":
+			limit, _ := strconv.Atoi(arg)
+			if length := len([]rune(value.String())); length > limit {
+				e.add(name, codeTooLong, "%s must be at most %d characters", name, limit)
+			}
+		case "min":
+			limit, _ := strconv.ParseInt(arg, 10, 64)
+			if value.Int() < limit {
+				if limit == 0 {
+					e.add(name, codeTooSmall, "%s must not be negative", name)
+				} else {
+					e.add(name, codeTooSmall, "%s must be at least %d", name, limit)
+				}
+			}
+		case "positive":
+			if value.Int() <= 0 {
+				e.add(name, codeTooSmall, "%s must be positive", name)
+			}
+		case "oneof":
+			allowed := strings.Fields(arg)
+			if !blank && !containsString(allowed, value.String()) {
+				e.add(name, codeInvalid, "%s must be one of %s", name, strings.Join(allowed, ", "))
+			}
+		case "currency":
+			if !blank && !currencyPattern.MatchString(value.String()) {
+				e.add(name, codeInvalid, "%s must be an ISO 4217 currency code", name)
+			}
+		case "ref":
+			if !blank {
+				if err := references[arg](store, int(value.Int())); err != nil {
+					e.add(name, codeNotFound, "%s %d does not exist", arg, value.Int())
+				}
+			}
+		case "dive":
+			for i := 0; i < value.Len(); i++ {
+				element := value.Index(i)
+				if element.Kind() == reflect.Ptr {
+					if element.IsNil() {
+						continue
+					}
+					element = element.Elem()
+				}
+				validateStruct(store, element, fmt.Sprintf("%s[%d].", name, i), e)
+			}
+		default:
+			panic(fmt.Sprintf("validate: unknown rule %q on %s", rule, name))
+		}
+	}
+}
+
+// isBlank reports whether value is zero, or a blank string.
+func isBlank(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.String:
+		return strings.TrimSpace(value.String()) == ""
+	case reflect.Slice, reflect.Map:
+		return value.Len() == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int() == 0
+	case reflect.Bool:
+		return !value.Bool()
+	}
+	if t, ok := value.Interface().(time.Time); ok {
+		return t.IsZero()
+	}
+	return false
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}